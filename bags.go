@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"github.com/witheve/evingo/value"
+	"sort"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// Bags
+//------------------------------------------------------------------------------
+
+// A Bag is a named edb. A bag belongs to the user who made it, who can share
+// it with other users; a bag with no owner is everybody's.
+type Bag struct {
+	Id      value.Uuid
+	Name    string
+	owner   value.Uuid
+	lock    sync.Mutex
+	readers map[value.Uuid]bool
+	db      *edb
+}
+
+// Bags is a registry of bags by id and by name
+type Bags struct {
+	lock   sync.Mutex
+	byId   map[value.Uuid]*Bag
+	byName map[string]*Bag
+}
+
+func NewBags() *Bags {
+	return &Bags{byId: make(map[value.Uuid]*Bag), byName: make(map[string]*Bag)}
+}
+
+// Create makes a new, empty bag. Names are unique across the registry.
+func (bags *Bags) Create(name string, owner value.Uuid) (*Bag, error) {
+	bags.lock.Lock()
+	defer bags.lock.Unlock()
+	if _, ok := bags.byName[name]; ok {
+		return nil, errors.New("there is already a bag called '" + name + "'")
+	}
+	var bag = &Bag{Id: *value.NewUuid(), Name: name, owner: owner, readers: make(map[value.Uuid]bool), db: NewEdb()}
+	bags.byId[bag.Id] = bag
+	bags.byName[name] = bag
+	return bag, nil
+}
+
+// Get looks a bag up by id
+func (bags *Bags) Get(id value.Uuid) (*Bag, bool) {
+	bags.lock.Lock()
+	defer bags.lock.Unlock()
+	var bag, ok = bags.byId[id]
+	return bag, ok
+}
+
+// Lookup looks a bag up by name
+func (bags *Bags) Lookup(name string) (*Bag, bool) {
+	bags.lock.Lock()
+	defer bags.lock.Unlock()
+	var bag, ok = bags.byName[name]
+	return bag, ok
+}
+
+// Share lets user read and write the bag
+func (bag *Bag) Share(user value.Uuid) {
+	bag.lock.Lock()
+	defer bag.lock.Unlock()
+	bag.readers[user] = true
+}
+
+// VisibleTo is true if user owns the bag, it's been shared with them, or
+// it's nobody's
+func (bag *Bag) VisibleTo(user value.Uuid) bool {
+	bag.lock.Lock()
+	defer bag.lock.Unlock()
+	return bag.owner.IsZero() || bag.owner == user || bag.readers[user]
+}
+
+// Visible are the bags user can see, sorted by name
+func (bags *Bags) Visible(user value.Uuid) []*Bag {
+	bags.lock.Lock()
+	var all []*Bag
+	for _, bag := range bags.byName {
+		all = append(all, bag)
+	}
+	bags.lock.Unlock()
+	var result []*Bag
+	for _, bag := range all {
+		if bag.VisibleTo(user) {
+			result = append(result, bag)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Context is how user runs queries over the named bags. Queries read from all
+// of them and write to the first. It's an error to name a bag that doesn't
+// exist or that user can't see.
+func (bags *Bags) Context(user value.Uuid, names ...string) (context, error) {
+	if len(names) == 0 {
+		return context{}, errors.New("a context needs at least one bag")
+	}
+	var c = context{user: user}
+	for ix, name := range names {
+		var bag, ok = bags.Lookup(name)
+		if !ok || !bag.VisibleTo(user) {
+			// not saying which keeps other users' bag names to themselves
+			return context{}, errors.New("no bag called '" + name + "'")
+		}
+		if ix == 0 {
+			c.bag = bag.Id
+			c.e = *bag.db
+		} else {
+			c.reads = append(c.reads, bag.db)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/witheve/evingo/util/color"
+	"io"
+	"os"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Commands
+//------------------------------------------------------------------------------
+
+// A command is one of evingo's subcommands. setup declares the command's
+// flags and returns what runs it, which gets the arguments left once flags
+// are taken out.
+type command struct {
+	name    string
+	args    string // what the arguments look like, for help
+	summary string
+	setup   func(flags *flag.FlagSet) func(args []string) error
+}
+
+// Exit codes
+const (
+	exitOk     = 0
+	exitFailed = 1 // the command ran and found a problem
+	exitUsage  = 2 // the command line was wrong
+)
+
+// a usageError is a mistake on the command line rather than in what the
+// command was given
+type usageError struct {
+	msg string
+}
+
+func (err *usageError) Error() string {
+	return err.msg
+}
+
+// errReported means the command has already explained what went wrong
+var errReported = errors.New("failed")
+
+// expectArgs checks how many arguments a command got
+func expectArgs(args []string, min int, max int) error {
+	if len(args) < min {
+		return &usageError{"not enough arguments"}
+	}
+	if max >= 0 && len(args) > max {
+		return &usageError{"too many arguments"}
+	}
+	return nil
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseFlags parses flags wherever they are among the arguments, so
+// `evingo run file.e --format json` works as well as the other way round
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func newFlagSet(c *command, out io.Writer) *flag.FlagSet {
+	var flags = flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() { commandHelp(out, c, flags) }
+	return flags
+}
+
+func commandHelp(out io.Writer, c *command, flags *flag.FlagSet) {
+	fmt.Fprintf(out, "usage: evingo %s %s\n\n%s\n", c.name, c.args, c.summary)
+	var hasFlags = false
+	flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(out, "\nflags:")
+		flags.PrintDefaults()
+	}
+}
+
+func help(out io.Writer) {
+	fmt.Fprintf(out, "Welcome to %s", color.Bright("Eve!\n"))
+	fmt.Fprintln(out, "usage: evingo <command> [flags] [arguments]")
+	fmt.Fprintln(out, "\nHere are the available commands:")
+	var width = 0
+	for _, c := range commands {
+		if len(c.name) > width {
+			width = len(c.name)
+		}
+	}
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %s%s  %s\n", color.Bright(c.name), strings.Repeat(" ", width-len(c.name)), c.summary)
+	}
+	fmt.Fprintln(out, "\nRun 'evingo help <command>' for a command's flags.")
+}
+
+// runCommand runs the command line and returns the exit code
+func runCommand(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		help(out)
+		return exitOk
+	}
+	var name = args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		if len(args) > 1 {
+			if c := findCommand(args[1]); c != nil {
+				var flags = newFlagSet(c, out)
+				c.setup(flags)
+				commandHelp(out, c, flags)
+				return exitOk
+			}
+			fmt.Fprintln(out, color.Error("Unknown command '"+args[1]+"'"))
+			return exitUsage
+		}
+		help(out)
+		return exitOk
+	}
+	var c = findCommand(name)
+	if c == nil {
+		fmt.Fprintln(out, color.Error("Unknown command '"+name+"'"))
+		help(out)
+		return exitUsage
+	}
+	var flags = newFlagSet(c, out)
+	var run = c.setup(flags)
+	positional, err := parseFlags(flags, args[1:])
+	if err == flag.ErrHelp {
+		return exitOk
+	}
+	if err != nil {
+		// the flag package has already said what was wrong
+		return exitUsage
+	}
+	err = run(positional)
+	switch err.(type) {
+	case nil:
+		return exitOk
+	case *usageError:
+		fmt.Fprintln(out, color.Error(err.Error()))
+		commandHelp(out, c, flags)
+		return exitUsage
+	}
+	if err != errReported {
+		fmt.Fprintln(os.Stderr, color.Error("ERROR: "+err.Error()))
+	}
+	return exitFailed
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"github.com/witheve/evingo/parser"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestRunCommandExitCodes(t *testing.T) {
+	var cases = []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, exitOk},
+		{[]string{"help", "run"}, exitOk},
+		{[]string{"dot"}, exitUsage},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"load"}, exitUsage},
+		{[]string{"run", "examples/counter.e", "--format", "xml"}, exitUsage},
+		{[]string{"check", "--nope", "examples/counter.e"}, exitUsage},
+		{[]string{"load", "fruity.json", "--quiet"}, exitOk},
+		{[]string{"load", "missing.json", "--quiet"}, exitFailed},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		if code := runCommand(c.args, &out); code != c.code {
+			t.Errorf("evingo %v exited %d, expected %d\n%s", c.args, code, c.code, out.String())
+		}
+	}
+}
+
+func TestFormatKeepsMeaning(t *testing.T) {
+	// objects in mutations are named after where they are, which formatting
+	// moves
+	var position = regexp.MustCompile(`-\d+\.\d+`)
+	var compiled = func(code string) []string {
+		var facts []string
+		for _, fact := range parser.ParseString(code).Facts {
+			if fact.Attribute != "line" && fact.Attribute != "offset" {
+				facts = append(facts, position.ReplaceAllString(fact.String(), ""))
+			}
+		}
+		return facts
+	}
+	// examples that use syntax the parser doesn't have yet
+	var unparsed = map[string]bool{
+		"examples/chat.e": true, // #channel-input: element
+	}
+	paths, _ := filepath.Glob("examples/*.e")
+	paths = append(paths, "")
+	for _, path := range paths {
+		var code = "// people\nget people! // all of them\n    #person   name age\n      // the age\n      age   = 3\n\n\n\ncount them\n    total = count(given: name)\n"
+		if path != "" {
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code = string(raw)
+		}
+		formatted, err := parser.Format(code)
+		if err != nil {
+			if unparsed[path] {
+				continue
+			}
+			t.Fatalf("%s: %v", path, err)
+		}
+		if unparsed[path] {
+			t.Errorf("%s parses now, so it can come off the list", path)
+		}
+		if again, _ := parser.Format(formatted); again != formatted {
+			t.Errorf("%s: formatting twice changed it again:\n%s", path, again)
+		}
+		if !reflect.DeepEqual(compiled(code), compiled(formatted)) {
+			t.Errorf("%s: formatting changed what the program means:\n%s", path, formatted)
+		}
+		if path == "" {
+			var expected = "// people\nget people! // all of them\n  #person name, age\n    // the age\n    age: 3\n\ncount them\n  total = count(given: name)\n"
+			if formatted != expected {
+				t.Errorf("Unexpected formatting:\n%s", formatted)
+			}
+		}
+	}
+	if _, err := parser.Format("broken\n  #: x\n"); err == nil {
+		t.Error("Expected code that doesn't parse to be left alone")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Graphviz
+//------------------------------------------------------------------------------
+
+// Each kind of node gets its own shape so a graph reads at a glance
+var dotShapes = map[string]string{
+	"variable":   "ellipse",
+	"constant":   "plaintext",
+	"scan":       "box",
+	"expression": "hexagon",
+	"mutate":     "house",
+	"not":        "octagon",
+	"union":      "trapezium",
+	"choose":     "invtrapezium",
+}
+
+func dotString(s string) string {
+	return "\"" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
+
+// dotWriter keeps node names unique across queries, since a sub-query can
+// use the same ids as the query it's part of
+type dotWriter struct {
+	out      strings.Builder
+	clusters int
+}
+
+func (w *dotWriter) line(pad string, text string) {
+	w.out.WriteString(pad + text + "\n")
+}
+
+func (w *dotWriter) node(pad string, name string, kind string, label string) {
+	w.line(pad, dotString(name)+" [shape="+dotShapes[kind]+", label="+dotString(label)+"]")
+}
+
+func (w *dotWriter) edge(pad string, from string, to string, attributes ...string) {
+	var text = dotString(from) + " -> " + dotString(to)
+	if len(attributes) > 0 {
+		text += " [" + strings.Join(attributes, ", ") + "]"
+	}
+	w.line(pad, text)
+}
+
+// A dotScope names the node for each variable a query can see, by name: a
+// not's body shares the variables of the queries it's inside that have the
+// same name, the way the planner sees them
+type dotScope map[string]string
+
+func (scope dotScope) variable(variable *VariableNode) string {
+	if name, ok := scope[variable.name]; ok {
+		return name
+	}
+	return variable.id
+}
+
+// bindings draws an edge for each binding between source and its variable or
+// constant, labelled with the field. Scans and expressions point at what they
+// bind; mutates are pointed at by what they write.
+func (w *dotWriter) bindings(pad string, prefix string, scope dotScope, source string, bindings []*BindingNode, into bool) {
+	var sorted = append([]*BindingNode(nil), bindings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+	for _, binding := range sorted {
+		var target string
+		if binding.IsConstant() {
+			target = prefix + binding.id
+			w.node(pad, target, "constant", binding.constant.String())
+		} else {
+			target = scope.variable(binding.variable)
+		}
+		if into {
+			w.edge(pad, target, source, "label="+dotString(binding.field))
+		} else {
+			w.edge(pad, source, target, "label="+dotString(binding.field))
+		}
+	}
+}
+
+// query draws a query as a cluster and returns the cluster's name. Edges
+// into the cluster attach to its entry point.
+func (w *dotWriter) query(pad string, query *QueryNode, outer dotScope) string {
+	w.clusters++
+	var cluster = "cluster_" + strconv.Itoa(w.clusters)
+	var prefix = cluster + "/"
+	var scope = make(dotScope)
+	for id, name := range outer {
+		scope[id] = name
+	}
+	var own []string
+	for _, id := range orderedKeys(MapToInterfaces(query.variables)) {
+		var name = query.variables[id].name
+		if _, ok := outer[name]; !ok {
+			scope[name] = prefix + id
+			own = append(own, id)
+		}
+	}
+	var label = query.name
+	if label == "" {
+		label = query.id
+	}
+	w.line(pad, "subgraph "+cluster+" {")
+	var inner = pad + "  "
+	w.line(inner, "label="+dotString(label))
+	w.line(inner, dotString(entryOf(cluster))+" [shape=point]")
+
+	for _, id := range own {
+		w.node(inner, prefix+id, "variable", query.variables[id].name)
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.scans)) {
+		w.node(inner, prefix+id, "scan", "scan")
+		w.bindings(inner, prefix, scope, prefix+id, query.scans[id].bindings, false)
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.expressions)) {
+		var expression = query.expressions[id]
+		w.node(inner, prefix+id, "expression", expression.operator)
+		w.bindings(inner, prefix, scope, prefix+id, expression.bindings, false)
+		for ix, variable := range expression.projection {
+			if variable != nil {
+				w.edge(inner, scope.variable(variable), prefix+id, "style=dashed", "label="+dotString("given "+strconv.Itoa(ix)))
+			}
+		}
+		for ix, variable := range expression.grouping {
+			if variable != nil {
+				w.edge(inner, scope.variable(variable), prefix+id, "style=dashed", "label="+dotString("per "+strconv.Itoa(ix)))
+			}
+		}
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.mutates)) {
+		var mutate = query.mutates[id]
+		var label = mutate.operator
+		if mutate.forever {
+			label += " forever"
+		}
+		w.node(inner, prefix+id, "mutate", label)
+		w.bindings(inner, prefix, scope, prefix+id, mutate.bindings, true)
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.nots)) {
+		w.node(inner, prefix+id, "not", "not")
+		var body = w.query(inner, query.nots[id].body, scope)
+		w.edge(inner, prefix+id, entryOf(body), "lhead="+body)
+	}
+	var members = func(id string, kind string, queries []*QueryNode) {
+		w.node(inner, prefix+id, kind, kind)
+		for ix, member := range queries {
+			var sub = w.query(inner, member, scope)
+			w.edge(inner, prefix+id, entryOf(sub), "lhead="+sub, "label="+dotString(strconv.Itoa(ix)))
+		}
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.unions)) {
+		members(id, "union", query.unions[id].members)
+	}
+	for _, id := range orderedKeys(MapToInterfaces(query.chooses)) {
+		members(id, "choose", query.chooses[id].members)
+	}
+	w.line(pad, "}")
+	return cluster
+}
+
+func entryOf(cluster string) string {
+	return cluster + "/entry"
+}
+
+// QueriesToDot draws queries as a Graphviz digraph with a cluster for each
+// query, nested for the bodies of nots, unions and chooses
+func QueriesToDot(queries []*QueryNode) string {
+	var w = &dotWriter{}
+	w.line("", "digraph program {")
+	w.line("  ", "compound=true")
+	for _, query := range queries {
+		w.query("  ", query, nil)
+	}
+	w.line("", "}")
+	return w.out.String()
+}
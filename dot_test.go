@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"strings"
+	"testing"
+)
+
+func TestQueriesToDot(t *testing.T) {
+	var outer = NewQuery("q1")
+	outer.name = "lonely"
+	var person = &VariableNode{id: "q1.person", name: "person"}
+	outer.variables[person.id] = person
+	var scan = &ScanNode{id: "s1"}
+	scan.bindings = []*BindingNode{
+		{id: "b1", variable: person, field: "entity", source: scan},
+		{id: "b2", constant: value.NewText("tag"), field: "attribute", source: scan},
+	}
+	outer.scans[scan.id] = scan
+
+	// the body has its own person, which is the outer one by name, and a
+	// friend of its own
+	var body = NewQuery("q2")
+	var bodyPerson = &VariableNode{id: "q2.person", name: "person"}
+	var friendOf = &VariableNode{id: "q2.friend", name: "friend"}
+	body.variables[bodyPerson.id] = bodyPerson
+	body.variables[friendOf.id] = friendOf
+	var friend = &ScanNode{id: "s2"}
+	friend.bindings = []*BindingNode{
+		{id: "b3", variable: bodyPerson, field: "entity", source: friend},
+		{id: "b4", variable: friendOf, field: "value", source: friend},
+	}
+	body.scans[friend.id] = friend
+
+	var count = &ExpressionNode{id: "e1", operator: "count"}
+	count.projection = []*VariableNode{person}
+	count.grouping = []*VariableNode{person}
+	outer.expressions[count.id] = count
+	outer.nots["n1"] = &NotNode{id: "n1", body: body}
+
+	var dot = QueriesToDot([]*QueryNode{outer})
+	for _, expected := range []string{
+		"subgraph cluster_1 {",
+		`label="lonely"`,
+		`"cluster_1/s1" [shape=box, label="scan"]`,
+		`"cluster_1/s1" -> "cluster_1/q1.person" [label="entity"]`,
+		`"cluster_1/b2" [shape=plaintext, label="\"tag\""]`,
+		`"cluster_1/n1" [shape=octagon, label="not"]`,
+		"subgraph cluster_2 {",
+		`"cluster_1/q1.person" -> "cluster_1/e1" [style=dashed, label="given 0"]`,
+		`"cluster_1/q1.person" -> "cluster_1/e1" [style=dashed, label="per 0"]`,
+		// the body's scan binds the outer query's variable
+		`"cluster_2/s2" -> "cluster_1/q1.person" [label="entity"]`,
+		`"cluster_2/q2.friend" [shape=ellipse, label="friend"]`,
+		`"cluster_2/s2" -> "cluster_2/q2.friend" [label="value"]`,
+		`"cluster_1/n1" -> "cluster_2/entry" [lhead=cluster_2]`,
+	} {
+		if !strings.Contains(dot, expected) {
+			t.Errorf("Expected the graph to contain %s\n%s", expected, dot)
+		}
+	}
+	if strings.Contains(dot, "q2.person") {
+		t.Errorf("Expected the body's person not to be drawn apart from the outer one\n%s", dot)
+	}
+	if QueriesToDot([]*QueryNode{outer}) != dot {
+		t.Error("Drawing the same query twice gave different graphs")
+	}
+}
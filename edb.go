@@ -3,20 +3,56 @@ package main
 import (
 	"github.com/witheve/evingo/gotomic"
 	"github.com/witheve/evingo/value"
+	"sync"
+	"sync/atomic"
 )
 
 type edb struct {
-	h         *gotomic.Hash
-	listeners map[*func(e, a, v value.Value)]struct{}
+	h         *gotomic.Hash // entity -> attribute -> value
+	ave       *index
+	vae       *index
+	listeners *factListeners
+	stats     *statistics
+	commits   *commits
+	history   *history
+}
+
+// A FactListener hears about every fact added to (OpInsert) or removed from
+// (OpRemove) an edb. Inserts are announced once the fact is visible, removes
+// while it still is, so a listener can always find the fact's neighbours.
+type FactListener func(op value.Operator, e, a, v value.Value)
+
+type factListeners struct {
+	lock sync.Mutex
+	fs   map[*FactListener]struct{}
+}
+
+// statistics are running counts the planner estimates cardinalities from.
+// They're keyed by the String() of attributes and values.
+type statistics struct {
+	lock       sync.Mutex
+	facts      int
+	entities   int
+	attributes map[string]*attributeStatistics
+}
+
+type attributeStatistics struct {
+	facts    int
+	entities int
+	values   map[string]int
 }
 
 type attributeSet struct {
+	facts     int64 // how many facts the entity has; first, so it's aligned for atomic access
 	h         *gotomic.Hash
 	listeners map[*func(a, v value.Value)]struct{}
 }
 
 func NewAttributeSet() *attributeSet {
-	return nil
+	return &attributeSet{
+		h:         gotomic.NewHash(),
+		listeners: make(map[*func(a, v value.Value)]struct{}),
+	}
 }
 
 type valueSet struct {
@@ -25,25 +61,176 @@ type valueSet struct {
 }
 
 func NewValueSet() *valueSet {
-	return nil
+	return &valueSet{
+		h:         gotomic.NewHash(),
+		listeners: make(map[*func(v value.Value)]struct{}),
+	}
 }
 
 type context struct {
 	user value.Uuid
 	bag  value.Uuid
-	// time restriction
-	e edb
+	asOf uint64 // the commit to read the edb as of, or 0 for as it is now
+	e    edb
+	// bags read alongside e. Writes only ever go to e.
+	reads []*edb
+}
+
+// edbs are every bag the context reads, the one it writes first
+func (c context) edbs() []*edb {
+	return append([]*edb{&c.e}, c.reads...)
+}
+
+// elsewhere reports whether a fact is in one of c's bags other than db, in
+// which case db gaining or losing it makes no difference to what c sees
+func (c context) elsewhere(db *edb, e, a, v value.Value) bool {
+	for _, other := range c.edbs() {
+		if other.h != db.h && scanEdb(other, e, a, v, func(e, a, v value.Value) bool { return true }) {
+			return true
+		}
+	}
+	return false
 }
 
 // per bag
 func NewEdb() *edb {
 	return &edb{
 		h:         gotomic.NewHash(),
-		listeners: make(map[*func(e, a, v value.Value)]struct{}),
+		ave:       newIndex([3]int{1, 2, 0}),
+		vae:       newIndex([3]int{2, 1, 0}),
+		listeners: &factListeners{fs: make(map[*FactListener]struct{})},
+		stats:     &statistics{attributes: make(map[string]*attributeStatistics)},
+		commits:   &commits{listeners: &commitListeners{fs: make(map[*CommitListener]struct{})}},
+		history:   newHistory(),
+	}
+}
+
+func (s *statistics) record(newEntity, newAttribute bool, a, v value.Value) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var as, ok = s.attributes[a.String()]
+	if !ok {
+		as = &attributeStatistics{values: make(map[string]int)}
+		s.attributes[a.String()] = as
+	}
+	s.facts++
+	as.facts++
+	as.values[v.String()]++
+	if newEntity {
+		s.entities++
+	}
+	if newAttribute {
+		as.entities++
+	}
+}
+
+// forget undoes record for a fact that's been removed
+func (s *statistics) forget(lastOfEntity, lastOfAttribute bool, a, v value.Value) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var as, ok = s.attributes[a.String()]
+	if !ok {
+		return
+	}
+	s.facts--
+	as.facts--
+	if as.values[v.String()]--; as.values[v.String()] <= 0 {
+		delete(as.values, v.String())
+	}
+	if lastOfEntity {
+		s.entities--
+	}
+	if lastOfAttribute {
+		as.entities--
+	}
+	if as.facts <= 0 {
+		delete(s.attributes, a.String())
+	}
+}
+
+// Listen calls f for every fact added or removed from now on, until the
+// returned function is called
+func (db *edb) Listen(f FactListener) func() {
+	var key = &f
+	db.listeners.lock.Lock()
+	db.listeners.fs[key] = struct{}{}
+	db.listeners.lock.Unlock()
+	return func() {
+		db.listeners.lock.Lock()
+		delete(db.listeners.fs, key)
+		db.listeners.lock.Unlock()
+	}
+}
+
+func (db *edb) announce(op value.Operator, e, a, v value.Value) {
+	db.listeners.lock.Lock()
+	var fs []FactListener
+	for f := range db.listeners.fs {
+		fs = append(fs, *f)
+	}
+	db.listeners.lock.Unlock()
+	for _, f := range fs {
+		f(op, e, a, v)
+	}
+}
+
+func max1(n int) float64 {
+	if n < 1 {
+		return 1
+	}
+	return float64(n)
+}
+
+// Estimate guesses how many facts a scan will produce each time it runs.
+// Constants are passed as values; bound marks fields that will have a value
+// from an earlier step by the time the scan runs, though we can't know what
+// it is while planning.
+func (db *edb) Estimate(e, a, v value.Value, bound [3]bool) int {
+	var s = db.stats
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var rows float64
+	if a != nil {
+		var as, ok = s.attributes[a.String()]
+		if !ok {
+			return 0
+		}
+		rows = float64(as.facts)
+		if v != nil {
+			rows = float64(as.values[v.String()])
+		} else if bound[2] {
+			rows /= max1(len(as.values))
+		}
+		if e != nil || bound[0] {
+			rows /= max1(as.entities)
+		}
+	} else {
+		rows = float64(s.facts)
+		if bound[1] {
+			rows /= max1(len(s.attributes))
+		}
+		if e != nil || bound[0] {
+			rows /= max1(s.entities)
+		}
+		if v != nil || bound[2] {
+			// assume values are mostly distinct within an attribute
+			rows /= max1(s.facts) / max1(len(s.attributes))
+		}
+	}
+	if rows > 0 && rows < 1 {
+		return 1
 	}
+	return int(rows)
 }
 
-func insert(c context, e, a, v value.Value) {
+// insert adds a fact straight to the edb, returning whether it was new.
+// Anything other than loading and tests should go through a Transaction.
+// The past can't be changed, so it does nothing to a context read as of a
+// commit.
+func insert(c context, e, a, v value.Value) bool {
+	if c.asOf != 0 {
+		return false
+	}
 	// there is a race here that we can close
 	// by refactoring the interface, but the consequence
 	// of losing it is only a pointless allocation
@@ -51,16 +238,261 @@ func insert(c context, e, a, v value.Value) {
 	var vs interface{}
 	var ok bool
 
+	var newEntity, newAttribute bool
+
 	if as, ok = c.e.h.Get(e); !ok {
-		as = c.e.h.PutIfMissing(e, NewAttributeSet())
+		newEntity = c.e.h.PutIfMissing(e, NewAttributeSet())
+		as, _ = c.e.h.Get(e)
 	}
 	if vs, ok = as.(*attributeSet).h.Get(a); !ok {
-		vs = as.(*attributeSet).h.PutIfMissing(a, NewValueSet())
+		newAttribute = as.(*attributeSet).h.PutIfMissing(a, NewValueSet())
+		vs, _ = as.(*attributeSet).h.Get(a)
+	}
+	if _, existed := vs.(*valueSet).h.Put(v, struct{}{}); !existed {
+		atomic.AddInt64(&as.(*attributeSet).facts, 1)
+		c.e.ave.add(e, a, v)
+		c.e.vae.add(e, a, v)
+		c.e.stats.record(newEntity, newAttribute, a, v)
+		c.e.history.record(value.OpInsert, c.e.commits.last+1, e, a, v)
+		c.e.announce(value.OpInsert, e, a, v)
+		return true
+	}
+	return false
+}
+
+// remove takes a fact out of the edb, dropping the entity's attribute and
+// then the entity itself once nothing is left in them. It returns whether
+// there was anything to remove.
+func remove(c context, e, a, v value.Value) bool {
+	if c.asOf != 0 {
+		return false
+	}
+	var as, ok = c.e.h.Get(e)
+	if !ok {
+		return false
+	}
+	var attributes = as.(*attributeSet)
+	vs, ok := attributes.h.Get(a)
+	if !ok {
+		return false
+	}
+	var values = vs.(*valueSet)
+	if _, ok := values.h.Get(v); !ok {
+		return false
+	}
+	c.e.announce(value.OpRemove, e, a, v)
+	if _, ok := values.h.Delete(v); !ok {
+		return false
+	}
+	atomic.AddInt64(&attributes.facts, -1)
+	c.e.ave.remove(e, a, v)
+	c.e.vae.remove(e, a, v)
+	var lastOfAttribute, lastOfEntity bool
+	if values.h.Size() == 0 {
+		attributes.h.Delete(a)
+		lastOfAttribute = true
+		if attributes.h.Size() == 0 {
+			c.e.h.Delete(e)
+			lastOfEntity = true
+		}
+	}
+	c.e.stats.forget(lastOfEntity, lastOfAttribute, a, v)
+	c.e.history.record(value.OpRemove, c.e.commits.last+1, e, a, v)
+	return true
+}
+
+// Scan makes a context a value.Relation, so compiled plans can read from it
+func (c context) Scan(e, a, v value.Value, f func(e, a, v value.Value)) {
+	scan(c, e, a, v, f)
+}
+
+// Contains reports whether any fact matches the pattern
+func (c context) Contains(e, a, v value.Value) bool {
+	if c.asOf != 0 {
+		return scanUntil(c, e, a, v, func(e, a, v value.Value) bool {
+			return true
+		})
+	}
+	for _, db := range c.edbs() {
+		if db.count(e, a, v) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSeek is true when something is known, so an index can find the facts;
+// otherwise it walks every entity
+func (c context) CanSeek(e, a, v value.Value) bool {
+	return e != nil || a != nil || v != nil
+}
+
+// Count is how many facts match the pattern, read from the sizes the edb
+// keeps rather than by finding them, since a generic join asks all the time.
+// A fact in more than one of c's bags is counted once per bag. Only reading
+// as of an earlier commit walks the facts.
+func (c context) Count(e, a, v value.Value) int {
+	var count = 0
+	if c.asOf != 0 {
+		scan(c, e, a, v, func(e, a, v value.Value) {
+			count++
+		})
+		return count
+	}
+	for _, db := range c.edbs() {
+		count += db.count(e, a, v)
+	}
+	return count
+}
+
+// count is Count for one edb. Everything but a known entity and value with
+// an unknown attribute is a lookup or two; that walks the entity's
+// attributes.
+func (db *edb) count(e, a, v value.Value) int {
+	if e == nil {
+		switch {
+		case a != nil:
+			return db.ave.count(e, a, v)
+		case v != nil:
+			return db.vae.count(e, a, v)
+		}
+		db.stats.lock.Lock()
+		defer db.stats.lock.Unlock()
+		return db.stats.facts
+	}
+	var as, ok = db.h.Get(e)
+	if !ok {
+		return 0
+	}
+	var attributes = as.(*attributeSet)
+	switch {
+	case a != nil:
+		var vs, ok = attributes.h.Get(a)
+		if !ok {
+			return 0
+		}
+		if v == nil {
+			return vs.(*valueSet).h.Size()
+		}
+		if _, ok := vs.(*valueSet).h.Get(v); ok {
+			return 1
+		}
+		return 0
+	case v == nil:
+		return int(atomic.LoadInt64(&attributes.facts))
+	}
+	var count = 0
+	attributes.h.Each(func(_ gotomic.Hashable, vs interface{}) bool {
+		if _, ok := vs.(*valueSet).h.Get(v); ok {
+			count++
+		}
+		return false
+	})
+	return count
+}
+
+// scan calls f with every fact matching the pattern. A nil e, a or v is
+// unbound and matches anything; a non-nil one is a pre-bound filter, which
+// is how constant bindings on a ScanNode reach the edb.
+func scan(c context, e, a, v value.Value, f func(e, a, v value.Value)) {
+	scanUntil(c, e, a, v, func(e, a, v value.Value) bool {
+		f(e, a, v)
+		return false
+	})
+}
+
+// scanUntil is scan, but stops as soon as f returns true. It returns
+// whether it was stopped. A fact in more than one of c's bags is only seen
+// once, from the first of them.
+func scanUntil(c context, e, a, v value.Value, f func(e, a, v value.Value) bool) bool {
+	var dbs = c.edbs()
+	for ix, db := range dbs {
+		var earlier = dbs[:ix]
+		var stopped = c.scanEdb(db, e, a, v, func(e, a, v value.Value) bool {
+			for _, other := range earlier {
+				if c.scanEdb(other, e, a, v, func(e, a, v value.Value) bool { return true }) {
+					return false
+				}
+			}
+			return f(e, a, v)
+		})
+		if stopped {
+			return true
+		}
+	}
+	return false
+}
+
+func (c context) scanEdb(db *edb, e, a, v value.Value, f func(e, a, v value.Value) bool) bool {
+	if c.asOf != 0 {
+		return db.history.scanAsOf(c.asOf, e, a, v, f)
+	}
+	return scanEdb(db, e, a, v, f)
+}
+
+// scanEdb walks whichever of db's indexes starts with something bound: EAV
+// for a known entity, AVE for a known attribute, VAE for a known value, and
+// every entity when nothing is known.
+func scanEdb(db *edb, e, a, v value.Value, f func(e, a, v value.Value) bool) bool {
+	if e == nil {
+		if a != nil {
+			return db.ave.scan(e, a, v, f)
+		}
+		if v != nil {
+			return db.vae.scan(e, a, v, f)
+		}
+	}
+	var eachValue = func(e, a value.Value, vs *valueSet) bool {
+		if v != nil {
+			if _, ok := vs.h.Get(v); ok {
+				return f(e, a, v)
+			}
+			return false
+		}
+		return vs.h.Each(func(k gotomic.Hashable, _ interface{}) bool {
+			return f(e, a, k.(value.Value))
+		})
+	}
+	var eachAttribute = func(e value.Value, as *attributeSet) bool {
+		if a != nil {
+			if vs, ok := as.h.Get(a); ok {
+				return eachValue(e, a, vs.(*valueSet))
+			}
+			return false
+		}
+		return as.h.Each(func(k gotomic.Hashable, vs interface{}) bool {
+			return eachValue(e, k.(value.Value), vs.(*valueSet))
+		})
+	}
+	if e != nil {
+		if as, ok := db.h.Get(e); ok {
+			return eachAttribute(e, as.(*attributeSet))
+		}
+		return false
+	}
+	return db.h.Each(func(k gotomic.Hashable, as interface{}) bool {
+		return eachAttribute(k.(value.Value), as.(*attributeSet))
+	})
+}
+
+// indexFor names the index scanEdb walks for a lookup with the given
+// positions of (e, a, v) known
+func indexFor(bound [3]bool) string {
+	switch {
+	case bound[0]:
+		return "eav"
+	case bound[1]:
+		return "ave"
+	case bound[2]:
+		return "vae"
 	}
-	vs.(*valueSet).h.Put(v, struct{}{})
+	return "every entity"
 }
 
-func scan_ea(c context, e, a value.Value) {
+func scan_ea(c context, e, a value.Value, f func(v value.Value)) {
+	scan(c, e, a, nil, func(_, _, v value.Value) {
+		f(v)
+	})
 }
 
 func allocate_bag(c context, e, a value.Value) *value.Uuid {
@@ -0,0 +1,13 @@
+the counter starts at zero
+  add
+    #expected test: "starting", tagged: "counter", count: 0, parent: "root"
+
+it shows its count
+  add
+    #expected test: "starting", tagged: "div", class: "count", text: "0"
+
+it has a button either side
+  add
+    #expected test: "buttons", tagged: "count-button", records: 2
+    #expected test: "buttons", tagged: "count-button", text: "-", diff: -1
+    #expected test: "buttons", tagged: "count-button", text: "+", diff: 1
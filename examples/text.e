@@ -0,0 +1,15 @@
+shout at people
+  #person
+    name
+  length(name) > 3
+  starts-with(name, "c")
+  shout = upper(name)
+  label = "{shout} has {length(name)} letters"
+  add
+    #shout
+      text: label
+
+split names into syllables
+  #person
+    name
+  syllable = split(text: name, by: "r")
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/witheve/evingo/parser"
+	"github.com/witheve/evingo/value"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Documents
+//------------------------------------------------------------------------------
+
+// A document is what gets exported as JSON or YAML. It's built from objects,
+// lists ([]interface{}), strings, ints, bools and value.Values, and unlike a
+// Go map an object keeps its keys in the order they were set, so the same
+// input always exports the same text.
+type object struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newObject() *object {
+	return &object{values: make(map[string]interface{})}
+}
+
+func (o *object) set(key string, v interface{}) *object {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+	return o
+}
+
+func orderedKeys(m map[string]interface{}) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func quote(s string) string {
+	var raw, _ = json.Marshal(s)
+	return string(raw)
+}
+
+// scalar writes anything that isn't an object or list, the same way for JSON
+// and YAML
+func scalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return quote(v)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case *value.Number, *value.Boolean:
+		return v.(value.Value).String()
+	case value.Value:
+		return quote(textOf(v))
+	}
+	panic("Unable to export a value of this type")
+}
+
+// ToJson writes a document as indented JSON
+func ToJson(doc interface{}) string {
+	var result strings.Builder
+	writeJson(&result, doc, "")
+	return result.String()
+}
+
+func writeJson(out *strings.Builder, doc interface{}, pad string) {
+	switch doc := doc.(type) {
+	case *object:
+		if len(doc.keys) == 0 {
+			out.WriteString("{}")
+			return
+		}
+		out.WriteString("{")
+		for i, key := range doc.keys {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + pad + "  " + quote(key) + ": ")
+			writeJson(out, doc.values[key], pad+"  ")
+		}
+		out.WriteString("\n" + pad + "}")
+	case []interface{}:
+		if isFlat(doc) {
+			out.WriteString(flatList(doc))
+			return
+		}
+		out.WriteString("[")
+		for i, item := range doc {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n" + pad + "  ")
+			writeJson(out, item, pad+"  ")
+		}
+		out.WriteString("\n" + pad + "]")
+	default:
+		out.WriteString(scalar(doc))
+	}
+}
+
+// lists of scalars, like a fact, fit on one line in JSON and YAML alike
+func flatList(list []interface{}) string {
+	var items []string
+	for _, item := range list {
+		items = append(items, scalar(item))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func isFlat(list []interface{}) bool {
+	for _, item := range list {
+		switch item.(type) {
+		case *object, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// ToYaml writes a document as block style YAML. Strings are always double
+// quoted, which YAML reads the same way JSON does.
+func ToYaml(doc interface{}) string {
+	if text := inline(doc); text != "" {
+		return text
+	}
+	var result strings.Builder
+	writeYaml(&result, doc, "")
+	return strings.TrimSuffix(result.String(), "\n")
+}
+
+// inline is how doc is written when it fits after a key or dash, or "" for
+// an object or list that needs lines of its own
+func inline(doc interface{}) string {
+	switch doc := doc.(type) {
+	case *object:
+		if len(doc.keys) == 0 {
+			return "{}"
+		}
+		return ""
+	case []interface{}:
+		if isFlat(doc) {
+			return flatList(doc)
+		}
+		return ""
+	}
+	return scalar(doc)
+}
+
+func yamlKey(key string) string {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return quote(key)
+		}
+	}
+	if key == "" || key[0] == '-' {
+		return quote(key)
+	}
+	return key
+}
+
+// writeYaml writes a non-empty object or list, each entry on its own line
+func writeYaml(out *strings.Builder, doc interface{}, pad string) {
+	switch doc := doc.(type) {
+	case *object:
+		for _, key := range doc.keys {
+			var v = doc.values[key]
+			out.WriteString(pad + yamlKey(key) + ":")
+			if text := inline(v); text != "" {
+				out.WriteString(" " + text + "\n")
+			} else {
+				out.WriteString("\n")
+				writeYaml(out, v, pad+"  ")
+			}
+		}
+	case []interface{}:
+		for _, item := range doc {
+			if text := inline(item); text != "" {
+				out.WriteString(pad + "- " + text + "\n")
+				continue
+			}
+			// the first line of a nested entry follows the dash
+			var nested strings.Builder
+			writeYaml(&nested, item, pad+"  ")
+			out.WriteString(pad + "- " + strings.TrimPrefix(nested.String(), pad+"  "))
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// Exporting
+//------------------------------------------------------------------------------
+
+// FactsDocument lists facts as [entity, attribute, value] in their original
+// order, the same shape ReadFactsFromJson reads
+func FactsDocument(facts *[]Fact) []interface{} {
+	var list = []interface{}{}
+	for _, fact := range *facts {
+		list = append(list, []interface{}{fact.entity, fact.attribute, fact.value})
+	}
+	return list
+}
+
+func entityDocument(entity *Entity) *object {
+	var doc = newObject().set("id", entity.entity)
+	var attributes = newObject()
+	var keys = make([]string, 0, len(entity.attributes))
+	for key := range entity.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		attributes.set(key, entity.attributes[key])
+	}
+	return doc.set("attributes", attributes)
+}
+
+func sortEntities(entities []*Entity) []*Entity {
+	var sorted = append([]*Entity(nil), entities...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].entity < sorted[j].entity
+	})
+	return sorted
+}
+
+// EntitiesDocument lists entities by id, each with its attributes by name
+func EntitiesDocument(entities []*Entity) []interface{} {
+	var list = []interface{}{}
+	for _, entity := range sortEntities(entities) {
+		list = append(list, entityDocument(entity))
+	}
+	return list
+}
+
+// TagMapDocument maps each tag, in order, to its entities by id
+func TagMapDocument(tagMap *TagMap) *object {
+	var doc = newObject()
+	var tags []string
+	for tag := range *tagMap {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		var list = []interface{}{}
+		for _, entity := range sortEntities((*tagMap)[tag]) {
+			list = append(list, entity.entity)
+		}
+		doc.set(tag, list)
+	}
+	return doc
+}
+
+func idsOf(ids []string) []interface{} {
+	var list = []interface{}{}
+	for _, id := range ids {
+		list = append(list, id)
+	}
+	return list
+}
+
+func withLine(doc *object, line int) *object {
+	if line > 0 {
+		doc.set("line", line)
+	}
+	return doc
+}
+
+func bindingDocument(binding *BindingNode) *object {
+	var doc = newObject().set("id", binding.id).set("field", binding.field)
+	if binding.IsConstant() {
+		doc.set("constant", binding.constant)
+	} else {
+		doc.set("variable", binding.variable.id)
+	}
+	return withLine(doc, binding.line)
+}
+
+func bindingsDocument(bindings []*BindingNode) []interface{} {
+	var sorted = append([]*BindingNode(nil), bindings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+	var list = []interface{}{}
+	for _, binding := range sorted {
+		list = append(list, bindingDocument(binding))
+	}
+	return list
+}
+
+func variableIds(variables []*VariableNode) []interface{} {
+	var list = []interface{}{}
+	for _, variable := range variables {
+		if variable == nil {
+			list = append(list, nil)
+		} else {
+			list = append(list, variable.id)
+		}
+	}
+	return list
+}
+
+// byId turns one of a query's maps of nodes into an object ordered by id
+func byId(nodes map[string]interface{}, f func(interface{}) interface{}) *object {
+	var doc = newObject()
+	for _, id := range orderedKeys(nodes) {
+		doc.set(id, f(nodes[id]))
+	}
+	return doc
+}
+
+func queriesDocument(queries []*QueryNode) []interface{} {
+	var list = []interface{}{}
+	for _, query := range queries {
+		list = append(list, QueryDocument(query))
+	}
+	return list
+}
+
+// QueryDocument is a query graph with each kind of node ordered by id.
+// Bindings appear under the scan, expression or mutate they belong to, and
+// everything else refers to nodes by id, except that the bodies of nots,
+// unions and chooses are written out in full.
+func QueryDocument(query *QueryNode) *object {
+	var doc = newObject().set("id", query.id).set("name", query.name)
+	withLine(doc, query.line)
+	doc.set("variables", byId(MapToInterfaces(query.variables), func(node interface{}) interface{} {
+		var variable = node.(*VariableNode)
+		var ids []string
+		for _, binding := range variable.bindings {
+			ids = append(ids, binding.id)
+		}
+		sort.Strings(ids)
+		return withLine(newObject().set("name", variable.name).set("bindings", idsOf(ids)), variable.line)
+	}))
+	doc.set("scans", byId(MapToInterfaces(query.scans), func(node interface{}) interface{} {
+		var scan = node.(*ScanNode)
+		return withLine(newObject().set("bindings", bindingsDocument(scan.bindings)), scan.line)
+	}))
+	doc.set("expressions", byId(MapToInterfaces(query.expressions), func(node interface{}) interface{} {
+		var expression = node.(*ExpressionNode)
+		var item = newObject().set("operator", expression.operator)
+		item.set("bindings", bindingsDocument(expression.bindings))
+		item.set("projection", variableIds(expression.projection))
+		item.set("grouping", variableIds(expression.grouping))
+		return withLine(item, expression.line)
+	}))
+	doc.set("mutates", byId(MapToInterfaces(query.mutates), func(node interface{}) interface{} {
+		var mutate = node.(*MutateNode)
+		var item = newObject().set("operator", mutate.operator)
+		if mutate.forever {
+			item.set("forever", true)
+		}
+		return withLine(item.set("bindings", bindingsDocument(mutate.bindings)), mutate.line)
+	}))
+	doc.set("nots", byId(MapToInterfaces(query.nots), func(node interface{}) interface{} {
+		return newObject().set("body", QueryDocument(node.(*NotNode).body))
+	}))
+	doc.set("unions", byId(MapToInterfaces(query.unions), func(node interface{}) interface{} {
+		return newObject().set("members", queriesDocument(node.(*UnionNode).members))
+	}))
+	doc.set("chooses", byId(MapToInterfaces(query.chooses), func(node interface{}) interface{} {
+		return newObject().set("members", queriesDocument(node.(*ChooseNode).members))
+	}))
+	return doc
+}
+
+// ProgramDocument is a parsed program: the facts it compiled to and any
+// errors, each with the line and offset they were found at
+func ProgramDocument(program *parser.Program) (*object, error) {
+	facts, err := FactsFromProgram(program)
+	if err != nil {
+		return nil, err
+	}
+	var errs = []interface{}{}
+	for _, parseError := range program.Errors {
+		errs = append(errs, newObject().set("line", parseError.Line).set("offset", parseError.Offset).set("message", parseError.Message))
+	}
+	return newObject().set("facts", FactsDocument(facts)).set("errors", errs), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/witheve/evingo/value"
+	"io/ioutil"
+	"testing"
+)
+
+func TestExportDocuments(t *testing.T) {
+	var doc = newObject().set("name", "fruit \"bowl\"").set("count", value.NewNumberFromInt(3))
+	doc.set("facts", []interface{}{[]interface{}{"e1", "tag", value.NewText("apple")}})
+	doc.set("nested", []interface{}{newObject().set("ok", true), newObject()})
+	var expectedJson = `{
+  "name": "fruit \"bowl\"",
+  "count": 3,
+  "facts": [
+    ["e1", "tag", "apple"]
+  ],
+  "nested": [
+    {
+      "ok": true
+    },
+    {}
+  ]
+}`
+	if text := ToJson(doc); text != expectedJson {
+		t.Errorf("Unexpected JSON:\n%s", text)
+	}
+	var expectedYaml = `name: "fruit \"bowl\""
+count: 3
+facts:
+  - ["e1", "tag", "apple"]
+nested:
+  - ok: true
+  - {}`
+	if text := ToYaml(doc); text != expectedYaml {
+		t.Errorf("Unexpected YAML:\n%s", text)
+	}
+}
+
+func TestExportIsDeterministic(t *testing.T) {
+	var raw, err = ioutil.ReadFile("fruity.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export = func() string {
+		facts, err := ReadFactsFromJson(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entities = FactsToEntities(facts)
+		tagMap, err := IndexEntitiesByTag(entities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := TagMapToQueryGraph(tagMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc = newObject().set("facts", FactsDocument(facts)).set("entities", EntitiesDocument(entities))
+		doc.set("tagmap", TagMapDocument(tagMap)).set("graph", QueryDocument(query))
+		return ToJson(doc)
+	}
+	var first = export()
+	if !json.Valid([]byte(first)) {
+		t.Fatalf("Export isn't valid JSON:\n%s", first)
+	}
+	for i := 0; i < 10; i++ {
+		if export() != first {
+			t.Fatal("Exporting the same facts twice gave different text")
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Test harness
+//------------------------------------------------------------------------------
+
+// Tests are written in Eve, after the pattern harness.json sketches. A test
+// file is a program whose name ends in _test.e, and its blocks add #expected
+// records: each says what one record the program makes should look like,
+// with every attribute it has besides these:
+//
+//   tagged   a tag the record should have. Real tags would make the program
+//            take the expectation for the record itself.
+//   test     names the test the expectation belongs to, the file's name if
+//            it's left out
+//   records  how many records should match, rather than at least one
+//
+// A test file runs in a bag of its own, along with the program it tests
+// (foo.e for foo_test.e) and the facts in its fixture (foo_test.json or
+// foo_test.f), whichever of those exist. A test passes when every one of its
+// expectations is met once the program reaches a fixpoint.
+
+const testSuffix = "_test.e"
+
+// A TestResult is how one test went. Failures explain each expectation that
+// wasn't met.
+type TestResult struct {
+	Name     string
+	Failures []string
+}
+
+func (result *TestResult) Passed() bool {
+	return len(result.Failures) == 0
+}
+
+// A TestReport is everything a test file's run found, its tests in name
+// order. A file with errors doesn't run, and has no tests.
+type TestReport struct {
+	Path        string
+	Diagnostics []Diagnostic
+	Tests       []*TestResult
+}
+
+func (report *TestReport) Passed() bool {
+	if HasErrors(report.Diagnostics) {
+		return false
+	}
+	for _, test := range report.Tests {
+		if !test.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// FindTestFiles lists the test files in paths: files as given, and every
+// _test.e file under directories
+func FindTestFiles(paths []string) ([]string, error) {
+	var found []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			found = append(found, path)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(file, testSuffix) {
+				found = append(found, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func fileExists(path string) bool {
+	var info, err = os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// RunTestFile runs a test file with the program it tests and its fixture,
+// then checks its expectations. Problems in either program come back as
+// diagnostics; anything that stops the tests from running at all comes back
+// as the error.
+func RunTestFile(path string) (*TestReport, error) {
+	var report = &TestReport{Path: path}
+	queries, diagnostics, err := LoadProgramFile(path)
+	report.Diagnostics = diagnostics
+	if err != nil {
+		return report, err
+	}
+	var base = strings.TrimSuffix(path, testSuffix)
+	if base != path && fileExists(base+".e") {
+		tested, diagnostics, err := LoadProgramFile(base + ".e")
+		report.Diagnostics = append(report.Diagnostics, diagnostics...)
+		if err != nil {
+			return report, err
+		}
+		queries = append(tested, queries...)
+	}
+	report.Diagnostics = append(report.Diagnostics, CheckQueries(queries)...)
+	if HasErrors(report.Diagnostics) {
+		return report, nil
+	}
+
+	var bags = NewBags()
+	if _, err := bags.Create("test", value.Uuid{}); err != nil {
+		return report, err
+	}
+	c, err := bags.Context(value.Uuid{}, "test")
+	if err != nil {
+		return report, err
+	}
+	for _, fixture := range []string{base + "_test.json", base + "_test.f"} {
+		if fileExists(fixture) {
+			if err := LoadFacts(c, fixture); err != nil {
+				return report, err
+			}
+		}
+	}
+	runtime, err := NewRuntime(c, queries)
+	if err != nil {
+		return report, err
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		return report, err
+	}
+	report.Tests = checkExpectations(c, filepath.Base(path))
+	return report, nil
+}
+
+// A record is an entity's facts, grouped by attribute
+type record struct {
+	id         value.Value
+	attributes map[string][]value.Value
+}
+
+func (r *record) has(attribute string, v value.Value) bool {
+	for _, other := range r.attributes[attribute] {
+		if other.Equals(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *record) isExpected() bool {
+	return r.has("tag", value.NewText("expected"))
+}
+
+func records(c context) []*record {
+	var byId = make(map[string]*record)
+	var all []*record
+	scan(c, nil, nil, nil, func(e, a, v value.Value) {
+		var key = e.String()
+		var r, ok = byId[key]
+		if !ok {
+			r = &record{id: e, attributes: make(map[string][]value.Value)}
+			byId[key] = r
+			all = append(all, r)
+		}
+		r.attributes[textOf(a)] = append(r.attributes[textOf(a)], v)
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].id.String() < all[j].id.String()
+	})
+	return all
+}
+
+// an expectation is the attribute, value pairs an #expected record asks for
+type expectation struct {
+	test    string
+	records int // -1 for at least one
+	pairs   [][2]string
+	values  []value.Value
+}
+
+func (x *expectation) matches(r *record) int {
+	var matched = 0
+	for ix, pair := range x.pairs {
+		if r.has(pair[0], x.values[ix]) {
+			matched++
+		}
+	}
+	return matched
+}
+
+func (x *expectation) describe() string {
+	var parts []string
+	for ix, pair := range x.pairs {
+		if pair[0] == "tag" {
+			parts = append(parts, "#"+textOf(x.values[ix]))
+		} else {
+			parts = append(parts, pair[0]+": "+pair[1])
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func expectationOf(r *record, file string) *expectation {
+	var x = &expectation{test: file, records: -1}
+	var attributes []string
+	for attribute := range r.attributes {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	for _, attribute := range attributes {
+		for _, v := range r.attributes[attribute] {
+			switch {
+			case attribute == "test":
+				x.test = textOf(v)
+			case attribute == "records":
+				if number, ok := v.(*value.Number); ok {
+					if n, err := strconv.Atoi(number.String()); err == nil {
+						x.records = n
+						continue
+					}
+				}
+				x.pairs = append(x.pairs, [2]string{attribute, v.String()})
+				x.values = append(x.values, v)
+			case attribute == "tagged":
+				x.pairs = append(x.pairs, [2]string{"tag", v.String()})
+				x.values = append(x.values, v)
+			case attribute == "tag":
+			default:
+				x.pairs = append(x.pairs, [2]string{attribute, v.String()})
+				x.values = append(x.values, v)
+			}
+		}
+	}
+	return x
+}
+
+// checkExpectations finds the #expected records in c and checks each
+// against every other record
+func checkExpectations(c context, file string) []*TestResult {
+	var all = records(c)
+	var tests = make(map[string]*TestResult)
+	for _, r := range all {
+		if !r.isExpected() {
+			continue
+		}
+		var x = expectationOf(r, file)
+		var test, ok = tests[x.test]
+		if !ok {
+			test = &TestResult{Name: x.test}
+			tests[x.test] = test
+		}
+		if failure := check(x, all); failure != "" {
+			test.Failures = append(test.Failures, failure)
+		}
+	}
+	var results []*TestResult
+	for _, test := range tests {
+		results = append(results, test)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// check is why an expectation isn't met, or "" if it is. When nothing
+// matches, the failure shows how the closest record differs: - for what it's
+// missing and + for the values it has instead.
+func check(x *expectation, all []*record) string {
+	var found = 0
+	var closest *record
+	var best = 0
+	for _, r := range all {
+		if r.isExpected() {
+			continue
+		}
+		var matched = x.matches(r)
+		if matched == len(x.pairs) {
+			found++
+		} else if matched > best {
+			closest, best = r, matched
+		}
+	}
+	var want = "at least 1"
+	if x.records >= 0 {
+		if found == x.records {
+			return ""
+		}
+		want = strconv.Itoa(x.records)
+	} else if found > 0 {
+		return ""
+	}
+	var failure = "expected " + want + " record(s) with " + x.describe() + ", found " + strconv.Itoa(found)
+	if found > 0 || closest == nil {
+		return failure
+	}
+	failure += "; the closest is " + textOf(closest.id) + ":"
+	var shown = make(map[string]bool)
+	for ix, pair := range x.pairs {
+		if closest.has(pair[0], x.values[ix]) {
+			continue
+		}
+		failure += "\n  - " + pair[0] + " " + pair[1]
+		if shown[pair[0]] {
+			continue
+		}
+		shown[pair[0]] = true
+		for _, v := range closest.attributes[pair[0]] {
+			failure += "\n  + " + pair[0] + " " + v.String()
+		}
+	}
+	return failure
+}
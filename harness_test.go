@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunTestFile(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var write = func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("greet.e", "greet people\n  #person name\n  add\n    #greeting who: name\n")
+	write("greet_test.json", `[["ada", "tag", "person"], ["ada", "name", "Ada"]]`)
+	write("greet_test.e", strings.Join([]string{
+		"Ada is greeted",
+		"  add",
+		`    #expected test: "greets", tagged: "greeting", who: "Ada"`,
+		"",
+		"nobody else is",
+		"  add",
+		`    #expected test: "greets", tagged: "greeting", records: 1`,
+		"",
+		"Bob is greeted",
+		"  add",
+		`    #expected test: "wrong", tagged: "greeting", who: "Bob"`,
+		"",
+	}, "\n"))
+
+	files, err := FindTestFiles([]string{dir})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected to find greet_test.e, got %v %v", files, err)
+	}
+	report, err := RunTestFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Diagnostics) > 0 || len(report.Tests) != 2 {
+		t.Fatalf("expected two tests and no diagnostics, got %v %v", report.Tests, report.Diagnostics)
+	}
+	var greets, wrong = report.Tests[0], report.Tests[1]
+	if !greets.Passed() {
+		t.Fatalf("expected greets to pass, got %v", greets.Failures)
+	}
+	if wrong.Passed() || report.Passed() {
+		t.Fatalf("expected wrong to fail")
+	}
+	if failure := wrong.Failures[0]; !strings.Contains(failure, `- who "Bob"`) || !strings.Contains(failure, `+ who "Ada"`) {
+		t.Fatalf("expected the failure to show how the closest record differs, got %v", failure)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// History
+//------------------------------------------------------------------------------
+
+// history remembers, for every fact an edb has ever had, the commits it was
+// there for, so the edb can be read as it was after any commit. Nothing is
+// forgotten until Forget is asked to.
+type history struct {
+	lock        sync.Mutex
+	facts       map[string]*versionedFact
+	byEntity    map[string][]*versionedFact
+	byAttribute map[string][]*versionedFact
+	byValue     map[string][]*versionedFact
+	order       []*versionedFact
+}
+
+// a versionedFact was in the edb from each interval's from until its to,
+// which is 0 while the fact is still there
+type versionedFact struct {
+	fact      [3]value.Value
+	intervals []interval
+}
+
+type interval struct {
+	from, to uint64
+}
+
+func newHistory() *history {
+	var h = &history{facts: make(map[string]*versionedFact)}
+	h.index(nil)
+	return h
+}
+
+// index makes order of facts, and the indexes on each field, facts
+func (h *history) index(facts []*versionedFact) {
+	h.order = nil
+	h.byEntity = make(map[string][]*versionedFact)
+	h.byAttribute = make(map[string][]*versionedFact)
+	h.byValue = make(map[string][]*versionedFact)
+	for _, versioned := range facts {
+		h.add(versioned)
+	}
+}
+
+func (h *history) add(versioned *versionedFact) {
+	var e, a, v = versioned.fact[0].String(), versioned.fact[1].String(), versioned.fact[2].String()
+	h.byEntity[e] = append(h.byEntity[e], versioned)
+	h.byAttribute[a] = append(h.byAttribute[a], versioned)
+	h.byValue[v] = append(h.byValue[v], versioned)
+	h.order = append(h.order, versioned)
+}
+
+// record notes that a fact came or went in transaction id. Changes made
+// outside a transaction belong to the next one to commit.
+func (h *history) record(op value.Operator, id uint64, e, a, v value.Value) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var fact = [3]value.Value{e, a, v}
+	var key = rowString(fact[:])
+	var versioned, ok = h.facts[key]
+	if !ok {
+		versioned = &versionedFact{fact: fact}
+		h.facts[key] = versioned
+		h.add(versioned)
+	}
+	if op == value.OpInsert {
+		versioned.intervals = append(versioned.intervals, interval{from: id})
+	} else if n := len(versioned.intervals); n > 0 {
+		versioned.intervals[n-1].to = id
+	}
+}
+
+// at is whether the fact was there once commit id was done
+func (versioned *versionedFact) at(id uint64) bool {
+	for _, i := range versioned.intervals {
+		if i.from <= id && (i.to == 0 || id < i.to) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanAsOf is scanEdb for the edb as it was after commit id. It only looks
+// through the facts that share the most selective field it's given.
+func (h *history) scanAsOf(id uint64, e, a, v value.Value, f func(e, a, v value.Value) bool) bool {
+	h.lock.Lock()
+	var candidates = h.order
+	for ix, field := range [3]value.Value{e, a, v} {
+		if field == nil {
+			continue
+		}
+		var facts = [3]map[string][]*versionedFact{h.byEntity, h.byAttribute, h.byValue}[ix][field.String()]
+		if len(facts) < len(candidates) {
+			candidates = facts
+		}
+	}
+	var matches [][3]value.Value
+	for _, versioned := range candidates {
+		var fact = versioned.fact
+		if (e == nil || e.Equals(fact[0])) && (a == nil || a.Equals(fact[1])) && (v == nil || v.Equals(fact[2])) && versioned.at(id) {
+			matches = append(matches, fact)
+		}
+	}
+	h.lock.Unlock()
+	for _, fact := range matches {
+		if f(fact[0], fact[1], fact[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget drops the history of facts that were gone by commit before, which
+// reading as of before or later never needs. Reading as of an earlier commit,
+// or diffing from one, misses those facts from then on.
+func (db *edb) Forget(before uint64) {
+	var h = db.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var kept []*versionedFact
+	for _, versioned := range h.order {
+		var intervals []interval
+		for _, i := range versioned.intervals {
+			if i.to == 0 || i.to > before {
+				intervals = append(intervals, i)
+			}
+		}
+		versioned.intervals = intervals
+		if len(intervals) == 0 {
+			delete(h.facts, rowString(versioned.fact[:]))
+			continue
+		}
+		kept = append(kept, versioned)
+	}
+	h.index(kept)
+}
+
+// AsOf is c reading every bag as it was once commit id was done. It can't
+// be written to, and views opened on it never change.
+func (c context) AsOf(id uint64) context {
+	c.asOf = id
+	return c
+}
+
+// Diff is the facts added and removed between commits from and to: facts
+// there after to but not after from, and the other way round. A to of 0 is
+// the edb as it is now.
+func (db *edb) Diff(from, to uint64) (added, removed [][3]value.Value) {
+	var h = db.history
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var now = to == 0
+	for _, versioned := range h.order {
+		var before = versioned.at(from)
+		var after bool
+		if now {
+			var n = len(versioned.intervals)
+			after = n > 0 && versioned.intervals[n-1].to == 0
+		} else {
+			after = versioned.at(to)
+		}
+		if after && !before {
+			added = append(added, versioned.fact)
+		} else if before && !after {
+			removed = append(removed, versioned.fact)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/witheve/evingo/gotomic"
+	"github.com/witheve/evingo/value"
+	"sync/atomic"
+)
+
+//------------------------------------------------------------------------------
+// Indexes
+//------------------------------------------------------------------------------
+
+// An index is facts nested three deep in some order other than entity,
+// attribute, value: AVE finds the entities with an attribute, or with an
+// attribute and value, and VAE finds whoever has a value. The edb keeps them
+// in step with its EAV hash on every insert and remove.
+type index struct {
+	h     *gotomic.Hash // first key -> *level
+	order [3]int        // where each level's key sits in an (e, a, v) fact
+}
+
+// a level is the facts under one first key, second key -> third key, along
+// with how many there are so they can be counted without walking them
+type level struct {
+	facts int64 // first, so it's aligned for atomic access
+	h     *gotomic.Hash
+}
+
+func newIndex(order [3]int) *index {
+	return &index{h: gotomic.NewHash(), order: order}
+}
+
+func (ix *index) keys(e, a, v value.Value) (x, y, z value.Value) {
+	var fact = [3]value.Value{e, a, v}
+	return fact[ix.order[0]], fact[ix.order[1]], fact[ix.order[2]]
+}
+
+func (ix *index) add(e, a, v value.Value) {
+	var x, y, z = ix.keys(e, a, v)
+	var ys, ok = ix.h.Get(x)
+	if !ok {
+		ix.h.PutIfMissing(x, &level{h: gotomic.NewHash()})
+		ys, _ = ix.h.Get(x)
+	}
+	var l = ys.(*level)
+	zs, ok := l.h.Get(y)
+	if !ok {
+		l.h.PutIfMissing(y, gotomic.NewHash())
+		zs, _ = l.h.Get(y)
+	}
+	if _, existed := zs.(*gotomic.Hash).Put(z, struct{}{}); !existed {
+		atomic.AddInt64(&l.facts, 1)
+	}
+}
+
+func (ix *index) remove(e, a, v value.Value) {
+	var x, y, z = ix.keys(e, a, v)
+	var ys, ok = ix.h.Get(x)
+	if !ok {
+		return
+	}
+	var l = ys.(*level)
+	zs, ok := l.h.Get(y)
+	if !ok {
+		return
+	}
+	if _, existed := zs.(*gotomic.Hash).Delete(z); existed {
+		atomic.AddInt64(&l.facts, -1)
+	}
+	if zs.(*gotomic.Hash).Size() == 0 {
+		l.h.Delete(y)
+		if l.h.Size() == 0 {
+			ix.h.Delete(x)
+		}
+	}
+}
+
+// count is how many facts match a pattern whose first key is bound, from the
+// sizes the index keeps rather than by walking them
+func (ix *index) count(e, a, v value.Value) int {
+	var x, y, z = ix.keys(e, a, v)
+	var ys, ok = ix.h.Get(x)
+	if !ok {
+		return 0
+	}
+	var l = ys.(*level)
+	if y == nil {
+		return int(atomic.LoadInt64(&l.facts))
+	}
+	zs, ok := l.h.Get(y)
+	if !ok {
+		return 0
+	}
+	if z == nil {
+		return zs.(*gotomic.Hash).Size()
+	}
+	if _, ok := zs.(*gotomic.Hash).Get(z); ok {
+		return 1
+	}
+	return 0
+}
+
+// scan is scanUntil for an index whose first key is bound
+func (ix *index) scan(e, a, v value.Value, f func(e, a, v value.Value) bool) bool {
+	var x, y, z = ix.keys(e, a, v)
+	var emit = func(x, y, z value.Value) bool {
+		var fact [3]value.Value
+		fact[ix.order[0]], fact[ix.order[1]], fact[ix.order[2]] = x, y, z
+		return f(fact[0], fact[1], fact[2])
+	}
+	var eachZ = func(y value.Value, zs *gotomic.Hash) bool {
+		if z != nil {
+			if _, ok := zs.Get(z); ok {
+				return emit(x, y, z)
+			}
+			return false
+		}
+		return zs.Each(func(k gotomic.Hashable, _ interface{}) bool {
+			return emit(x, y, k.(value.Value))
+		})
+	}
+	var ys, ok = ix.h.Get(x)
+	if !ok {
+		return false
+	}
+	var l = ys.(*level)
+	if y != nil {
+		if zs, ok := l.h.Get(y); ok {
+			return eachZ(y, zs.(*gotomic.Hash))
+		}
+		return false
+	}
+	return l.h.Each(func(k gotomic.Hashable, zs interface{}) bool {
+		return eachZ(k.(value.Value), zs.(*gotomic.Hash))
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// triangleQuery finds every a -> b -> c -> a cycle in the "edge" attribute,
+// the classic query pairwise joins do badly on
+func triangleQuery() *QueryNode {
+	var query = NewQuery("triangles")
+	for _, name := range []string{"a", "b", "c"} {
+		query.variables[name] = &VariableNode{id: name, name: name}
+	}
+	var edge = value.NewText("edge")
+	for ix, pair := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "a"}} {
+		var scan = &ScanNode{id: "s" + strconv.Itoa(ix)}
+		var from = &BindingNode{id: scan.id + "e", field: "entity", variable: query.variables[pair[0]], source: scan}
+		var attribute = &BindingNode{id: scan.id + "a", field: "attribute", constant: edge, source: scan}
+		var to = &BindingNode{id: scan.id + "v", field: "value", variable: query.variables[pair[1]], source: scan}
+		scan.bindings = []*BindingNode{from, attribute, to}
+		query.scans[scan.id] = scan
+	}
+	return query
+}
+
+func randomGraph(nodes int, edges int) context {
+	var random = rand.New(rand.NewSource(42))
+	var c = context{e: *NewEdb()}
+	var edge = value.NewText("edge")
+	for i := 0; i < edges; i++ {
+		var from = value.NewNumberFromInt(int64(random.Intn(nodes)))
+		var to = value.NewNumberFromInt(int64(random.Intn(nodes)))
+		insert(c, from, edge, to)
+	}
+	return c
+}
+
+func countRows(t testing.TB, c context, strategy JoinStrategy) int {
+	var plan, err = PlanQuery(triangleQuery(), &c.e, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows = 0
+	if err := plan.Run(c, func(row []value.Value) { rows++ }); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestGenericJoinMatchesNested(t *testing.T) {
+	var c = randomGraph(50, 400)
+	var nested = countRows(t, c, JoinNested)
+	var generic = countRows(t, c, JoinGeneric)
+	if nested != generic {
+		t.Fatalf("nested join found %v triangles, generic join found %v", nested, generic)
+	}
+	if nested == 0 {
+		t.Fatal("expected the random graph to have some triangles")
+	}
+}
+
+// edgeQuery is a query scanning "edge" once per pair of variables
+func edgeQuery(pairs ...[2]string) *QueryNode {
+	var query = NewQuery("edges")
+	var edge = value.NewText("edge")
+	for ix, pair := range pairs {
+		for _, name := range pair {
+			if query.variables[name] == nil {
+				query.variables[name] = &VariableNode{id: name, name: name}
+			}
+		}
+		var scan = &ScanNode{id: "s" + strconv.Itoa(ix)}
+		scan.bindings = []*BindingNode{
+			{id: scan.id + "e", field: "entity", variable: query.variables[pair[0]], source: scan},
+			{id: scan.id + "a", field: "attribute", constant: edge, source: scan},
+			{id: scan.id + "v", field: "value", variable: query.variables[pair[1]], source: scan},
+		}
+		query.scans[scan.id] = scan
+	}
+	return query
+}
+
+func TestAutoJoinOnlyForCycles(t *testing.T) {
+	var tests = []struct {
+		pairs   [][2]string
+		generic bool
+	}{
+		{[][2]string{{"a", "b"}, {"b", "c"}, {"c", "a"}}, true},
+		{[][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}, {"d", "a"}}, true},
+		// a record: one entity shared by every pattern
+		{[][2]string{{"e", "a"}, {"e", "b"}, {"e", "c"}, {"e", "d"}}, false},
+		{[][2]string{{"a", "b"}, {"b", "a"}}, false},
+		{[][2]string{{"a", "b"}, {"b", "c"}, {"c", "d"}}, false},
+	}
+	for _, test := range tests {
+		var plan, err = PlanQuery(edgeQuery(test.pairs...), nil, JoinAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generic = len(plan.steps) == 1 && plan.steps[0].join != nil
+		if generic != test.generic {
+			t.Errorf("%v: expected generic %v, got %v", test.pairs, test.generic, plan)
+		}
+	}
+}
+
+// skewedGraph is a random graph plus a few hubs with an edge to and from
+// every node, which is where joining a pair of patterns at a time blows up:
+// every path through a hub is an intermediate result.
+func skewedGraph(nodes int, edges int, hubs int) context {
+	var c = randomGraph(nodes, edges)
+	var edge = value.NewText("edge")
+	for hub := 0; hub < hubs; hub++ {
+		for i := hubs; i < nodes; i++ {
+			insert(c, value.NewNumberFromInt(int64(hub)), edge, value.NewNumberFromInt(int64(i)))
+			insert(c, value.NewNumberFromInt(int64(i)), edge, value.NewNumberFromInt(int64(hub)))
+		}
+	}
+	return c
+}
+
+func benchmarkTriangles(b *testing.B, c context, strategy JoinStrategy) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		countRows(b, c, strategy)
+	}
+}
+
+func BenchmarkTrianglesNested(b *testing.B) {
+	benchmarkTriangles(b, randomGraph(300, 6000), JoinNested)
+}
+
+func BenchmarkTrianglesGeneric(b *testing.B) {
+	benchmarkTriangles(b, randomGraph(300, 6000), JoinGeneric)
+}
+
+func BenchmarkSkewedTrianglesNested(b *testing.B) {
+	benchmarkTriangles(b, skewedGraph(500, 1000, 2), JoinNested)
+}
+
+func BenchmarkSkewedTrianglesGeneric(b *testing.B) {
+	benchmarkTriangles(b, skewedGraph(500, 1000, 2), JoinGeneric)
+}
+
+// every way into the edb finds, and counts, the same facts walking every
+// entity would
+func TestIndexesMatchFullScan(t *testing.T) {
+	var random = rand.New(rand.NewSource(3))
+	var c = randomGraph(10, 60)
+	var attributes = []value.Value{value.NewText("edge"), value.NewText("tag")}
+	var node = func() value.Value { return value.NewNumberFromInt(int64(random.Intn(10))) }
+	for i := 0; i < 200; i++ {
+		var e, a, v = node(), attributes[random.Intn(2)], node()
+		if random.Intn(3) == 0 {
+			remove(c, e, a, v)
+		} else {
+			insert(c, e, a, v)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		var pattern = [3]value.Value{node(), attributes[random.Intn(2)], node()}
+		for ix := range pattern {
+			if random.Intn(2) == 0 {
+				pattern[ix] = nil
+			}
+		}
+		var expected = 0
+		scanEdb(&c.e, nil, nil, nil, func(e, a, v value.Value) bool {
+			var fact = [3]value.Value{e, a, v}
+			for ix, p := range pattern {
+				if p != nil && !p.Equals(fact[ix]) {
+					return false
+				}
+			}
+			expected++
+			return false
+		})
+		var found = 0
+		scan(c, pattern[0], pattern[1], pattern[2], func(e, a, v value.Value) { found++ })
+		if found != expected {
+			t.Fatalf("pattern %v: scan found %v facts, walking everything found %v", pattern, found, expected)
+		}
+		if count := c.Count(pattern[0], pattern[1], pattern[2]); count != expected {
+			t.Fatalf("pattern %v: Count gave %v, walking everything found %v", pattern, count, expected)
+		}
+	}
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/witheve/evingo/parser"
+	"github.com/witheve/evingo/value"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// JSON-RPC
+//------------------------------------------------------------------------------
+
+// An rpcMessage is a request (with an id), a notification (without) or, on
+// the way out, a response
+type rpcMessage struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+)
+
+// readMessage reads one message framed by a Content-Length header
+func readMessage(in *bufio.Reader) ([]byte, error) {
+	var length = -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return nil, errors.New("bad Content-Length header: " + line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message has no Content-Length header")
+	}
+	var body = make([]byte, length)
+	_, err := io.ReadFull(in, body)
+	return body, err
+}
+
+func writeMessage(out io.Writer, message rpcMessage) error {
+	message.Jsonrpc = "2.0"
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, "Content-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+	return err
+}
+
+//------------------------------------------------------------------------------
+// Protocol types
+//------------------------------------------------------------------------------
+
+// Lines and characters both count from 0. Characters are counted the way
+// the lexer counts them, which is the same as UTF-16 outside the astral
+// planes.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	Uri   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Completion item kinds and diagnostic severities from the protocol
+const (
+	lspKindVariable = 6
+	lspKindClass    = 7
+	lspKindProperty = 10
+
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+)
+
+type lspTextDocument struct {
+	Uri  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+}
+
+//------------------------------------------------------------------------------
+// Documents
+//------------------------------------------------------------------------------
+
+// An lspDocument is an .e file as it's been analysed: its tokens for finding
+// what's under the cursor, and the queries it compiles to for everything else
+type lspDocument struct {
+	uri     string
+	lines   []string
+	tokens  []*parser.Token
+	queries []*QueryNode
+	errors  []*parser.ParseError
+	checked []Diagnostic // the checker's, or the loader's if it stopped
+}
+
+func analyse(uri string, text string) *lspDocument {
+	var doc = &lspDocument{uri: uri, lines: strings.Split(text, "\n"), tokens: parser.Lex(text)}
+	var program = parser.ParseString(text)
+	doc.errors = program.Errors
+	facts, err := FactsFromProgram(program)
+	if err != nil {
+		doc.checked = loadDiagnostics(program, err)
+		return doc
+	}
+	queries, err := queriesFromFacts(facts)
+	if err != nil {
+		doc.checked = loadDiagnostics(program, err)
+		return doc
+	}
+	sort.SliceStable(queries, func(i, j int) bool {
+		return queries[i].line < queries[j].line
+	})
+	doc.queries = queries
+	doc.checked = CheckQueries(queries)
+	return doc
+}
+
+// loadDiagnostics are the problems that stopped a program loading, each on
+// the line of the entity it's about, if that's known
+func loadDiagnostics(program *parser.Program, err error) []Diagnostic {
+	var errs, ok = err.(LoadErrors)
+	if !ok {
+		return []Diagnostic{{SeverityError, 0, "", err.Error()}}
+	}
+	var lines = make(map[string]int)
+	for _, fact := range program.Facts {
+		if line, ok := fact.Value.(int); ok && fact.Attribute == "line" {
+			lines[fact.Entity] = line
+		}
+	}
+	var diagnostics []Diagnostic
+	for _, err := range errs {
+		var entity = err.entity
+		if entity == "" && err.index >= 0 && err.index < len(program.Facts) {
+			entity = program.Facts[err.index].Entity
+		}
+		diagnostics = append(diagnostics, Diagnostic{SeverityError, lines[entity], entity, err.msg})
+	}
+	return diagnostics
+}
+
+func tokenLength(token *parser.Token) int {
+	return len([]rune(token.Value()))
+}
+
+func (doc *lspDocument) lineLength(line int) int {
+	if line < 1 || line > len(doc.lines) {
+		return 0
+	}
+	return len([]rune(strings.TrimRight(doc.lines[line-1], "\r")))
+}
+
+// diagnostics are the parser's errors, pointing at the token they're about,
+// and then the checker's or the loader's, which only know their line
+func (doc *lspDocument) diagnostics() []lspDiagnostic {
+	var result = []lspDiagnostic{}
+	for _, err := range doc.errors {
+		var at = lspPosition{err.Line - 1, err.Offset}
+		var end = lspPosition{at.Line, at.Character + 1}
+		if token := doc.tokenAt(err.Line, err.Offset); token != nil {
+			end.Character = token.Offset() + tokenLength(token)
+		}
+		result = append(result, lspDiagnostic{lspRange{at, end}, lspSeverityError, "evingo", err.Message})
+	}
+	for _, diagnostic := range doc.checked {
+		var line = diagnostic.line
+		if line < 1 {
+			line = 1
+		}
+		var severity = lspSeverityError
+		if diagnostic.severity == SeverityWarning {
+			severity = lspSeverityWarning
+		}
+		var span = lspRange{lspPosition{line - 1, 0}, lspPosition{line - 1, doc.lineLength(line)}}
+		result = append(result, lspDiagnostic{span, severity, "evingo", diagnostic.msg})
+	}
+	return result
+}
+
+// tokenAt finds the token covering a character, including the one just
+// after its end so a cursor at the end of a word still counts
+func (doc *lspDocument) tokenAt(line int, character int) *parser.Token {
+	var found *parser.Token
+	for _, token := range doc.tokens {
+		if token.Line() != line {
+			continue
+		}
+		if character >= token.Offset() && character <= token.Offset()+tokenLength(token) {
+			found = token
+			if character < token.Offset()+tokenLength(token) {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// isTagName is whether an identifier is the name after a #
+func (doc *lspDocument) isTagName(token *parser.Token) bool {
+	for ix, t := range doc.tokens {
+		if t == token {
+			if ix == 0 {
+				return false
+			}
+			var previous = doc.tokens[ix-1]
+			return previous.Type() == parser.TAG && previous.Line() == token.Line() && previous.Offset()+1 == token.Offset()
+		}
+	}
+	return false
+}
+
+// queryAt is the query whose block holds a line: the last one to start at
+// or before it
+func (doc *lspDocument) queryAt(line int) *QueryNode {
+	var found *QueryNode
+	for _, query := range doc.queries {
+		if query.line > 0 && query.line <= line {
+			found = query
+		}
+	}
+	return found
+}
+
+func variableNamed(query *QueryNode, name string) *VariableNode {
+	if query == nil {
+		return nil
+	}
+	for _, variable := range query.variables {
+		if variable.name == name {
+			return variable
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// Inference
+//------------------------------------------------------------------------------
+
+// entityShapes finds, for each variable a query uses as an entity, the tags
+// it's given and the other attributes it's scanned or mutated with
+func entityShapes(query *QueryNode) (tags map[*VariableNode][]string, attributes map[*VariableNode][]string) {
+	tags = make(map[*VariableNode][]string)
+	attributes = make(map[*VariableNode][]string)
+	var sources []*[]*BindingNode
+	for _, scan := range query.scans {
+		sources = append(sources, &scan.bindings)
+	}
+	for _, mutate := range query.mutates {
+		sources = append(sources, &mutate.bindings)
+	}
+	for _, bindings := range sources {
+		var entity *VariableNode
+		var attribute, tag string
+		for _, binding := range *bindings {
+			switch {
+			case binding.field == "entity" && !binding.IsConstant():
+				entity = binding.variable
+			case binding.field == "attribute" && binding.IsConstant():
+				attribute = textOf(binding.constant)
+			case binding.field == "value" && binding.IsConstant():
+				if text, ok := binding.constant.(*value.Text); ok {
+					tag = text.Value()
+				}
+			}
+		}
+		if entity == nil || attribute == "" {
+			continue
+		}
+		if attribute == "tag" {
+			if tag != "" {
+				tags[entity] = append(tags[entity], tag)
+			}
+		} else {
+			attributes[entity] = append(attributes[entity], attribute)
+		}
+	}
+	return tags, attributes
+}
+
+// workspaceShapes collects every attribute seen on an entity with each tag,
+// and every attribute seen at all
+func workspaceShapes(docs []*lspDocument) (byTag map[string]map[string]bool, all map[string]bool) {
+	byTag = make(map[string]map[string]bool)
+	all = make(map[string]bool)
+	for _, doc := range docs {
+		for _, query := range doc.queries {
+			var tags, attributes = entityShapes(query)
+			for entity, entityTags := range tags {
+				for _, tag := range entityTags {
+					if byTag[tag] == nil {
+						byTag[tag] = make(map[string]bool)
+					}
+					for _, attribute := range attributes[entity] {
+						byTag[tag][attribute] = true
+					}
+				}
+			}
+			for _, entityAttributes := range attributes {
+				for _, attribute := range entityAttributes {
+					all[attribute] = true
+				}
+			}
+		}
+	}
+	return byTag, all
+}
+
+func sortedSet(set map[string]bool) []string {
+	var items []string
+	for item := range set {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+//------------------------------------------------------------------------------
+// Server
+//------------------------------------------------------------------------------
+
+// A langServer answers an editor over the Language Server Protocol. Open
+// documents are analysed as they change; the other .e files under the
+// workspace root are analysed once, when the server starts, so hover and
+// completion can draw on them too.
+type langServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	open      map[string]*lspDocument
+	workspace map[string]*lspDocument
+	shutdown  bool
+}
+
+var errExitWithoutShutdown = errors.New("the client exited without asking the server to shut down")
+
+// ServeLsp speaks the Language Server Protocol over in and out until the
+// client says to exit
+func ServeLsp(in io.Reader, out io.Writer) error {
+	var server = &langServer{
+		in:        bufio.NewReader(in),
+		out:       out,
+		open:      make(map[string]*lspDocument),
+		workspace: make(map[string]*lspDocument),
+	}
+	for {
+		body, err := readMessage(server.in)
+		if err == io.EOF {
+			return errExitWithoutShutdown
+		}
+		if err != nil {
+			return err
+		}
+		var message rpcMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			return errors.New("malformed message: " + err.Error())
+		}
+		if message.Method == "exit" {
+			if server.shutdown {
+				return nil
+			}
+			return errExitWithoutShutdown
+		}
+		result, rpcErr := server.handle(message)
+		if message.Id == nil {
+			continue
+		}
+		var response = rpcMessage{Id: message.Id, Result: result, Error: rpcErr}
+		if result == nil && rpcErr == nil {
+			// a null result still has to be there
+			response.Result = json.RawMessage("null")
+		}
+		if err := writeMessage(server.out, response); err != nil {
+			return err
+		}
+	}
+}
+
+func (server *langServer) handle(message rpcMessage) (interface{}, *rpcError) {
+	var invalid = func(err error) *rpcError {
+		return &rpcError{rpcInvalidParams, err.Error()}
+	}
+	switch message.Method {
+	case "initialize":
+		var params struct {
+			RootUri  string `json:"rootUri"`
+			RootPath string `json:"rootPath"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, invalid(err)
+		}
+		var root = params.RootPath
+		if params.RootUri != "" {
+			root = uriToPath(params.RootUri)
+		}
+		if root != "" {
+			server.scanWorkspace(root)
+		}
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // the whole document on every change
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"#"}},
+			},
+			"serverInfo": map[string]string{"name": "evingo"},
+		}, nil
+	case "shutdown":
+		server.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		var params struct {
+			TextDocument   lspTextDocument   `json:"textDocument"`
+			ContentChanges []lspTextDocument `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, invalid(err)
+		}
+		var uri = params.TextDocument.Uri
+		switch message.Method {
+		case "textDocument/didOpen":
+			server.update(uri, params.TextDocument.Text)
+		case "textDocument/didChange":
+			if len(params.ContentChanges) > 0 {
+				server.update(uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+			}
+		case "textDocument/didClose":
+			delete(server.open, uri)
+			server.publish(uri, []lspDiagnostic{})
+		}
+		return nil, nil
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		var params lspPositionParams
+		if err := json.Unmarshal(message.Params, &params); err != nil {
+			return nil, invalid(err)
+		}
+		var doc = server.document(params.TextDocument.Uri)
+		if doc == nil {
+			return nil, nil
+		}
+		var line, character = params.Position.Line + 1, params.Position.Character
+		switch message.Method {
+		case "textDocument/definition":
+			return server.definition(doc, line, character), nil
+		case "textDocument/hover":
+			return server.hover(doc, line, character), nil
+		}
+		return server.completion(doc, line, character), nil
+	}
+	if message.Id != nil {
+		return nil, &rpcError{rpcMethodNotFound, "unsupported method '" + message.Method + "'"}
+	}
+	// notifications we don't care about, like initialized and didSave
+	return nil, nil
+}
+
+func uriToPath(uri string) string {
+	if parsed, err := url.Parse(uri); err == nil && parsed.Scheme == "file" {
+		return parsed.Path
+	}
+	return uri
+}
+
+func pathToUri(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// scanWorkspace analyses every .e file under root, skipping hidden
+// directories
+func (server *langServer) scanWorkspace(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && path != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".e" {
+			if text, err := ioutil.ReadFile(path); err == nil {
+				var uri = pathToUri(path)
+				server.workspace[uri] = analyse(uri, string(text))
+			}
+		}
+		return nil
+	})
+}
+
+func (server *langServer) update(uri string, text string) {
+	var doc = analyse(uri, text)
+	server.open[uri] = doc
+	server.publish(uri, doc.diagnostics())
+}
+
+func (server *langServer) publish(uri string, diagnostics []lspDiagnostic) {
+	var params, _ = json.Marshal(map[string]interface{}{"uri": uri, "diagnostics": diagnostics})
+	writeMessage(server.out, rpcMessage{Method: "textDocument/publishDiagnostics", Params: params})
+}
+
+// document is the open copy of a document if there is one, otherwise the one
+// read from disk
+func (server *langServer) document(uri string) *lspDocument {
+	if doc, ok := server.open[uri]; ok {
+		return doc
+	}
+	return server.workspace[uri]
+}
+
+// documents is everything in the workspace, open copies in place of the
+// ones on disk, in a stable order
+func (server *langServer) documents() []*lspDocument {
+	var uris = make(map[string]bool)
+	for uri := range server.workspace {
+		uris[uri] = true
+	}
+	for uri := range server.open {
+		uris[uri] = true
+	}
+	var docs []*lspDocument
+	for _, uri := range sortedSet(uris) {
+		docs = append(docs, server.document(uri))
+	}
+	return docs
+}
+
+// definition goes from a variable to where its query first binds it
+func (server *langServer) definition(doc *lspDocument, line int, character int) interface{} {
+	var token = doc.tokenAt(line, character)
+	if token == nil || token.Type() != parser.IDENTIFIER || doc.isTagName(token) {
+		return nil
+	}
+	var variable = variableNamed(doc.queryAt(line), token.Value())
+	if variable == nil || variable.line < 1 {
+		return nil
+	}
+	var at = lspRange{lspPosition{variable.line - 1, 0}, lspPosition{variable.line - 1, 0}}
+	for _, t := range doc.tokens {
+		if t.Line() == variable.line && t.Type() == parser.IDENTIFIER && t.Value() == token.Value() && !doc.isTagName(t) {
+			at = lspRange{lspPosition{variable.line - 1, t.Offset()}, lspPosition{variable.line - 1, t.Offset() + tokenLength(t)}}
+			break
+		}
+	}
+	return lspLocation{doc.uri, at}
+}
+
+// hover describes a tag by the attributes seen with it across the
+// workspace, and a variable by the tags it's given
+func (server *langServer) hover(doc *lspDocument, line int, character int) interface{} {
+	var token = doc.tokenAt(line, character)
+	if token == nil || token.Type() != parser.IDENTIFIER {
+		return nil
+	}
+	var text string
+	if doc.isTagName(token) {
+		var byTag, _ = workspaceShapes(server.documents())
+		var attributes = sortedSet(byTag[token.Value()])
+		text = "**#" + token.Value() + "**"
+		if len(attributes) > 0 {
+			text += "\n\nattributes: " + strings.Join(attributes, ", ")
+		}
+	} else {
+		var query = doc.queryAt(line)
+		var variable = variableNamed(query, token.Value())
+		if variable == nil {
+			return nil
+		}
+		text = "variable **" + variable.name + "**"
+		var tags, _ = entityShapes(query)
+		if len(tags[variable]) > 0 {
+			var set = make(map[string]bool)
+			for _, tag := range tags[variable] {
+				set["#"+tag] = true
+			}
+			text += "\n\ntags: " + strings.Join(sortedSet(set), " ")
+		}
+	}
+	var span = lspRange{lspPosition{line - 1, token.Offset()}, lspPosition{line - 1, token.Offset() + tokenLength(token)}}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": text},
+		"range":    span,
+	}
+}
+
+// completion offers the workspace's tags after a #, and otherwise its
+// attributes and the variables of the query the cursor is in
+func (server *langServer) completion(doc *lspDocument, line int, character int) interface{} {
+	var byTag, attributes = workspaceShapes(server.documents())
+	var items = []lspCompletionItem{}
+	if line < 1 || line > len(doc.lines) {
+		return items
+	}
+	var before = []rune(strings.TrimRight(doc.lines[line-1], "\r"))
+	if character > len(before) {
+		character = len(before)
+	}
+	var start = character
+	for start > 0 && !strings.ContainsRune(" \t#:,()[]{}", before[start-1]) {
+		start--
+	}
+	if start > 0 && before[start-1] == '#' {
+		var tags = make(map[string]bool)
+		for tag := range byTag {
+			tags[tag] = true
+		}
+		for _, tag := range sortedSet(tags) {
+			items = append(items, lspCompletionItem{Label: tag, Kind: lspKindClass})
+		}
+		return items
+	}
+	for _, attribute := range sortedSet(attributes) {
+		items = append(items, lspCompletionItem{Label: attribute, Kind: lspKindProperty})
+	}
+	if query := doc.queryAt(line); query != nil {
+		var names = make(map[string]bool)
+		for _, variable := range query.variables {
+			// leave out the names the compiler makes up
+			if !strings.HasPrefix(variable.name, "$") && !strings.Contains(variable.name, ".") {
+				names[variable.name] = true
+			}
+		}
+		for _, name := range sortedSet(names) {
+			items = append(items, lspCompletionItem{Label: name, Kind: lspKindVariable, Detail: "variable"})
+		}
+	}
+	return items
+}
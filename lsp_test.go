@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lspSession sends requests to a server and collects everything it says back
+func lspSession(t *testing.T, requests ...string) map[string]json.RawMessage {
+	var in bytes.Buffer
+	for _, request := range requests {
+		in.WriteString("Content-Length: " + strconv.Itoa(len(request)) + "\r\n\r\n" + request)
+	}
+	var out bytes.Buffer
+	if err := ServeLsp(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	// results or errors by id, and the last notification of each method
+	var replies = make(map[string]json.RawMessage)
+	var reader = bufio.NewReader(&out)
+	for {
+		body, err := readMessage(reader)
+		if err != nil {
+			break
+		}
+		var message struct {
+			Id     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+			Error  json.RawMessage `json:"error"`
+		}
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Method != "" {
+			replies[message.Method] = message.Params
+		} else if message.Error != nil {
+			replies[string(message.Id)] = message.Error
+		} else {
+			replies[string(message.Id)] = message.Result
+		}
+	}
+	return replies
+}
+
+func TestLanguageServer(t *testing.T) {
+	var text = strings.Join([]string{
+		"count the people",
+		"  #person name age",
+		"  total = count(given: name)",
+		"",
+		"name the robots",
+		"  #robot model",
+		"  add",
+		"    #person name: model, age: 0",
+	}, "\\n")
+	var position = func(id int, method string, line int, character int) string {
+		return `{"jsonrpc":"2.0","id":` + strconv.Itoa(id) + `,"method":"textDocument/` + method + `","params":{"textDocument":{"uri":"file:///people.e"},"position":{"line":` + strconv.Itoa(line) + `,"character":` + strconv.Itoa(character) + `}}}`
+	}
+	var replies = lspSession(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///people.e","text":"`+text+`"}}}`,
+		position(2, "definition", 2, 26),
+		position(3, "hover", 1, 4),
+		position(4, "completion", 7, 5),
+		position(5, "completion", 7, 13),
+		`{"jsonrpc":"2.0","id":6,"method":"textDocument/formatting","params":{}}`,
+		`{"jsonrpc":"2.0","id":7,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+
+	if !strings.Contains(string(replies["1"]), `"hoverProvider":true`) {
+		t.Errorf("Unexpected capabilities %s", replies["1"])
+	}
+	if !strings.Contains(string(replies["textDocument/publishDiagnostics"]), `"uri":"file:///people.e"`) {
+		t.Errorf("Expected diagnostics for the document, got %s", replies["textDocument/publishDiagnostics"])
+	}
+
+	// name in count(given: name) goes back to where #person binds it
+	var location lspLocation
+	json.Unmarshal(replies["2"], &location)
+	if location.Range.Start != (lspPosition{1, 10}) || location.Range.End != (lspPosition{1, 14}) {
+		t.Errorf("Unexpected definition %s", replies["2"])
+	}
+
+	// #person has attributes from both queries
+	if !strings.Contains(string(replies["3"]), "attributes: age, name") {
+		t.Errorf("Unexpected hover %s", replies["3"])
+	}
+
+	var labels = func(raw json.RawMessage) []string {
+		var items []lspCompletionItem
+		json.Unmarshal(raw, &items)
+		var result []string
+		for _, item := range items {
+			result = append(result, item.Label)
+		}
+		return result
+	}
+	if got := strings.Join(labels(replies["4"]), " "); got != "person robot" {
+		t.Errorf("Expected tags after #, got %s", got)
+	}
+	if got := strings.Join(labels(replies["5"]), " "); got != "age model name model robot" {
+		t.Errorf("Expected attributes then variables, got %s", got)
+	}
+
+	if !strings.Contains(string(replies["6"]), strconv.Itoa(rpcMethodNotFound)) {
+		t.Errorf("Expected an unsupported method to be an error, got %s", replies["6"])
+	}
+}
+
+func TestLanguageServerLoadErrors(t *testing.T) {
+	var replies = lspSession(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///broken.e","text":"numbers\n  #a n\n  n = 1.2.3\n"}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	var published struct {
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	json.Unmarshal(replies["textDocument/publishDiagnostics"], &published)
+	if len(published.Diagnostics) != 1 {
+		t.Fatalf("expected the load error to be published, got %s", replies["textDocument/publishDiagnostics"])
+	}
+	if d := published.Diagnostics[0]; d.Range.Start.Line != 2 || !strings.Contains(d.Message, "invalid number 1.2.3") {
+		t.Errorf("expected the bad number on line 3, got %+v", d)
+	}
+}
+
+func TestLanguageServerNeedsShutdown(t *testing.T) {
+	var in = strings.NewReader("Content-Length: 33\r\n\r\n" + `{"jsonrpc":"2.0","method":"exit"}`)
+	if err := ServeLsp(in, &bytes.Buffer{}); err != errExitWithoutShutdown {
+		t.Errorf("Expected exiting without a shutdown to fail, got %v", err)
+	}
+}
@@ -1,103 +1,578 @@
 package main
 
 import (
-	//"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/witheve/evingo/parser"
 	"github.com/witheve/evingo/util/color"
-	"github.com/witheve/evingo/value"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
-	//"strings"
+	"strings"
+	"time"
 )
 
-func panicOnError(e error, msg string) {
-	if e != nil {
-		fmt.Println("ERROR: " + msg)
-		panic(e)
-	}
+//------------------------------------------------------------------------------
+// Subcommands
+//------------------------------------------------------------------------------
+
+// formatFlag adds the --format flag shared by the commands that can print
+// results for scripts to read. The first format is the default.
+func formatFlag(flags *flag.FlagSet, formats ...string) *string {
+	return flags.String("format", formats[0], "how to print results: "+orList(formats))
 }
 
-type Stringer interface {
-	String() string
+func checkFormat(format string, formats ...string) error {
+	for _, f := range formats {
+		if format == f {
+			return nil
+		}
+	}
+	return &usageError{"unknown format '" + format + "', expected " + orList(formats)}
 }
 
-func pprintCollection(list *interface{}) {
+func orList(items []string) string {
+	if len(items) == 1 {
+		return items[0]
+	}
+	return strings.Join(items[:len(items)-1], ", ") + " or " + items[len(items)-1]
 }
 
-func doDotStuff() {
-	// genericize
-	tree := value.NewMapNode()
-	value.Insert(tree, []string{"a", "b", "c"}, value.NewValnode(value.NewText("d")))
-	value.Insert(tree, []string{"a", "b", "z"}, value.NewValnode(value.NewText("e")))
-	fmt.Println(value.Tree2dot(tree))
+// export prints a document as JSON or YAML
+func export(doc interface{}, format string) {
+	if format == "yaml" {
+		fmt.Println(ToYaml(doc))
+	} else {
+		fmt.Println(ToJson(doc))
+	}
 }
 
-func main() {
-	args := os.Args
-	argsLen := len(args)
-	switch {
-	case argsLen == 1:
-		//print help
-		fmt.Printf("Welcome to %s", color.Bright("Eve!\n"))
-		fmt.Println("Here are the available commands:")
-		fmt.Printf("  - %s\n", color.Bright("dot"))
-		fmt.Printf("  - %s %s\n", color.Bright("parse"), color.Info("<file>"))
-		fmt.Printf("  - %s %s\n", color.Bright("parse"), color.Info("<file>"))
-	case args[1] == "dot":
-		doDotStuff()
-	case args[1] == "parse":
-		if argsLen > 2 {
-			parser.ParseFile(args[2])
+// printDiagnostics prints diagnostics as text or as a JSON array of objects
+// with file, line, severity, node and message fields
+func printDiagnostics(out io.Writer, path string, diagnostics []Diagnostic, format string) {
+	if format == "json" {
+		type jsonDiagnostic struct {
+			File     string `json:"file"`
+			Line     int    `json:"line"`
+			Severity string `json:"severity"`
+			Node     string `json:"node"`
+			Message  string `json:"message"`
+		}
+		var items = []jsonDiagnostic{}
+		for _, d := range diagnostics {
+			items = append(items, jsonDiagnostic{path, d.line, string(d.severity), d.node, d.msg})
+		}
+		var raw, _ = json.MarshalIndent(items, "", "  ")
+		fmt.Fprintln(out, string(raw))
+		return
+	}
+	for _, diagnostic := range diagnostics {
+		if diagnostic.severity == SeverityError {
+			fmt.Fprintln(out, color.Error(path+": "+diagnostic.String()))
 		} else {
-			fmt.Println(color.Error("Must provide a file to parse"))
+			fmt.Fprintln(out, color.Warning(path+": "+diagnostic.String()))
 		}
-	case args[1] == "load":
-		fmt.Println("Loading", args[2])
-		if argsLen > 2 {
-			data, err := ioutil.ReadFile(args[2])
-			panicOnError(err, "Invalid JSON file '"+args[2]+"'")
-			var facts = ReadFactsFromJson(data)
-			if true {
-				fmt.Println("---FACTS---")
-				result := "[\n"
-				for k, item := range *facts {
-					result += "  " + strconv.Itoa(k) + ": " + item.String() + ",\n"
-				}
-				fmt.Println(result[:len(result)-2] + "\n]")
-			}
+	}
+}
 
-			var entities = FactsToEntities(facts)
-			if true {
-				fmt.Println("---ENTITIES---")
-				result := "[\n"
-				for k, item := range entities {
-					result += "  " + strconv.Itoa(k) + ": " + item.String() + ",\n"
-				}
-				fmt.Println(result[:len(result)-2] + "\n]")
-			}
+func dump(title string, items []string) {
+	fmt.Println("---" + title + "---")
+	if len(items) == 0 {
+		fmt.Println("[]")
+		return
+	}
+	fmt.Println("[")
+	for k, item := range items {
+		var end = ","
+		if k == len(items)-1 {
+			end = ""
+		}
+		fmt.Println("  " + strconv.Itoa(k) + ": " + item + end)
+	}
+	fmt.Println("]")
+}
 
-			var tagMap = IndexEntitiesByTag(entities)
-			if true {
-				fmt.Println("---TAG MAP---")
-				fmt.Println(tagMap.String())
+var commands = []*command{
+	{
+		name:    "dot",
+		args:    "<file>",
+		summary: "print what a program compiles to as a graphviz digraph",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 1); err != nil {
+					return err
+				}
+				queries, diagnostics, err := LoadProgramFile(args[0])
+				printDiagnostics(os.Stderr, args[0], diagnostics, "text")
+				if err != nil {
+					return errors.New("unable to load '" + args[0] + "': " + err.Error())
+				}
+				fmt.Print(QueriesToDot(queries))
+				return nil
 			}
-
-			var query = TagMapToQueryGraph(tagMap)
-			if true {
-				fmt.Println("---QUERY GRAPH---")
-				fmt.Println(query.String())
+		},
+	},
+	{
+		name:    "parse",
+		args:    "<file>",
+		summary: "parse an .e file, printing the parser's debug output or the facts it compiles to",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var quiet = flags.Bool("quiet", false, "only report whether the file parses")
+			var format = formatFlag(flags, "text", "json", "yaml")
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 1); err != nil {
+					return err
+				}
+				if err := checkFormat(*format, "text", "json", "yaml"); err != nil {
+					return err
+				}
+				parser.Debug = !*quiet && *format == "text"
+				program, err := parser.ParseFile(args[0])
+				if err != nil {
+					return errors.New("couldn't parse '" + args[0] + "': " + err.Error())
+				}
+				if *format != "text" && !*quiet {
+					doc, err := ProgramDocument(program)
+					if err != nil {
+						return errors.New("couldn't compile '" + args[0] + "': " + err.Error())
+					}
+					export(doc, *format)
+				}
+				return nil
 			}
+		},
+	},
+	{
+		name:    "load",
+		args:    "<file>",
+		summary: "load a JSON fact file and print the stages of building its query graph",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var showFacts = flags.Bool("facts", false, "print the facts")
+			var showEntities = flags.Bool("entities", false, "print the entities the facts describe")
+			var showTagMap = flags.Bool("tagmap", false, "print the entities indexed by tag")
+			var showGraph = flags.Bool("graph", false, "print the query graph")
+			var quiet = flags.Bool("quiet", false, "print nothing, only check the file loads")
+			var format = formatFlag(flags, "text", "json", "yaml")
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 1); err != nil {
+					return err
+				}
+				if err := checkFormat(*format, "text", "json", "yaml"); err != nil {
+					return err
+				}
+				var path = args[0]
+				// with no stage picked, show them all
+				if !*showFacts && !*showEntities && !*showTagMap && !*showGraph {
+					*showFacts, *showEntities, *showTagMap, *showGraph = true, true, true, true
+				}
+				var show = func(stage bool) bool {
+					return stage && !*quiet && *format == "text"
+				}
+				// json and yaml gather the stages into one document
+				var doc = newObject()
+				var keep = func(stage bool, key string, f func() interface{}) {
+					if stage && !*quiet && *format != "text" {
+						doc.set(key, f())
+					}
+				}
 
-			//scanner := bufio.NewScanner(os.Stdin)
-			//for scanner.Scan() {
-			//	line := scanner.Text()
-			//	_ = strings.Split(line, " ")
-			//}
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return errors.New("unable to read file '" + path + "': " + err.Error())
+				}
+				facts, err := ReadFactsFromJson(data)
+				if err != nil {
+					return errors.New("invalid fact file '" + path + "': " + err.Error())
+				}
+				keep(*showFacts, "facts", func() interface{} { return FactsDocument(facts) })
+				if show(*showFacts) {
+					var items []string
+					for _, fact := range *facts {
+						items = append(items, fact.String())
+					}
+					dump("FACTS", items)
+				}
 
-		} else {
-			fmt.Println(color.Error("Must provide a file to load"))
-		}
-	}
+				var entities = FactsToEntities(facts)
+				keep(*showEntities, "entities", func() interface{} { return EntitiesDocument(entities) })
+				if show(*showEntities) {
+					var items []string
+					for _, entity := range entities {
+						items = append(items, entity.String())
+					}
+					dump("ENTITIES", items)
+				}
+
+				tagMap, err := IndexEntitiesByTag(entities)
+				if err != nil {
+					return errors.New("invalid entities in '" + path + "': " + err.Error())
+				}
+				keep(*showTagMap, "tagmap", func() interface{} { return TagMapDocument(tagMap) })
+				if show(*showTagMap) {
+					fmt.Println("---TAG MAP---")
+					fmt.Println(tagMap.String())
+				}
+
+				query, err := TagMapToQueryGraph(tagMap)
+				if err != nil {
+					return errors.New("invalid query graph in '" + path + "': " + err.Error())
+				}
+				keep(*showGraph, "graph", func() interface{} { return QueryDocument(query) })
+				if show(*showGraph) {
+					fmt.Println("---QUERY GRAPH---")
+					fmt.Println(query.String())
+				}
+				if *format != "text" && !*quiet {
+					export(doc, *format)
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "fmt",
+		args:    "[file...]",
+		summary: "format programs in place, or stdin to stdout if no files are given",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var check = flags.Bool("check", false, "change nothing, list the files that aren't formatted and exit 1 if there are any")
+			return func(args []string) error {
+				if len(args) == 0 {
+					code, err := ioutil.ReadAll(os.Stdin)
+					if err != nil {
+						return err
+					}
+					formatted, err := parser.Format(string(code))
+					if err != nil {
+						return errors.New("<stdin>: " + err.Error())
+					}
+					if *check {
+						if formatted != string(code) {
+							fmt.Println("<stdin>")
+							return errReported
+						}
+						return nil
+					}
+					fmt.Print(formatted)
+					return nil
+				}
+				var failed = false
+				for _, path := range args {
+					code, err := ioutil.ReadFile(path)
+					if err != nil {
+						return errors.New("unable to read '" + path + "': " + err.Error())
+					}
+					formatted, err := parser.Format(string(code))
+					if err != nil {
+						fmt.Fprintln(os.Stderr, color.Error(path+": "+err.Error()))
+						failed = true
+						continue
+					}
+					if formatted == string(code) {
+						continue
+					}
+					if *check {
+						fmt.Println(path)
+						failed = true
+						continue
+					}
+					if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+						return errors.New("unable to write '" + path + "': " + err.Error())
+					}
+				}
+				if failed {
+					return errReported
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "check",
+		args:    "<file>",
+		summary: "validate a program, exiting 1 if it has errors",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var quiet = flags.Bool("quiet", false, "only print errors, not warnings")
+			var format = formatFlag(flags, "text", "json")
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 1); err != nil {
+					return err
+				}
+				if err := checkFormat(*format, "text", "json"); err != nil {
+					return err
+				}
+				var path = args[0]
+				queries, diagnostics, err := LoadProgramFile(path)
+				if err != nil {
+					return errors.New("unable to load '" + path + "': " + err.Error())
+				}
+				diagnostics = append(diagnostics, CheckQueries(queries)...)
+				if *quiet {
+					var errs []Diagnostic
+					for _, diagnostic := range diagnostics {
+						if diagnostic.severity == SeverityError {
+							errs = append(errs, diagnostic)
+						}
+					}
+					diagnostics = errs
+				}
+				printDiagnostics(os.Stdout, path, diagnostics, *format)
+				if HasErrors(diagnostics) {
+					return errReported
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "plan",
+		args:    "<file> [data.json]",
+		summary: "print the plan for each query, costed against the data if given",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 2); err != nil {
+					return err
+				}
+				queries, _, err := LoadProgramFile(args[0])
+				if err != nil {
+					return errors.New("unable to load '" + args[0] + "': " + err.Error())
+				}
+				var stats Statistics
+				if len(args) > 1 {
+					db, err := LoadEdbFile(args[1])
+					if err != nil {
+						return errors.New("unable to load data from '" + args[1] + "': " + err.Error())
+					}
+					stats = db
+				}
+				for _, query := range queries {
+					plan, err := PlanQuery(query, stats, JoinAuto)
+					if err != nil {
+						return errors.New("unable to plan '" + query.name + "': " + err.Error())
+					}
+					fmt.Println(plan.String())
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "explain",
+		args:    "<file> [data.json]",
+		summary: "show how each block runs, and with --profile what running it costs",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var format = formatFlag(flags, "text", "json", "yaml")
+			var profile = flags.Bool("profile", false, "run the program, with the data in its bag if given, and count the rows, time and lookups of each step")
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 2); err != nil {
+					return err
+				}
+				if err := checkFormat(*format, "text", "json", "yaml"); err != nil {
+					return err
+				}
+				var path, data = args[0], ""
+				if len(args) > 1 {
+					data = args[1]
+				}
+				var explanations []*Explanation
+				if *profile {
+					var diagnostics []Diagnostic
+					var err error
+					explanations, diagnostics, err = ProfileProgram(path, data)
+					printDiagnostics(os.Stderr, path, diagnostics, "text")
+					if err != nil {
+						return errors.New("unable to run '" + path + "': " + err.Error())
+					}
+					if HasErrors(diagnostics) {
+						return errReported
+					}
+				} else {
+					queries, _, err := LoadProgramFile(path)
+					if err != nil {
+						return errors.New("unable to load '" + path + "': " + err.Error())
+					}
+					var stats Statistics
+					if data != "" {
+						db, err := LoadEdbFile(data)
+						if err != nil {
+							return errors.New("unable to load data from '" + data + "': " + err.Error())
+						}
+						stats = db
+					}
+					explanations, err = Explain(queries, stats)
+					if err != nil {
+						return errors.New("unable to explain '" + path + "': " + err.Error())
+					}
+				}
+				if *format == "text" {
+					fmt.Print(ExplanationsText(explanations))
+					return nil
+				}
+				export(ExplanationsDocument(explanations), *format)
+				return nil
+			}
+		},
+	},
+	{
+		name:    "run",
+		args:    "<file>",
+		summary: "run a program to a fixpoint and print the facts it ends with",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var format = formatFlag(flags, "text", "json")
+			var bag = flags.String("bag", "session", "the bags to run the program with, separated by commas: it runs in the first and reads them all, and name=facts.json fills a bag from a fact file first")
+			var watch = flags.Bool("watch", false, "keep running, reloading the blocks that change whenever the .e file is saved")
+			return func(args []string) error {
+				if err := expectArgs(args, 1, 1); err != nil {
+					return err
+				}
+				if err := checkFormat(*format, "text", "json"); err != nil {
+					return err
+				}
+				var path = args[0]
+				if *watch {
+					if filepath.Ext(path) != ".e" {
+						return &usageError{"--watch needs an .e file"}
+					}
+					watcher, err := NewWatcher(path, strings.Split(*bag, ","), os.Stdout)
+					if err != nil {
+						return errors.New("unable to run '" + path + "': " + err.Error())
+					}
+					defer watcher.Close()
+					var stop = make(chan struct{})
+					var interrupt = make(chan os.Signal, 1)
+					signal.Notify(interrupt, os.Interrupt)
+					go func() {
+						<-interrupt
+						close(stop)
+					}()
+					watcher.Watch(200*time.Millisecond, stop)
+					return nil
+				}
+				facts, diagnostics, err := RunProgram(path, strings.Split(*bag, ","))
+				printDiagnostics(os.Stderr, path, diagnostics, "text")
+				if err != nil {
+					return errors.New("unable to run '" + path + "': " + err.Error())
+				}
+				if HasErrors(diagnostics) {
+					return errReported
+				}
+				if *format == "json" {
+					fmt.Println(FactsToJson(facts))
+				} else {
+					for _, fact := range facts {
+						fmt.Println(textOf(fact[0]), textOf(fact[1]), fact[2].String())
+					}
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "test",
+		args:    "[path...]",
+		summary: "run the _test.e files in the paths given, or under the current directory",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			var verbose = flags.Bool("v", false, "list every test, not just the ones that fail")
+			return func(args []string) error {
+				if len(args) == 0 {
+					args = []string{"."}
+				}
+				files, err := FindTestFiles(args)
+				if err != nil {
+					return err
+				}
+				if len(files) == 0 {
+					fmt.Println("no test files")
+					return nil
+				}
+				var failed = false
+				for _, path := range files {
+					report, err := RunTestFile(path)
+					printDiagnostics(os.Stdout, path, report.Diagnostics, "text")
+					if err != nil {
+						fmt.Println(color.Error(path + ": " + err.Error()))
+					}
+					for _, test := range report.Tests {
+						if !test.Passed() {
+							fmt.Println(color.Error("--- FAIL: " + test.Name))
+							for _, failure := range test.Failures {
+								fmt.Println("    " + strings.Replace(failure, "\n", "\n    ", -1))
+							}
+						} else if *verbose {
+							fmt.Println("--- ok: " + test.Name)
+						}
+					}
+					if err == nil && report.Passed() {
+						fmt.Println("ok   " + path + " (" + strconv.Itoa(len(report.Tests)) + " tests)")
+					} else {
+						fmt.Println(color.Error("FAIL " + path))
+						failed = true
+					}
+				}
+				if failed {
+					return errReported
+				}
+				return nil
+			}
+		},
+	},
+	{
+		name:    "lsp",
+		summary: "serve the Language Server Protocol over stdin and stdout for editors",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			return func(args []string) error {
+				if err := expectArgs(args, 0, 0); err != nil {
+					return err
+				}
+				return ServeLsp(os.Stdin, os.Stdout)
+			}
+		},
+	},
+	{
+		name:    "repl",
+		args:    "[file...]",
+		summary: "start an interactive session, loading any files given",
+		setup: func(flags *flag.FlagSet) func([]string) error {
+			return func(args []string) error {
+				repl, err := NewRepl(os.Stdout)
+				if err != nil {
+					return errors.New("unable to start the REPL: " + err.Error())
+				}
+				defer repl.Close()
+				for _, path := range args {
+					if err := repl.Load(path); err != nil {
+						fmt.Println(color.Error("Unable to load '" + path + "': " + err.Error()))
+					}
+				}
+				if home, err := os.UserHomeDir(); err == nil {
+					repl.KeepHistory(filepath.Join(home, ".evingo_history"))
+				}
+				fmt.Println("Type :help for help, :quit to leave")
+				reader := newLineReader(os.Stdin, os.Stdout)
+				for {
+					line, err := reader.ReadLine(repl.Prompt(), repl.History(), repl.Complete)
+					if err == errInterrupted {
+						repl.Interrupt()
+						continue
+					}
+					if err != nil {
+						repl.End()
+						break
+					}
+					if !repl.Line(line) {
+						break
+					}
+				}
+				return nil
+			}
+		},
+	},
+}
+
+func main() {
+	os.Exit(runCommand(os.Args[1:], os.Stdout))
 }
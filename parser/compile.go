@@ -0,0 +1,246 @@
+//-----------------------------------------------------
+// Compile
+// Flattens the parse tree into the same entity/
+// attribute/value facts a hand-written program file
+// uses, so both share one loader
+//-----------------------------------------------------
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+)
+
+//-----------------------------------------------------
+// Program
+//-----------------------------------------------------
+
+// Number is a numeric constant, kept as its source text so no precision is
+// lost before it becomes a decimal
+type Number string
+
+// Fact is one triple of a compiled program. Value is a string, Number, bool
+// or int.
+type Fact struct {
+	Entity    string
+	Attribute string
+	Value     interface{}
+}
+
+func (f Fact) String() string {
+	return fmt.Sprintf("[%q, %q, %#v]", f.Entity, f.Attribute, f.Value)
+}
+
+type Program struct {
+	Facts  []Fact
+	Errors []*ParseError
+}
+
+//-----------------------------------------------------
+// Compiler
+//-----------------------------------------------------
+
+type compiler struct {
+	facts     []Fact
+	counts    map[string]int
+	variables map[*node]string
+}
+
+func (c *compiler) newId(prefix string) string {
+	c.counts[prefix]++
+	return fmt.Sprintf("%s%v", prefix, c.counts[prefix])
+}
+
+func (c *compiler) add(entity string, attribute string, value interface{}) {
+	c.facts = append(c.facts, Fact{entity, attribute, value})
+}
+
+// position records where in the source an entity came from so later passes
+// can point back at it
+func (c *compiler) position(entity string, n *node) {
+	c.add(entity, "line", n.line)
+	c.add(entity, "offset", n.offset)
+}
+
+func (c *compiler) compileQuery(query *node) {
+	queryId := c.newId("q")
+	c.add(queryId, "tag", "query")
+	c.add(queryId, "name", query.info["name"])
+	c.position(queryId, query)
+
+	// sort the variables so ids are stable from run to run
+	variables := query.info["variables"].(map[string]*node)
+	var names []string
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		variableId := queryId + "." + name
+		c.variables[variables[name]] = variableId
+		c.add(variableId, "tag", "variable")
+		c.add(variableId, "query", queryId)
+		c.add(variableId, "name", name)
+		c.position(variableId, variables[name])
+	}
+
+	for _, child := range query.children {
+		switch child.nodeType {
+		case OBJECT_NODE:
+			c.compileObject(queryId, child, "scan", "", false)
+		case EXPRESSION_NODE:
+			c.compileExpression(queryId, child)
+		case ADD_NODE, REMOVE_NODE, UPDATE_NODE:
+			operator := mutateOperators[child.nodeType]
+			forever := child.info["forever"] == true
+			for _, object := range child.children {
+				if object.nodeType == OBJECT_NODE {
+					c.compileObject(queryId, object, "mutate", operator, forever)
+				}
+			}
+		}
+	}
+}
+
+var mutateOperators = map[nodeType]string{
+	ADD_NODE:    "add",
+	REMOVE_NODE: "remove",
+	UPDATE_NODE: "update",
+}
+
+// compileObject turns each attribute of an object into its own scan (or
+// mutate) over entity/attribute/value, joined on the object's variable.
+// Objects nested under an attribute are compiled the same way, and the
+// attribute gets one value per object.
+func (c *compiler) compileObject(queryId string, object *node, sourceTag string, operator string, forever bool) {
+	entity, ok := object.info["variable"].(*node)
+	if !ok {
+		// the parser has already reported the missing name
+		return
+	}
+	for _, binding := range object.children {
+		if binding.nodeType != BINDING_NODE {
+			continue
+		}
+		if binding.info["nested"] == true {
+			for _, nested := range binding.children {
+				c.compileObject(queryId, nested, sourceTag, operator, forever)
+				if variable, ok := nested.info["variable"].(*node); ok {
+					c.compileSource(queryId, binding, sourceTag, operator, forever, c.variables[entity], c.variables[variable], nil)
+				}
+			}
+			continue
+		}
+		variable, constant := c.operand(queryId, binding)
+		c.compileSource(queryId, binding, sourceTag, operator, forever, c.variables[entity], variable, constant)
+	}
+}
+
+// compileSource emits one scan (or mutate) of entity's binding.field
+func (c *compiler) compileSource(queryId string, binding *node, sourceTag string, operator string, forever bool, entity string, variable string, constant interface{}) {
+	sourceId := c.newId(sourceTag[:1])
+	c.add(sourceId, "tag", sourceTag)
+	c.add(sourceId, "query", queryId)
+	if operator != "" {
+		c.add(sourceId, "operator", operator)
+	}
+	if forever {
+		c.add(sourceId, "forever", true)
+	}
+	c.position(sourceId, binding)
+
+	c.compileBinding(sourceId, "entity", binding, entity, nil)
+	c.compileBinding(sourceId, "attribute", binding, "", binding.info["field"])
+	c.compileBinding(sourceId, "value", binding, variable, constant)
+}
+
+// operand compiles whatever a binding holds, returning either the id of the
+// variable it's bound to or its constant value
+func (c *compiler) operand(queryId string, binding *node) (string, interface{}) {
+	if variable, ok := binding.info["variable"].(*node); ok {
+		return c.variables[variable], nil
+	}
+	if expression, ok := binding.info["expression"].(*node); ok {
+		return c.compileExpression(queryId, expression), nil
+	}
+	constant := binding.info["constant"]
+	if binding.info["constantType"] == "number" {
+		constant = Number(constant.(string))
+	}
+	return "", constant
+}
+
+// compileExpression emits an expression and its arguments, compiling nested
+// expressions first, and returns the variable its result is bound to ("" for
+// filters). Results nobody named get a fresh variable. An aggregate's given:
+// and per: become its projection and grouping.
+func (c *compiler) compileExpression(queryId string, expression *node) string {
+	expressionId := c.newId("e")
+	c.add(expressionId, "tag", "expression")
+	c.add(expressionId, "query", queryId)
+	c.add(expressionId, "operator", expression.info["operator"])
+	c.position(expressionId, expression)
+	for _, argument := range expression.children {
+		variable, constant := c.operand(queryId, argument)
+		c.compileBinding(expressionId, argument.info["field"].(string), argument, variable, constant)
+	}
+	given, _ := expression.info["given"].([]*node)
+	for _, variable := range given {
+		projectionId := c.newId("p")
+		c.add(projectionId, "tag", "projection")
+		c.add(projectionId, "expression", expressionId)
+		c.add(projectionId, "variable", c.variables[variable])
+	}
+	per, _ := expression.info["per"].([]*node)
+	for ix, variable := range per {
+		groupingId := c.newId("g")
+		c.add(groupingId, "tag", "grouping")
+		c.add(groupingId, "expression", expressionId)
+		c.add(groupingId, "ix", ix)
+		c.add(groupingId, "variable", c.variables[variable])
+	}
+	resultField, _ := expression.info["resultField"].(string)
+	if resultField == "" {
+		return ""
+	}
+	var result string
+	if variable, ok := expression.info["result"].(*node); ok {
+		result = c.variables[variable]
+	} else {
+		name := c.newId("$")
+		result = queryId + "." + name
+		c.add(result, "tag", "variable")
+		c.add(result, "query", queryId)
+		c.add(result, "name", name)
+		c.position(result, expression)
+	}
+	c.compileBinding(expressionId, resultField, expression, result, nil)
+	return result
+}
+
+// compileBinding binds field of a source to variable, or to constant if
+// variable is ""
+func (c *compiler) compileBinding(sourceId string, field string, at *node, variable string, constant interface{}) {
+	bindingId := c.newId("b")
+	c.add(bindingId, "tag", "binding")
+	c.add(bindingId, "source", sourceId)
+	c.add(bindingId, "field", field)
+	if variable != "" {
+		c.add(bindingId, "variable", variable)
+	} else {
+		c.add(bindingId, "constant", constant)
+	}
+	c.position(bindingId, at)
+}
+
+func compile(root *node) *Program {
+	c := &compiler{counts: make(map[string]int), variables: make(map[*node]string)}
+	for _, child := range root.children {
+		if child.nodeType == QUERY_NODE {
+			c.compileQuery(child)
+		}
+	}
+	errors, _ := root.info["errors"].([]*ParseError)
+	return &Program{c.facts, errors}
+}
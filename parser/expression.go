@@ -0,0 +1,377 @@
+//-----------------------------------------------------
+// Expressions
+// Infix arithmetic and comparisons, function calls
+// and string interpolation, on the right-hand side
+// of attributes or on a line of their own
+//-----------------------------------------------------
+
+package parser
+
+import (
+	"github.com/witheve/evingo/value"
+	"strconv"
+	"strings"
+)
+
+// EXPRESSION_NODE
+//    operator string
+//    resultField string, "" for filters
+//    result *VARIABLE_NODE, if the line assigns to a variable
+//    children []*BINDING_NODE, one per argument
+//
+// Operands are BINDING_NODEs with no source or field yet, holding a
+// variable, a constant, or an expression.
+
+var comparisons = map[string]string{
+	"=":  "=",
+	"!=": "not=",
+	"<":  "<",
+	">":  ">",
+	"<=": "<=",
+	">=": ">=",
+}
+
+func newExpression(token *Token, operator string, resultField string) *node {
+	expression := newNode(EXPRESSION_NODE, token.line, token.offset)
+	expression.info["operator"] = operator
+	expression.info["resultField"] = resultField
+	return expression
+}
+
+// argument attaches an operand to an expression as field
+func argument(expression *node, field string, operand *node) {
+	operand.info["source"] = expression
+	operand.info["field"] = field
+	expression.children = append(expression.children, operand)
+}
+
+func expressionOperand(token *Token, expression *node) *node {
+	operand := newNode(BINDING_NODE, token.line, token.offset)
+	operand.info["expression"] = expression
+	return operand
+}
+
+func infix(token *Token, operator string, resultField string, left *node, right *node) *node {
+	expression := newExpression(token, operator, resultField)
+	argument(expression, "a", left)
+	argument(expression, "b", right)
+	return expressionOperand(token, expression)
+}
+
+// parseExpression reads the longest expression it can from iter, and returns
+// nil if there isn't one. Errors are reported against line.
+func parseExpression(line *line, iter *tokenIterator) *node {
+	left := parseSum(line, iter)
+	if left == nil {
+		return nil
+	}
+	token, ok := iter.peek()
+	if !ok || token.tokenType != OPERATOR {
+		return left
+	}
+	operator, isComparison := comparisons[token.value]
+	if !isComparison {
+		return left
+	}
+	iter.read()
+	right := parseSum(line, iter)
+	if right == nil {
+		reportError(line, token, "'"+token.value+"' without a right-hand side")
+		return nil
+	}
+	return infix(token, operator, "", left, right)
+}
+
+func parseSum(line *line, iter *tokenIterator) *node {
+	left := parseProduct(line, iter)
+	for left != nil {
+		token, ok := iter.peek()
+		if !ok || token.tokenType != OPERATOR || (token.value != "+" && token.value != "-") {
+			break
+		}
+		iter.read()
+		right := parseProduct(line, iter)
+		if right == nil {
+			reportError(line, token, "'"+token.value+"' without a right-hand side")
+			return nil
+		}
+		left = infix(token, token.value, "return", left, right)
+	}
+	return left
+}
+
+func parseProduct(line *line, iter *tokenIterator) *node {
+	left := parsePrimary(line, iter)
+	for left != nil {
+		token, ok := iter.peek()
+		if !ok || token.tokenType != OPERATOR || (token.value != "*" && token.value != "/") {
+			break
+		}
+		iter.read()
+		right := parsePrimary(line, iter)
+		if right == nil {
+			reportError(line, token, "'"+token.value+"' without a right-hand side")
+			return nil
+		}
+		left = infix(token, token.value, "return", left, right)
+	}
+	return left
+}
+
+func parsePrimary(line *line, iter *tokenIterator) *node {
+	token, ok := iter.peek()
+	if !ok {
+		return nil
+	}
+	switch token.tokenType {
+	case NUMBER:
+		iter.read()
+		return newConstantBinding(token, nil, "", token.value, "number")
+	case STRING:
+		iter.read()
+		return parseString(line, token)
+	case IDENTIFIER:
+		iter.read()
+		if next, ok := iter.peek(); ok && next.tokenType == OPEN_PAREN {
+			return parseCall(line, iter, token)
+		}
+		return newBinding(token, nil, "", assignVariable(line, token, token.value))
+	case OPEN_PAREN:
+		iter.read()
+		inner := parseExpression(line, iter)
+		if inner == nil {
+			reportError(line, token, "Empty parentheses")
+			return nil
+		}
+		if close, ok := iter.read(); !ok || close.tokenType != CLOSE_PAREN {
+			reportError(line, token, "Unclosed (")
+			return nil
+		}
+		return inner
+	}
+	return nil
+}
+
+// parseCall reads the arguments of name(...). Arguments are either named
+// (by: " ") or positional, in which case they're matched up with the
+// function's inputs in order. Aggregates also take given:, the variables
+// whose distinct values are counted, and per:, the variables to group by,
+// each a variable or a parenthesised list of them. min and max are functions
+// too, and only aggregate when they start with a value:, given: or per:.
+func parseCall(line *line, iter *tokenIterator, name *Token) *node {
+	open, _ := iter.read()
+	signature, ok := value.LookupSignature(name.value)
+	aggregate := value.IsAggregate(name.value) && (!ok || startsAggregate(iter))
+	if aggregate {
+		signature, ok = value.LookupAggregate(name.value)
+	}
+	if !ok {
+		reportError(line, name, "Unknown function '"+name.value+"'")
+		return nil
+	}
+	resultField := ""
+	if len(signature.Outputs) > 0 {
+		resultField = signature.Outputs[0]
+	}
+	expression := newExpression(name, name.value, resultField)
+	position := 0
+	for {
+		token, ok := iter.peek()
+		if !ok {
+			reportError(line, open, "Unclosed (")
+			return nil
+		}
+		if token.tokenType == CLOSE_PAREN {
+			iter.read()
+			break
+		}
+		if token.tokenType == COMMA {
+			iter.read()
+			continue
+		}
+		field := ""
+		if token.tokenType == IDENTIFIER {
+			iter.read()
+			if next, ok := iter.peek(); ok && next.tokenType == COLON {
+				iter.read()
+				field = token.value
+				if aggregate && (field == "given" || field == "per") {
+					variables := parseVariableList(line, iter, token)
+					if variables == nil {
+						return nil
+					}
+					list, _ := expression.info[field].([]*node)
+					expression.info[field] = append(list, variables...)
+					continue
+				}
+				if !signature.HasField(field) || signature.IsOutput(field) {
+					reportError(line, token, "'"+name.value+"' has no argument '"+field+"'")
+				}
+			} else {
+				iter.unread()
+			}
+		}
+		if field == "" {
+			if position >= len(signature.Inputs) {
+				reportError(line, token, "Too many arguments to '"+name.value+"'")
+				return nil
+			}
+			field = signature.Inputs[position]
+			position++
+		}
+		operand := parseExpression(line, iter)
+		if operand == nil {
+			reportError(line, token, "Expected an argument to '"+name.value+"'")
+			return nil
+		}
+		argument(expression, field, operand)
+	}
+	return expressionOperand(name, expression)
+}
+
+// aggregateFields are the named arguments that make min and max aggregates
+var aggregateFields = map[string]bool{"value": true, "given": true, "per": true}
+
+// startsAggregate reports whether the arguments at iter begin with one only
+// an aggregate takes
+func startsAggregate(iter *tokenIterator) bool {
+	token, ok := iter.read()
+	if !ok {
+		return false
+	}
+	next, ok := iter.peek()
+	iter.unread()
+	return ok && token.tokenType == IDENTIFIER && aggregateFields[token.value] && next.tokenType == COLON
+}
+
+// parseVariableList reads the variable, or parenthesised list of variables,
+// given to an aggregate's given: or per:
+func parseVariableList(line *line, iter *tokenIterator, field *Token) []*node {
+	var variables []*node
+	open, _ := iter.peek()
+	parenthesised := open != nil && open.tokenType == OPEN_PAREN
+	if parenthesised {
+		iter.read()
+	}
+	for {
+		token, ok := iter.read()
+		if !ok || token.tokenType != IDENTIFIER {
+			reportError(line, field, "'"+field.value+"' takes a variable or a list of them in ()")
+			return nil
+		}
+		variables = append(variables, assignVariable(line, token, token.value))
+		if !parenthesised {
+			return variables
+		}
+		next, ok := iter.read()
+		if ok && next.tokenType == CLOSE_PAREN {
+			return variables
+		}
+		if !ok || next.tokenType != COMMA {
+			reportError(line, open, "Unclosed (")
+			return nil
+		}
+	}
+}
+
+// unescape turns the escapes in a string token into the characters they
+// stand for
+func unescape(raw string) string {
+	quoted := "\"" + strings.Replace(raw, "\n", "\\n", -1) + "\""
+	if s, err := strconv.Unquote(quoted); err == nil {
+		return s
+	}
+	return raw
+}
+
+// parseString turns "{name} is {age + 1}" into concatenations of its pieces.
+// Strings without any {} are just constants.
+func parseString(line *line, token *Token) *node {
+	var pieces []*node
+	rest := token.value
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			break
+		}
+		end += start
+		if start > 0 {
+			pieces = append(pieces, newConstantBinding(token, nil, "", unescape(rest[:start]), "string"))
+		}
+		// the inside of {} is an expression of its own, positioned at the string
+		tokens := Lex(rest[start+1 : end])
+		for _, inner := range tokens {
+			inner.line = token.line
+			inner.offset += token.offset
+		}
+		iter := newTokenIterator(tokens)
+		piece := parseExpression(line, &iter)
+		if extra, ok := iter.read(); ok {
+			reportError(line, extra, "Unexpected '"+extra.value+"' in {}")
+		}
+		if piece == nil {
+			reportError(line, token, "Empty {} in string")
+			return nil
+		}
+		pieces = append(pieces, piece)
+		rest = rest[end+1:]
+	}
+	if len(pieces) == 0 {
+		return newConstantBinding(token, nil, "", unescape(rest), "string")
+	}
+	if rest != "" {
+		pieces = append(pieces, newConstantBinding(token, nil, "", unescape(rest), "string"))
+	}
+	if len(pieces) == 1 && pieces[0].info["constant"] == nil {
+		expression := newExpression(token, "to-string", "return")
+		argument(expression, "a", pieces[0])
+		return expressionOperand(token, expression)
+	}
+	result := pieces[0]
+	for _, piece := range pieces[1:] {
+		result = infix(token, "concat", "return", result, piece)
+	}
+	return result
+}
+
+// parseExpressionLine handles a line of a query that isn't an object:
+// either a filter (age > 20) or an assignment (total = price * count). An
+// assignment is really just an = filter, but binding the variable to the
+// expression's result directly is what lets the variable be new.
+func parseExpressionLine(line *line) {
+	iter := newTokenIterator(line.tokens)
+	operand := parseExpression(line, &iter)
+	if extra, ok := iter.read(); ok {
+		reportError(line, extra, "Unexpected '"+extra.value+"'")
+	}
+	if operand == nil {
+		return
+	}
+	expression, ok := operand.info["expression"].(*node)
+	if !ok {
+		reportError(line, line.tokens[0], "Expected a filter or an assignment")
+		return
+	}
+	if expression.info["operator"] == "=" {
+		left, right := expression.children[0], expression.children[1]
+		if variable, ok := left.info["variable"].(*node); ok {
+			if inner, ok := right.info["expression"].(*node); ok && inner.info["resultField"] != "" {
+				expression = inner
+			} else {
+				expression = newExpression(line.tokens[0], "set", "return")
+				argument(expression, "a", right)
+			}
+			expression.info["result"] = variable
+		}
+	}
+	if expression.info["resultField"] != "" && expression.info["result"] == nil {
+		reportError(line, line.tokens[0], "The result of this expression isn't used")
+		return
+	}
+	line.rootNode = expression
+	setChildOnParentNode(line)
+}
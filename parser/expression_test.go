@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"testing"
+)
+
+// entity is the attributes of one compiled entity, each attribute's values
+// in the order they were emitted
+func entity(program *Program, id string) map[string][]interface{} {
+	var attributes = make(map[string][]interface{})
+	for _, fact := range program.Facts {
+		if fact.Entity == id {
+			attributes[fact.Attribute] = append(attributes[fact.Attribute], fact.Value)
+		}
+	}
+	return attributes
+}
+
+// tagged is the ids of the entities with tag, in the order they were emitted
+func tagged(program *Program, tag string) []string {
+	var ids []string
+	for _, fact := range program.Facts {
+		if fact.Attribute == "tag" && fact.Value == tag {
+			ids = append(ids, fact.Entity)
+		}
+	}
+	return ids
+}
+
+func parseQuery(t *testing.T, body string) *Program {
+	var program = ParseString("people\n  #person\n    name\n    dept\n    age\n" + body)
+	if len(program.Errors) > 0 {
+		t.Fatalf("expected no errors, got %v", program.Errors)
+	}
+	return program
+}
+
+func TestAggregateCalls(t *testing.T) {
+	var program = parseQuery(t, "  n = count(given: name, per: (dept, age))\n")
+	var expressions = tagged(program, "expression")
+	if len(expressions) != 1 || entity(program, expressions[0])["operator"][0] != "count" {
+		t.Fatalf("expected one count expression, got %v", expressions)
+	}
+	var projections = tagged(program, "projection")
+	if len(projections) != 1 {
+		t.Fatalf("expected one projection, got %v", projections)
+	}
+	if p := entity(program, projections[0]); p["expression"][0] != expressions[0] || p["variable"][0] != "q1.name" {
+		t.Errorf("expected the projection to be name, got %v", p)
+	}
+	var groupings = tagged(program, "grouping")
+	var expected = []string{"q1.dept", "q1.age"}
+	if len(groupings) != len(expected) {
+		t.Fatalf("expected %v groupings, got %v", len(expected), groupings)
+	}
+	for ix, id := range groupings {
+		if g := entity(program, id); g["ix"][0] != ix || g["variable"][0] != expected[ix] {
+			t.Errorf("expected grouping %v to be %v, got %v", ix, expected[ix], g)
+		}
+	}
+
+	// sum has no function, so its positional argument is its value
+	program = parseQuery(t, "  total = sum(age, given: name)\n")
+	var fields []interface{}
+	for _, id := range tagged(program, "binding") {
+		if b := entity(program, id); b["source"][0] == "e1" {
+			fields = append(fields, b["field"][0])
+		}
+	}
+	if len(fields) != 2 || fields[0] != "value" || fields[1] != "return" {
+		t.Errorf("expected sum to bind value and return, got %v", fields)
+	}
+	if len(tagged(program, "projection")) != 1 {
+		t.Errorf("expected sum to have a projection")
+	}
+
+	// max is a function of two arguments unless it starts like an aggregate
+	program = parseQuery(t, "  a = max(age, 2)\n  b = max(value: age, per: dept)\n")
+	if len(tagged(program, "projection")) != 0 || len(tagged(program, "grouping")) != 1 {
+		t.Errorf("expected only the second max to aggregate")
+	}
+}
+
+func TestAggregateCallErrors(t *testing.T) {
+	var tests = []struct {
+		body    string
+		message string
+	}{
+		{"  a = upper(name, given: age)\n", "'upper' has no argument 'given'"},
+		{"  a = max(age, 2, per: dept)\n", "'max' has no argument 'per'"},
+		{"  n = count(given: \"x\")\n", "'given' takes a variable or a list of them in ()"},
+		{"  n = count(per: (dept age))\n", "Unclosed ("},
+	}
+	for _, test := range tests {
+		var program = ParseString("people\n  #person\n    name\n    dept\n    age\n" + test.body)
+		var found = false
+		for _, err := range program.Errors {
+			found = found || err.Message == test.message
+		}
+		if !found {
+			t.Errorf("%q: expected %q, got %v", test.body, test.message, program.Errors)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+//-----------------------------------------------------
+// Format
+// Lays programs out one way, so diffs only show
+// changes that mean something
+//-----------------------------------------------------
+
+package parser
+
+import (
+	"strings"
+)
+
+// Format rewrites code canonically without changing what it means:
+//
+//  - lines nest by two spaces a level, since only how deep a line is
+//    matters to the parser, not by how much
+//  - tokens are separated by single spaces, except where punctuation hugs
+//    them (#tag, a.b, f(x), attr: value, x, y)
+//  - attributes of an object are separated by commas, and given their
+//    values with ':' rather than '='
+//  - there's at most one blank line in a row, and always one between queries
+//
+// Query names are kept exactly as written, and so are comments. Code that
+// doesn't parse isn't formatted; its first error comes back instead.
+func Format(code string) (string, error) {
+	code = strings.Replace(code, "\r\n", "\n", -1)
+	tokens := lex(code, true)
+	var codeTokens []*Token
+	byLine := make(map[int][]*Token)
+	for _, token := range tokens {
+		if token.tokenType == STRING && strings.Contains(token.value, "\n") {
+			return "", &ParseError{token.line, token.offset, "Can't format a string that runs over more than one line"}
+		}
+		if token.tokenType != COMMENT {
+			codeTokens = append(codeTokens, token)
+		}
+		byLine[token.line] = append(byLine[token.line], token)
+	}
+	root := ParseTokens(codeTokens, map[string]interface{}{"sourceType": "string"})
+	if errors, _ := root.info["errors"].([]*ParseError); len(errors) > 0 {
+		return "", errors[0]
+	}
+	starts := make(map[[2]int]bool)
+	attributeStarts(root, starts)
+
+	lines := strings.Split(code, "\n")
+	depths := lineDepths(lines, byLine)
+	var out []string
+	var lastDepth = 0
+	var blank = false
+	for ix, text := range lines {
+		lineTokens := byLine[ix+1]
+		if len(lineTokens) == 0 {
+			blank = len(out) > 0
+			continue
+		}
+		depth, isCode := depths[ix+1]
+		if !isCode {
+			// comments on their own go with the code after them
+			depth = commentDepth(ix+1, text, depths, len(lines))
+		}
+		if depth == 0 && lastDepth > 0 {
+			// a new query, or a comment before one
+			blank = true
+		}
+		if blank {
+			out = append(out, "")
+			blank = false
+		}
+		lastDepth = depth
+		if isCode && depth == 0 {
+			out = append(out, strings.TrimRight(text, " \t"))
+			continue
+		}
+		out = append(out, strings.Repeat("  ", depth)+formatTokens(lineTokens, starts))
+	}
+	if len(out) == 0 {
+		return "", nil
+	}
+	return strings.Join(out, "\n") + "\n", nil
+}
+
+// attributeStarts finds where each attribute of an object begins, which is
+// where its binding says it is. Tags and names have bindings too; those
+// point at the name after the # or @.
+func attributeStarts(n *node, starts map[[2]int]bool) {
+	for _, child := range n.children {
+		if n.nodeType == OBJECT_NODE && child.nodeType == BINDING_NODE {
+			starts[[2]int{child.line, child.offset}] = true
+		}
+		attributeStarts(child, starts)
+	}
+}
+
+// lineDepths is how deep each line with code on it sits in the line tree,
+// worked out the way ParseTokens does it. Query names are at depth 0.
+func lineDepths(lines []string, byLine map[int][]*Token) map[int]int {
+	depths := make(map[int]int)
+	var parents []int
+	for ix := range lines {
+		var first *Token
+		for _, token := range byLine[ix+1] {
+			if token.tokenType != COMMENT {
+				first = token
+				break
+			}
+		}
+		if first == nil {
+			continue
+		}
+		for len(parents) > 0 && parents[len(parents)-1] >= first.offset {
+			parents = parents[:len(parents)-1]
+		}
+		depths[ix+1] = len(parents)
+		parents = append(parents, first.offset)
+	}
+	return depths
+}
+
+// commentDepth puts a comment that starts a line at the depth of the next
+// line of code, or inside the query it's in if that's a new query. Comments
+// at the very start of a line stay there.
+func commentDepth(line int, text string, depths map[int]int, count int) int {
+	if !strings.HasPrefix(text, " ") && !strings.HasPrefix(text, "\t") {
+		return 0
+	}
+	for next := line + 1; next <= count; next++ {
+		if depth, ok := depths[next]; ok && depth > 0 {
+			return depth
+		} else if ok {
+			break
+		}
+	}
+	for previous := line - 1; previous > 0; previous-- {
+		if depth, ok := depths[previous]; ok {
+			if depth == 0 {
+				return 1
+			}
+			return depth
+		}
+	}
+	return 0
+}
+
+func isOpen(token *Token) bool {
+	return token.tokenType == OPEN_PAREN || token.tokenType == OPEN_BRACKET || token.tokenType == OPEN_CURLY
+}
+
+func isClose(token *Token) bool {
+	return token.tokenType == CLOSE_PAREN || token.tokenType == CLOSE_BRACKET || token.tokenType == CLOSE_CURLY
+}
+
+// formatTokens lays out one line's tokens
+func formatTokens(tokens []*Token, starts map[[2]int]bool) string {
+	var result strings.Builder
+	var isTagName = func(ix int) bool {
+		return ix > 0 && tokens[ix].tokenType == IDENTIFIER && (tokens[ix-1].tokenType == TAG || tokens[ix-1].tokenType == NAME)
+	}
+	var isAttribute = func(ix int) bool {
+		return starts[[2]int{tokens[ix].line, tokens[ix].offset}] && !isTagName(ix)
+	}
+	var seenAttribute = false
+	for ix, token := range tokens {
+		text := token.value
+		tokenType := token.tokenType
+		switch {
+		case tokenType == STRING:
+			text = "\"" + text + "\""
+		case tokenType == OPERATOR && text == "=" && ix > 0 && isAttribute(ix-1):
+			// attr = x means attr: x, but counter.count = x reads better as it is
+			afterDot := ix > 1 && tokens[ix-2].tokenType == DOT
+			if !afterDot && ix+1 < len(tokens) && tokens[ix+1].tokenType != COMMENT {
+				text = ":"
+				tokenType = COLON
+			}
+		}
+		if ix > 0 {
+			previous := tokens[ix-1]
+			switch {
+			case tokenType == COMMENT:
+				result.WriteString(" ")
+			case isAttribute(ix) && seenAttribute && previous.tokenType != COMMA:
+				result.WriteString(", ")
+			case tokenType == COMMA || tokenType == COLON || isClose(token):
+			case tokenType == DOT || previous.tokenType == DOT:
+			case previous.tokenType == TAG || previous.tokenType == NAME || isOpen(previous):
+			case (tokenType == OPEN_PAREN || tokenType == OPEN_BRACKET) && previous.tokenType == IDENTIFIER:
+			default:
+				result.WriteString(" ")
+			}
+		}
+		if isAttribute(ix) {
+			seenAttribute = true
+		}
+		result.WriteString(text)
+	}
+	return result.String()
+}
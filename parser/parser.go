@@ -33,6 +33,26 @@ func (t Token) String() string {
 	return fmt.Sprintf("{%v %v line %v ch %v}", t.tokenType, t.value, t.line, t.offset)
 }
 
+func (t Token) Type() TokenType {
+	return t.tokenType
+}
+
+// Value is the token's text. Strings don't include their quotes.
+func (t Token) Value() string {
+	return t.value
+}
+
+// Line counts from 1
+func (t Token) Line() int {
+	return t.line
+}
+
+// Offset is how many characters into its line the token starts, counting
+// from 0
+func (t Token) Offset() int {
+	return t.offset
+}
+
 const (
 	TAG           TokenType = "TAG"
 	NAME                    = "NAME"
@@ -43,15 +63,20 @@ const (
 	CLOSE_BRACKET           = "CLOSE_BRACKET"
 	OPEN_CURLY              = "OPEN_CURLY"
 	CLOSE_CURLY             = "CLOSE_CURLY"
+	COLON                   = "COLON"
+	COMMA                   = "COMMA"
+	OPERATOR                = "OPERATOR"
 	CHOOSE                  = "CHOOSE"
 	UNION                   = "UNION"
 	OR                      = "OR"
 	AND                     = "AND"
 	ADD                     = "ADD"
 	REMOVE                  = "REMOVE"
+	UPDATE                  = "UPDATE"
 	STRING                  = "STRING"
 	NUMBER                  = "NUMBER"
 	IDENTIFIER              = "IDENTIFIER"
+	COMMENT                 = "COMMENT"
 )
 
 var specials = map[rune]TokenType{
@@ -64,6 +89,20 @@ var specials = map[rune]TokenType{
 	')': CLOSE_PAREN,
 	'{': OPEN_CURLY,
 	'}': CLOSE_CURLY,
+	':': COLON,
+	',': COMMA,
+}
+
+// operator characters; any of them may be followed by = (<=, !=, ...).
+// - is handled on its own since it's also part of names and numbers.
+var operatorChars = map[rune]bool{
+	'+': true,
+	'*': true,
+	'/': true,
+	'<': true,
+	'>': true,
+	'=': true,
+	'!': true,
 }
 
 var keywords = map[string]TokenType{
@@ -73,6 +112,53 @@ var keywords = map[string]TokenType{
 	"or":     OR,
 	"add":    ADD,
 	"remove": REMOVE,
+	"update": UPDATE,
+}
+
+//-----------------------------------------------------
+// Debugging and errors
+//-----------------------------------------------------
+
+// Debug turns on the parser's trace output
+var Debug = false
+
+func debugln(args ...interface{}) {
+	if Debug {
+		fmt.Println(args...)
+	}
+}
+
+func debugf(format string, args ...interface{}) {
+	if Debug {
+		fmt.Printf(format, args...)
+	}
+}
+
+type ParseError struct {
+	Line    int
+	Offset  int
+	Message string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("line %v ch %v: %s", err.Line, err.Offset, err.Message)
+}
+
+// reportError records an error on the code context at the root of the line
+// tree, pointing at token if we have one or the start of the line otherwise
+func reportError(cur *line, token *Token, message string) {
+	err := &ParseError{cur.line, cur.offset, message}
+	if token != nil {
+		err.Line = token.line
+		err.Offset = token.offset
+	}
+	for cur.parent != nil {
+		cur = cur.parent
+	}
+	info := cur.rootNode.info
+	errors, _ := info["errors"].([]*ParseError)
+	info["errors"] = append(errors, err)
+	debugln(color.Error(err.Error()))
 }
 
 //-----------------------------------------------------
@@ -88,8 +174,12 @@ func isSpecialChar(ch rune) bool {
 	return found
 }
 
+func isOperatorChar(ch rune) bool {
+	return operatorChars[ch]
+}
+
 func isIdentifierChar(ch rune) bool {
-	return !isWhiteSpace(ch) && !isSpecialChar(ch)
+	return !isWhiteSpace(ch) && !isSpecialChar(ch) && !isOperatorChar(ch) && !isStringChar(ch)
 }
 
 func isKeyword(str string) bool {
@@ -196,7 +286,14 @@ func NewScanner(str string) *Scanner {
 // Lexing
 //-----------------------------------------------------
 
+// Lex turns code into tokens, leaving out comments
 func Lex(str string) []*Token {
+	return lex(str, false)
+}
+
+// lex is Lex, optionally keeping comments. A comment runs from // to the end
+// of the line and its token's value is the whole of it, slashes included.
+func lex(str string, comments bool) []*Token {
 	scanner := NewScanner(str)
 	var tokens []*Token
 	var curType TokenType
@@ -206,6 +303,11 @@ func Lex(str string) []*Token {
 		switch {
 		case isWhiteSpace(char):
 			scanner.eatWhiteSpace()
+		case strings.HasPrefix(scanner.str[scanner.byteOffset:], "//"):
+			str := scanner.eatWhile(func(ch rune) bool { return ch != '\n' })
+			if comments {
+				tokens = append(tokens, &Token{COMMENT, strings.TrimRight(str, " \t\r"), line, offset})
+			}
 		case isStringChar(char):
 			scanner.read()
 			str := scanner.eatWhileState(isStringCharStateful)
@@ -215,6 +317,14 @@ func Lex(str string) []*Token {
 		case isSpecialChar(char):
 			scanner.read()
 			tokens = append(tokens, &Token{specials[char], string(char), line, offset})
+		case isOperatorChar(char):
+			scanner.read()
+			str := string(char)
+			if next, nextOk := scanner.peek(); nextOk && next == '=' && char != '=' {
+				scanner.read()
+				str += "="
+			}
+			tokens = append(tokens, &Token{OPERATOR, str, line, offset})
 		case isDigitChar(char):
 			str := scanner.eatWhile(isDigitChar)
 			tokens = append(tokens, &Token{NUMBER, string(str), line, offset})
@@ -224,10 +334,12 @@ func Lex(str string) []*Token {
 			if nextOk && isDigitChar(next) {
 				str := "-" + scanner.eatWhile(isDigitChar)
 				tokens = append(tokens, &Token{NUMBER, string(str), line, offset})
-			} else {
+			} else if nextOk && isIdentifierChar(next) {
 				str := "-" + scanner.eatWhile(isIdentifierChar)
 				curType = IDENTIFIER
 				tokens = append(tokens, &Token{curType, str, line, offset})
+			} else {
+				tokens = append(tokens, &Token{OPERATOR, "-", line, offset})
 			}
 		case isIdentifierChar(char):
 			str := scanner.eatWhile(isIdentifierChar)
@@ -247,7 +359,7 @@ type tokenIterator struct {
 }
 
 func (iter *tokenIterator) peek() (*Token, bool) {
-	if iter.pos+1 < len(iter.tokens) {
+	if iter.pos+1 >= len(iter.tokens) {
 		return nil, false
 	}
 	return iter.tokens[iter.pos+1], true
@@ -261,9 +373,13 @@ func (iter *tokenIterator) read() (*Token, bool) {
 	return nil, false
 }
 
+// unread steps back a token, returning the one now current, if any. It can
+// step back to before the first token.
 func (iter *tokenIterator) unread() (*Token, bool) {
-	if iter.pos-1 > -1 {
+	if iter.pos > -1 {
 		iter.pos -= 1
+	}
+	if iter.pos > -1 {
 		return iter.tokens[iter.pos], true
 	}
 	return nil, false
@@ -285,6 +401,7 @@ const (
 	OBJECT_NODE                = "OBJECT"
 	ADD_NODE                   = "ADD"
 	REMOVE_NODE                = "REMOVE"
+	UPDATE_NODE                = "UPDATE"
 	EXPRESSION_NODE            = "EXPRESSION"
 	BINDING_NODE               = "BINDING_NODE"
 	VARIABLE_NODE              = "VARIABLE_NODE"
@@ -313,11 +430,16 @@ type node struct {
 //    variable
 //    attributes []*BINDING_NODE
 //
+// ADD_NODE, REMOVE_NODE, UPDATE_NODE
+//    forever bool
+//    objects []*OBJECT_NODE
+//
 // VARIABLE_NODE
 //    name
 //
 // BINDING_NODE
-//    variable
+//    variable, constant (with constantType) or expression *EXPRESSION_NODE,
+//    or nested true with the objects it holds as children
 //    field string
 //    source *node
 
@@ -465,64 +587,91 @@ func assignVariable(line *line, token *Token, name string) *node {
 	return variable
 }
 
+// parseNames reads any #tags and @names at the iterator, binding them on
+// object, and returns the first, which names the object's variable
+func parseNames(line *line, iter *tokenIterator, object *node) *Token {
+	var nameToken *Token
+	for token, ok := iter.read(); ok; token, ok = iter.read() {
+		var field string
+		switch token.tokenType {
+		case TAG:
+			field = "tag"
+		case NAME:
+			field = "name"
+		default:
+			iter.unread()
+			return nameToken
+		}
+		value, ok := iter.read()
+		if !ok || value.tokenType != IDENTIFIER {
+			reportError(line, token, "Naked "+token.value)
+			continue
+		}
+		object.children = append(object.children, newConstantBinding(value, object, field, value.value, "string"))
+		if nameToken == nil {
+			nameToken = value
+		}
+	}
+	return nameToken
+}
+
+// parseObjectLine handles a line that starts an object: tags and names
+// followed by attributes. Objects named by a tag in a query join with any
+// other of the same name, but in a mutation or nested under an attribute
+// every one is a new object. Under a mutation an object can also start with
+// a variable the query already has (counter, or counter.count = 1).
 func parseObjectLine(line *line) {
-	// query := getParentQuery(line)
 	iter := newTokenIterator(line.tokens)
 	curNode := line.rootNode
 	curNode.nodeType = OBJECT_NODE
-	info := curNode.info
 	setChildOnParentNode(line)
-	mode := "variable"
-	var nameToken *Token
-	for token, ok := iter.read(); ok; token, ok = iter.read() {
-		if mode == "variable" {
-			switch token.tokenType {
-			case TAG:
-				//create a binding for tag
-				value, ok := iter.read()
-				if !ok {
-					fmt.Println(color.Error("Naked # on line %v"), token.line)
-					continue
-				}
-				curNode.children = append(curNode.children, newConstantBinding(value, curNode, "tag", value.value, "string"))
-				if nameToken == nil {
-					nameToken = value
-				}
-			case NAME:
-				//create a binding for name
-				value, ok := iter.read()
-				if !ok {
-					fmt.Println(color.Error("Naked @ on line %v"), token.line)
-					continue
-				}
-				curNode.children = append(curNode.children, newConstantBinding(value, curNode, "name", value.value, "string"))
-				if nameToken == nil {
-					nameToken = value
-				}
-			default:
-				// what do we do here?
-				// mode = "attributes"
-			}
+	first, _ := iter.peek()
+	if first.tokenType == IDENTIFIER {
+		iter.read()
+		curNode.info["variable"] = assignVariable(line, first, first.value)
+		if dot, ok := iter.read(); ok && dot.tokenType != DOT {
+			reportError(line, dot, "Expected '.' or a new line after '"+first.value+"'")
+			return
 		}
-		fmt.Println("token: ", iter.pos, token)
+		parseAttributes(line, &iter, curNode)
+		return
 	}
+	nameToken := parseNames(line, &iter, curNode)
 	if nameToken == nil {
-		fmt.Println(color.Error("Object query without any naming # or @, %v"), line.line)
-	} else {
-		variable := assignVariable(line, nameToken, nameToken.value)
-		info["variable"] = variable
+		reportError(line, line.tokens[0], "Object query without any naming # or @")
+		return
+	}
+	name := nameToken.value
+	if parentType := line.parent.rootNode.nodeType; parentType == BINDING_NODE || isMutation(parentType) {
+		name = fmt.Sprintf("%s-%v.%v", name, nameToken.line, nameToken.offset)
+	}
+	curNode.info["variable"] = assignVariable(line, nameToken, name)
+	if nested := parseAttributes(line, &iter, curNode); nested != nil {
+		reportError(line, line.tokens[0], "Objects nested under '"+nested.info["field"].(string)+"' need a line of their own")
 	}
 }
 
+// parseAttributeLine handles a line under an object, which can add tags and
+// names as well as attributes
 func parseAttributeLine(line *line) {
-	fmt.Println("PARSING ATTRIBUTE LINE", line)
-	// the first token should be an identifier
+	debugln("PARSING ATTRIBUTE LINE", line)
 	iter := newTokenIterator(line.tokens)
-	field, ok := iter.read()
-	if !ok {
-		fmt.Println(color.Error("Empty attribute on line %v"), line.line)
+	object := line.parent.rootNode
+	parseNames(line, &iter, object)
+	if nested := parseAttributes(line, &iter, object); nested != nil {
+		line.rootNode = nested
+	} else {
+		// any lines under this one carry on with the same object
+		line.rootNode = object
 	}
-	// possible cases
+}
+
+// parseAttributes binds the rest of the line's attributes on object. It
+// returns the binding for an attribute with nothing after its colon, whose
+// value is the objects on the lines under it.
+func parseAttributes(line *line, iter *tokenIterator, object *node) *node {
+	var nested *node
+	// possible cases, any number of them separated by commas or spaces
 	//  attr
 	//  attr: constant
 	//  attr: var
@@ -530,42 +679,59 @@ func parseAttributeLine(line *line) {
 	//  attr = constant
 	//  attr = var
 	//  attr = some-expression
-	op, ok := iter.read()
-	fmt.Println("OP: ", op)
-	switch {
-	case !ok:
-		// we're just binding the attribute to its own name
-		// we need to look up if there's already a variable
-		// and if not, get one
-		variable := assignVariable(line, field, field.value)
-		line.rootNode = newBinding(field, line.parent.rootNode, field.value, variable)
-		fmt.Println("ADDING A BINDING!")
-		setChildOnParentNode(line)
-	case op.value == ":":
-		fallthrough
-	case op.value == "=":
-		rightSide, ok := iter.read()
+	//  attr:
+	//    #nested object
+	for field, ok := iter.read(); ok; field, ok = iter.read() {
+		if field.tokenType == COMMA {
+			continue
+		}
+		if field.tokenType != IDENTIFIER {
+			reportError(line, field, "Expected an attribute name, not '"+field.value+"'")
+			return nested
+		}
+		op, ok := iter.peek()
+		if !ok || (op.tokenType != COLON && op.value != "=") {
+			// we're just binding the attribute to its own name
+			// we need to look up if there's already a variable
+			// and if not, get one
+			variable := assignVariable(line, field, field.value)
+			object.children = append(object.children, newBinding(field, object, field.value, variable))
+			continue
+		}
+		iter.read()
+		if _, more := iter.peek(); !more && op.tokenType == COLON && len(line.children) > 0 {
+			nested = newNode(BINDING_NODE, field.line, field.offset)
+			nested.info["source"] = object
+			nested.info["field"] = field.value
+			nested.info["nested"] = true
+			object.children = append(object.children, nested)
+			continue
+		}
+		rightSide := parseExpression(line, iter)
 		// @TODO it's technically ok to put the right-hand side of the expression on another line,
 		// I'm not sure exactly how we should handle that
-		if !ok {
-			fmt.Println(color.Error("Equality without left-hand side on line %v"), line.line)
+		if rightSide == nil {
+			reportError(line, op, "Equality without right-hand side")
+			return nested
 		}
-		fmt.Println("EQUALITY ATTRIBUTE: ", rightSide)
-		// @TODO: write a helper that parses cases where an expression is expected
-		if rightSide.tokenType == NUMBER || rightSide.tokenType == STRING {
-			constantType := "string"
-			if rightSide.tokenType == NUMBER {
-				constantType = "number"
-			}
-			line.rootNode = newConstantBinding(field, line.parent.rootNode, field.value, rightSide.value, constantType)
-		} else {
-			line.rootNode = newConstantBinding(field, line.parent.rootNode, field.value, "THIS SHOULD BE AN EXPRESSION", "string")
+		debugln("EQUALITY ATTRIBUTE: ", rightSide)
+		if expression, ok := rightSide.info["expression"].(*node); ok && expression.info["resultField"] == "" {
+			reportError(line, op, "'"+expression.info["operator"].(string)+"' is a filter and has no value to give '"+field.value+"'")
+			return nested
 		}
-		setChildOnParentNode(line)
-
+		rightSide.info["source"] = object
+		rightSide.info["field"] = field.value
+		rightSide.line = field.line
+		rightSide.offset = field.offset
+		object.children = append(object.children, rightSide)
 	}
+	return nested
 }
 
+// parseMutationLine handles add, remove and update, optionally followed by
+// forever. Mutations always commit, so while a program runs forever changes
+// nothing; it matters when the block is reloaded away, since what it added
+// forever stays.
 func parseMutationLine(line *line) {
 	iter := newTokenIterator(line.tokens)
 	curNode := line.rootNode
@@ -575,8 +741,16 @@ func parseMutationLine(line *line) {
 		curNode.nodeType = ADD_NODE
 	case REMOVE:
 		curNode.nodeType = REMOVE_NODE
+	case UPDATE:
+		curNode.nodeType = UPDATE_NODE
+	}
+	if next, ok := iter.read(); ok {
+		if next.value == "forever" {
+			curNode.info["forever"] = true
+		} else {
+			reportError(line, next, "Unexpected '"+next.value+"'")
+		}
 	}
-	//@TODO check for "forever"
 	setChildOnParentNode(line)
 }
 
@@ -592,31 +766,37 @@ func getSiblingLine(line *line) (*line, bool) {
 func parseLine(line *line) {
 	parentNode := getLineNode(line.parent)
 	parentType := parentNode.nodeType
-	fmt.Println("PARSING", line.line, "PARENT", parentType)
+	debugln("PARSING", line.line, "PARENT", parentType)
 	if parentType == CODE_CONTEXT_NODE {
 		parseQueryLine(line)
-	} else {
-		iter := newTokenIterator(line.tokens)
-		// otherwise we have to look at the first bits of the line and the parent
-		// context to get a sense of what it's doing
-		if parentType == OBJECT_NODE {
-			//treat this as an attribute
-			parseAttributeLine(line)
-		}
-		firstToken, _ := iter.read()
-		if firstToken.tokenType == TAG || firstToken.tokenType == NAME {
-			//@TODO: we need to handle #eavs specially
-			parseObjectLine(line)
-		}
-		if firstToken.tokenType == ADD || firstToken.tokenType == REMOVE {
-			parseMutationLine(line)
-		}
-
-		// if it's just an identifier and we're in the context of a selection
-
+		return
+	}
+	// otherwise we have to look at the first bits of the line and the parent
+	// context to get a sense of what it's doing
+	firstToken := line.tokens[0]
+	switch {
+	case parentType == OBJECT_NODE:
+		parseAttributeLine(line)
+	case parentType == BINDING_NODE:
+		// objects nested under an attribute
+		parseObjectLine(line)
+	case firstToken.tokenType == TAG || firstToken.tokenType == NAME:
+		//@TODO: we need to handle #eavs specially
+		parseObjectLine(line)
+	case firstToken.tokenType == ADD || firstToken.tokenType == REMOVE || firstToken.tokenType == UPDATE:
+		parseMutationLine(line)
+	case firstToken.tokenType == IDENTIFIER && isMutation(parentType):
+		// a variable the query already has
+		parseObjectLine(line)
+	case parentType == QUERY_NODE:
+		parseExpressionLine(line)
 	}
 }
 
+func isMutation(nodeType nodeType) bool {
+	return nodeType == ADD_NODE || nodeType == REMOVE_NODE || nodeType == UPDATE_NODE
+}
+
 func getLineNode(line *line) *node {
 	// NOTE: if parseLine calls getLineNode on its children
 	// before setting the nodeType it's possible for this
@@ -626,7 +806,7 @@ func getLineNode(line *line) *node {
 	curType := line.rootNode.nodeType
 	if curType == UNKNOWN_NODE {
 		parseLine(line)
-		fmt.Println("Node type: ", line.rootNode.nodeType)
+		debugln("Node type: ", line.rootNode.nodeType)
 	}
 	return line.rootNode
 }
@@ -643,7 +823,7 @@ func fullParseTree(root *line) *node {
 	return root.rootNode
 }
 
-func ParseTokens(tokens []*Token, info map[string]interface{}) {
+func ParseTokens(tokens []*Token, info map[string]interface{}) *node {
 	var token *Token
 	// var queries []node
 	// var context []node
@@ -666,33 +846,34 @@ func ParseTokens(tokens []*Token, info map[string]interface{}) {
 			parentLine = parentLine.parent
 		}
 		currentLine := newLine(parentLine, indent, lineTokens)
-		fmt.Println("Parent", parentLine)
-		fmt.Println("Child", currentLine)
+		debugln("Parent", parentLine)
+		debugln("Child", currentLine)
 		parentLine.children = append(parentLine.children, currentLine)
 		parentLine = currentLine
 		// context = parseLine(, queries, context)
-		fmt.Printf("Line tree: %v\n\n\n", codeContext)
+		debugf("Line tree: %v\n\n\n", codeContext)
 	}
-	fmt.Printf("Parse nodes:\n\n%v\n\n", fullParseTree(codeContext))
+	root := fullParseTree(codeContext)
+	debugf("Parse nodes:\n\n%v\n\n", root)
+	return root
 }
 
-func ParseString(code string) {
+func ParseString(code string) *Program {
 	tokens := Lex(code)
 	info := make(map[string]interface{})
 	info["sourceType"] = "string"
-	ParseTokens(tokens, info)
+	return compile(ParseTokens(tokens, info))
 }
 
-func ParseFile(path string) {
+func ParseFile(path string) (*Program, error) {
 	content, err := ioutil.ReadFile(path)
-	if err == nil {
-		code := string(content)
-		tokens := Lex(code)
-		info := make(map[string]interface{})
-		info["sourceType"] = "file"
-		info["file"] = path
-		ParseTokens(tokens, info)
-	} else {
-		fmt.Printf(color.Error("Couldn't read file: %v"), path)
+	if err != nil {
+		return nil, err
 	}
+	code := string(content)
+	tokens := Lex(code)
+	info := make(map[string]interface{})
+	info["sourceType"] = "file"
+	info["file"] = path
+	return compile(ParseTokens(tokens, info)), nil
 }
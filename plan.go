@@ -0,0 +1,747 @@
+package main
+
+import (
+	"errors"
+	"github.com/witheve/evingo/value"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Plan Types
+//------------------------------------------------------------------------------
+
+// Statistics is what the planner needs to know about the data; the edb
+// implements it.
+type Statistics interface {
+	Estimate(e, a, v value.Value, bound [3]bool) int
+}
+
+// assumed size of a scan when there are no statistics to go on
+const defaultEstimate = 1000
+
+// JoinStrategy picks how a plan's scans are joined. Nested joins the
+// patterns one at a time in the cheapest order; generic binds one variable at
+// a time across every pattern (see value.buildJoin). Auto uses generic only
+// for cyclic queries, where nested joins produce huge intermediate results
+// on skewed data; everywhere else nested is as good or better (see the
+// Triangles benchmarks).
+type JoinStrategy int
+
+const (
+	JoinAuto JoinStrategy = iota
+	JoinNested
+	JoinGeneric
+)
+
+// A planTerm is one position of a pattern: either a constant or a register.
+// Registers are usually a query variable, but object-style scans without a
+// $$ENTITY binding get an anonymous one.
+type planTerm struct {
+	constant value.Value
+	variable *VariableNode
+	register int
+}
+
+func (t planTerm) String() string {
+	if t.constant != nil {
+		return t.constant.String()
+	}
+	if t.variable != nil {
+		return t.variable.name
+	}
+	return "_" + strconv.Itoa(t.register)
+}
+
+func (t planTerm) Node() value.Node {
+	if t.constant != nil {
+		return value.NewValnode(t.constant)
+	}
+	return value.NewRegisterNode(t.register)
+}
+
+// A pattern is a single entity/attribute/value lookup. Triple-style scans
+// (fields entity, attribute and value) are one pattern; object-style scans
+// (a field per attribute, plus $$ENTITY) are one pattern per attribute.
+type pattern struct {
+	scan  *ScanNode
+	terms [3]planTerm
+}
+
+func (p *pattern) String() string {
+	return "[" + p.terms[0].String() + " " + p.terms[1].String() + " " + p.terms[2].String() + "]"
+}
+
+type PlanStep struct {
+	pattern    *pattern        // set for scans
+	expression *ExpressionNode // set for expressions
+	join       []*pattern      // set for generic joins, along with order
+	order      []planTerm
+	not        *NotNode // set for nots, along with the body's steps
+	body       []*PlanStep
+	estimate   int
+}
+
+func (step *PlanStep) String() string {
+	if step.not != nil {
+		var body []string
+		for _, inner := range step.body {
+			body = append(body, inner.String())
+		}
+		return "not " + step.not.id + " (" + strings.Join(body, "; ") + ")"
+	}
+	if step.join != nil {
+		var result = "join"
+		for _, p := range step.join {
+			result += " " + p.scan.id + p.String()
+		}
+		result += " on "
+		for ix, t := range step.order {
+			if ix > 0 {
+				result += ", "
+			}
+			result += t.String()
+		}
+		return result
+	}
+	if step.pattern != nil {
+		return "scan " + step.pattern.scan.id + " " + step.pattern.String() + " ~" + strconv.Itoa(step.estimate) + " rows"
+	}
+	// bindings are in whatever order they were loaded in
+	var bindings = append([]*BindingNode(nil), step.expression.bindings...)
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].field < bindings[j].field
+	})
+	var args = ""
+	for _, binding := range bindings {
+		if args != "" {
+			args += ", "
+		}
+		args += binding.field + ": "
+		if binding.IsConstant() {
+			args += binding.constant.String()
+		} else {
+			args += binding.variable.name
+		}
+	}
+	return "expression " + step.expression.id + " " + step.expression.operator + "(" + args + ")"
+}
+
+type Plan struct {
+	query     *QueryNode
+	registers map[*VariableNode]int
+	size      int
+	steps     []*PlanStep
+}
+
+func (plan *Plan) String() string {
+	var result = "Plan<" + plan.query.id + ">{"
+	result += "\n  registers: (" + strconv.Itoa(plan.size) + ") ["
+	var variables = sortedVariables(plan.query)
+	for ix, variable := range variables {
+		if ix > 0 {
+			result += ", "
+		}
+		result += variable.name + "=" + strconv.Itoa(plan.registers[variable])
+	}
+	result += "],\n  steps: ["
+	for ix, step := range plan.steps {
+		result += "\n    " + strconv.Itoa(ix+1) + ". " + step.String()
+	}
+	return result + "\n  ]\n}"
+}
+
+// Node renders the plan as the chain of operator nodes value.Build expects
+func (plan *Plan) Node() value.Node {
+	return plan.chain(plan.steps)
+}
+
+func (plan *Plan) chain(steps []*PlanStep) value.Node {
+	var root value.Node
+	var tail value.Node
+	for _, step := range steps {
+		var n value.Node
+		if step.not != nil {
+			n = value.NewOpNode("not")
+			value.Set(n, "body", plan.chain(step.body))
+		} else if step.join != nil {
+			n = joinNode(step)
+		} else if step.pattern != nil {
+			n = value.NewOpNode("scan")
+			for ix, key := range []string{"e", "a", "v"} {
+				value.Set(n, key, step.pattern.terms[ix].Node())
+			}
+		} else {
+			n = plan.expressionNode(step.expression)
+		}
+		if root == nil {
+			root = n
+		} else {
+			value.Set(tail, "next", n)
+		}
+		tail = n
+	}
+	return root
+}
+
+func joinNode(step *PlanStep) value.Node {
+	var n = value.NewOpNode("join")
+	var patterns []value.Node
+	for _, p := range step.join {
+		var pn = value.NewMapNode()
+		for ix, key := range []string{"e", "a", "v"} {
+			value.Set(pn, key, p.terms[ix].Node())
+		}
+		patterns = append(patterns, pn)
+	}
+	var order []value.Node
+	for _, t := range step.order {
+		order = append(order, value.NewValnode(value.NewNumberFromInt(int64(t.register))))
+	}
+	value.Set(n, "patterns", value.NewSetNode(patterns))
+	value.Set(n, "order", value.NewSetNode(order))
+	return n
+}
+
+func (plan *Plan) term(binding *BindingNode) planTerm {
+	if binding.IsConstant() {
+		return planTerm{constant: binding.constant, register: -1}
+	}
+	return planTerm{variable: binding.variable, register: plan.registers[binding.variable]}
+}
+
+// expressionNode puts inputs at their position in the operator's signature
+// and outputs under their names
+func (plan *Plan) expressionNode(expression *ExpressionNode) value.Node {
+	if expression.IsAggregate() {
+		return plan.aggregateNode(expression)
+	}
+	var n = value.NewOpNode("expression")
+	value.Set(n, "operator", value.NewValnode(value.NewText(expression.operator)))
+	var signature, _ = expression.Signature()
+	for _, binding := range expression.bindings {
+		var key = signature.Canonical(binding.field)
+		if !signature.IsOutput(binding.field) {
+			var name = signature.Canonical(binding.field)
+			for ix, input := range signature.Inputs {
+				if input == name {
+					key = strconv.Itoa(ix)
+				}
+			}
+		}
+		value.Set(n, key, plan.term(binding).Node())
+	}
+	return n
+}
+
+// aggregateNode passes the projection and grouping through as register lists
+// along with the aggregate's value and result
+func (plan *Plan) aggregateNode(expression *ExpressionNode) value.Node {
+	var n = value.NewOpNode("aggregate")
+	value.Set(n, "operator", value.NewValnode(value.NewText(expression.operator)))
+	var signature, _ = expression.Signature()
+	for _, binding := range expression.bindings {
+		value.Set(n, signature.Canonical(binding.field), plan.term(binding).Node())
+	}
+	value.Set(n, "grouping", plan.registerList(expression.grouping))
+	if len(expression.projection) > 0 {
+		value.Set(n, "projection", plan.registerList(expression.projection))
+	}
+	return n
+}
+
+func (plan *Plan) registerList(variables []*VariableNode) value.Node {
+	var registers []value.Node
+	for _, variable := range variables {
+		if variable != nil {
+			registers = append(registers, value.NewValnode(value.NewNumberFromInt(int64(plan.registers[variable]))))
+		}
+	}
+	return value.NewSetNode(registers)
+}
+
+// build compiles steps into a function that feeds rows through them and on
+// to out. With a profile, each step is compiled on its own and wrapped so the
+// profile sees the rows going in and out of it and the time it takes.
+func (plan *Plan) build(env *value.Env, steps []*PlanStep, out func(value.Operator, []value.Value), profile *Profile) func(value.Operator, []value.Value) {
+	if profile == nil || len(steps) == 0 {
+		return value.Build(env, plan.chain(steps), out)
+	}
+	var next = out
+	for ix := len(steps) - 1; ix >= 0; ix-- {
+		var step = profile.step(steps[ix])
+		var run = value.Build(env, plan.chain(steps[ix:ix+1]), step.output(next))
+		next = profile.input(step, run)
+	}
+	return next
+}
+
+// Registers is how wide a row of this plan is
+func (plan *Plan) Registers() int {
+	return plan.size
+}
+
+// Run executes the plan against a context, calling f with each result row
+func (plan *Plan) Run(c context, f func(row []value.Value)) error {
+	var err error
+	var run = plan.build(&value.Env{Relation: c}, plan.steps, func(op value.Operator, row []value.Value) {
+		switch op {
+		case value.OpError:
+			if err == nil {
+				err = errors.New(row[0].(*value.Text).Value())
+			}
+		case value.OpInsert:
+			f(row)
+		}
+	}, nil)
+	run(value.OpInsert, make([]value.Value, plan.size))
+	run(value.OpFlush, nil)
+	return err
+}
+
+//------------------------------------------------------------------------------
+// Planning
+//------------------------------------------------------------------------------
+
+func sortedVariables(query *QueryNode) []*VariableNode {
+	var variables []*VariableNode
+	for _, variable := range query.variables {
+		variables = append(variables, variable)
+	}
+	sort.Sort(variablesByName(variables))
+	return variables
+}
+
+type variablesByName []*VariableNode
+
+func (vs variablesByName) Len() int      { return len(vs) }
+func (vs variablesByName) Swap(i, j int) { vs[i], vs[j] = vs[j], vs[i] }
+func (vs variablesByName) Less(i, j int) bool {
+	if vs[i].name != vs[j].name {
+		return vs[i].name < vs[j].name
+	}
+	return vs[i].id < vs[j].id
+}
+
+// patterns breaks a scan into entity/attribute/value lookups
+func (plan *Plan) patterns(scan *ScanNode) []*pattern {
+	var triple = [3]planTerm{{register: -2}, {register: -2}, {register: -2}}
+	var isTriple = true
+	var entity *BindingNode
+	for _, binding := range scan.bindings {
+		switch binding.field {
+		case "entity":
+			triple[0] = plan.term(binding)
+		case "attribute":
+			triple[1] = plan.term(binding)
+		case "value":
+			triple[2] = plan.term(binding)
+		case "$$ENTITY":
+			entity = binding
+			isTriple = false
+		default:
+			isTriple = false
+		}
+	}
+	if isTriple {
+		// any field the scan doesn't mention is an anonymous register
+		for ix := range triple {
+			if triple[ix].register == -2 {
+				triple[ix] = planTerm{register: plan.anonymous()}
+			}
+		}
+		return []*pattern{{scan, triple}}
+	}
+
+	var entityTerm planTerm
+	if entity != nil {
+		entityTerm = plan.term(entity)
+	} else {
+		entityTerm = planTerm{register: plan.anonymous()}
+	}
+	var patterns []*pattern
+	for _, binding := range scan.bindings {
+		if binding == entity {
+			continue
+		}
+		var attribute = planTerm{constant: value.NewText(binding.field), register: -1}
+		patterns = append(patterns, &pattern{scan, [3]planTerm{entityTerm, attribute, plan.term(binding)}})
+	}
+	return patterns
+}
+
+func (plan *Plan) anonymous() int {
+	plan.size++
+	return plan.size - 1
+}
+
+func (p *pattern) estimate(stats Statistics, bound map[int]bool) int {
+	var constants [3]value.Value
+	var isBound [3]bool
+	for ix, t := range p.terms {
+		if t.constant != nil {
+			constants[ix] = t.constant
+		} else {
+			isBound[ix] = bound[t.register]
+		}
+	}
+	if stats == nil {
+		var estimate = defaultEstimate
+		for ix := range p.terms {
+			if constants[ix] != nil || isBound[ix] {
+				estimate /= 10
+			}
+		}
+		return estimate
+	}
+	return stats.Estimate(constants[0], constants[1], constants[2], isBound)
+}
+
+// ready reports whether every input of an expression will have a value
+func (plan *Plan) ready(expression *ExpressionNode, bound map[int]bool) bool {
+	var signature, ok = expression.Signature()
+	if !ok {
+		return false
+	}
+	for _, binding := range expression.bindings {
+		if binding.IsConstant() || signature.IsOutput(binding.field) {
+			continue
+		}
+		if !bound[plan.registers[binding.variable]] {
+			return false
+		}
+	}
+	return true
+}
+
+// PlanQuery picks an order for a query's scans, expressions and nots. It's
+// greedy: any expression whose inputs are all bound runs as soon as it can,
+// since filtering early is always a win, and so does any not whose variables
+// the query has bound; otherwise the scan with the smallest estimated output
+// given what's already bound goes next. stats may be nil, in which case every
+// scan is assumed to be the same size and constants and bound variables are
+// what tip the balance. Unions and chooses can't be planned yet, and are an
+// error.
+func PlanQuery(query *QueryNode, stats Statistics, strategy JoinStrategy) (*Plan, error) {
+	var plan = &Plan{query: query, registers: make(map[*VariableNode]int)}
+	var names = make(map[string]int)
+	for _, variable := range sortedVariables(query) {
+		plan.registers[variable] = plan.anonymous()
+		names[variable.name] = plan.registers[variable]
+	}
+	var steps, err = plan.order(query, names, make(map[int]bool), stats, strategy)
+	if err != nil {
+		return nil, err
+	}
+	plan.steps = steps
+	return plan, nil
+}
+
+// order plans query's steps given the registers already bound, which for the
+// body of a not are the ones its parent binds before it. names are the
+// registers of the variables in scope, which a not's body shares by name.
+func (plan *Plan) order(query *QueryNode, names map[string]int, bound map[int]bool, stats Statistics, strategy JoinStrategy) ([]*PlanStep, error) {
+	for id := range query.unions {
+		return nil, errors.New("query '" + query.id + "': union '" + id + "' can't be planned yet")
+	}
+	for id := range query.chooses {
+		return nil, errors.New("query '" + query.id + "': choose '" + id + "' can't be planned yet")
+	}
+
+	var scanIds []string
+	for id := range query.scans {
+		scanIds = append(scanIds, id)
+	}
+	sort.Strings(scanIds)
+	var patterns []*pattern
+	for _, id := range scanIds {
+		patterns = append(patterns, plan.patterns(query.scans[id])...)
+	}
+
+	var expressionIds []string
+	for id, expression := range query.expressions {
+		if _, ok := expression.Signature(); !ok {
+			return nil, errors.New("query '" + query.id + "': unknown operator '" + expression.operator + "' in '" + id + "'")
+		}
+		expressionIds = append(expressionIds, id)
+	}
+	sort.Strings(expressionIds)
+	var expressions []*ExpressionNode
+	for _, id := range expressionIds {
+		expressions = append(expressions, query.expressions[id])
+	}
+
+	var nots []*NotNode
+	var needs = make(map[*NotNode][]int)
+	var notIds []string
+	for id := range query.nots {
+		notIds = append(notIds, id)
+	}
+	sort.Strings(notIds)
+	for _, id := range notIds {
+		var not = query.nots[id]
+		nots = append(nots, not)
+		needs[not] = plan.scope(not.body, names)
+	}
+
+	var steps []*PlanStep
+	if len(patterns) > 1 && (strategy == JoinGeneric || (strategy == JoinAuto && needsGenericJoin(patterns))) {
+		var step = plan.genericJoin(patterns, stats)
+		steps = append(steps, step)
+		for _, t := range step.order {
+			bound[t.register] = true
+		}
+		patterns = nil
+	}
+	for len(patterns) > 0 || len(expressions) > 0 || len(nots) > 0 {
+		// aggregates wait until everything else that can run has, since
+		// they need to see every row the rest of the query produces
+		var next = -1
+		for ix, expression := range expressions {
+			if !expression.IsAggregate() && plan.ready(expression, bound) {
+				next = ix
+				break
+			}
+		}
+		if next < 0 {
+			if ix := readyNot(nots, needs, bound); ix >= 0 {
+				var not = nots[ix]
+				nots = append(nots[:ix], nots[ix+1:]...)
+				var step, err = plan.notStep(not, names, bound, stats, strategy)
+				if err != nil {
+					return nil, err
+				}
+				steps = append(steps, step)
+				continue
+			}
+		}
+		for ix, expression := range expressions {
+			if next < 0 && len(patterns) == 0 && len(nots) == 0 && plan.ready(expression, bound) {
+				next = ix
+			}
+		}
+		if next >= 0 {
+			var expression = expressions[next]
+			expressions = append(expressions[:next], expressions[next+1:]...)
+			steps = append(steps, &PlanStep{expression: expression})
+			for _, binding := range expression.bindings {
+				if !binding.IsConstant() {
+					bound[plan.registers[binding.variable]] = true
+				}
+			}
+			continue
+		}
+
+		if len(patterns) == 0 {
+			if len(nots) > 0 {
+				return nil, errors.New("query '" + query.id + "': not '" + nots[0].id + "' uses variables nothing binds")
+			}
+			var expression = expressions[0]
+			return nil, errors.New("query '" + query.id + "': expression '" + expression.id + "' (" + expression.operator + ") has inputs nothing binds")
+		}
+		var best = 0
+		var bestEstimate = -1
+		for ix, p := range patterns {
+			var estimate = p.estimate(stats, bound)
+			if bestEstimate < 0 || estimate < bestEstimate {
+				best, bestEstimate = ix, estimate
+			}
+		}
+		var p = patterns[best]
+		patterns = append(patterns[:best], patterns[best+1:]...)
+		steps = append(steps, &PlanStep{pattern: p, estimate: bestEstimate})
+		for _, t := range p.terms {
+			if t.constant == nil {
+				bound[t.register] = true
+			}
+		}
+	}
+	return steps, nil
+}
+
+// scope gives the variables of a not's body registers: the register of the
+// variable in scope with the same name, or a new one for variables of the
+// body's own. It returns the registers the body shares, which the parent has
+// to bind before the not can run.
+func (plan *Plan) scope(body *QueryNode, names map[string]int) []int {
+	var shared []int
+	var seen = make(map[int]bool)
+	var register = func(variable *VariableNode) {
+		if variable == nil {
+			return
+		}
+		if _, ok := plan.registers[variable]; !ok {
+			if r, ok := names[variable.name]; ok {
+				plan.registers[variable] = r
+			} else {
+				plan.registers[variable] = plan.anonymous()
+			}
+		}
+		if r, ok := names[variable.name]; ok && r == plan.registers[variable] && !seen[r] {
+			seen[r] = true
+			shared = append(shared, r)
+		}
+	}
+	for _, variable := range sortedVariables(body) {
+		register(variable)
+	}
+	for _, scan := range body.scans {
+		for _, binding := range scan.bindings {
+			register(binding.variable)
+		}
+	}
+	for _, expression := range body.expressions {
+		for _, binding := range expression.bindings {
+			register(binding.variable)
+		}
+	}
+	sort.Ints(shared)
+	return shared
+}
+
+// readyNot is the first of nots whose shared registers are all bound, or -1
+func readyNot(nots []*NotNode, needs map[*NotNode][]int, bound map[int]bool) int {
+	for ix, not := range nots {
+		var ready = true
+		for _, r := range needs[not] {
+			ready = ready && bound[r]
+		}
+		if ready {
+			return ix
+		}
+	}
+	return -1
+}
+
+// notStep plans a not's body against what's bound so far. Nothing the body
+// binds is visible after it.
+func (plan *Plan) notStep(not *NotNode, names map[string]int, bound map[int]bool, stats Statistics, strategy JoinStrategy) (*PlanStep, error) {
+	for _, expression := range not.body.expressions {
+		if expression.IsAggregate() {
+			return nil, errors.New("query '" + not.body.id + "': aggregate '" + expression.id + "' inside a not can't be planned")
+		}
+	}
+	var inner = make(map[string]int)
+	for name, r := range names {
+		inner[name] = r
+	}
+	for _, variable := range not.body.variables {
+		inner[variable.name] = plan.registers[variable]
+	}
+	var innerBound = make(map[int]bool)
+	for r := range bound {
+		innerBound[r] = true
+	}
+	var body, err = plan.order(not.body, inner, innerBound, stats, strategy)
+	if err != nil {
+		return nil, err
+	}
+	return &PlanStep{not: not, body: body}, nil
+}
+
+// needsGenericJoin looks for a cycle of three or more variables (like a
+// triangle), the one shape where the generic join wins: on skewed data a
+// pairwise join of a cycle builds every path through the busy nodes first.
+// Variables shared by many patterns, like the entity of a record, and pairs
+// of patterns over the same two variables join fine nested, and faster.
+func needsGenericJoin(patterns []*pattern) bool {
+	var parent = make(map[int]int)
+	var find func(r int) int
+	find = func(r int) int {
+		if p, ok := parent[r]; ok && p != r {
+			parent[r] = find(p)
+			return parent[r]
+		}
+		parent[r] = r
+		return r
+	}
+	var linked = make(map[[2]int]bool)
+	for _, p := range patterns {
+		var previous = -1
+		for _, t := range p.terms {
+			if t.constant != nil || t.register == previous {
+				continue
+			}
+			if previous >= 0 {
+				var edge = [2]int{previous, t.register}
+				if edge[0] > edge[1] {
+					edge[0], edge[1] = edge[1], edge[0]
+				}
+				if !linked[edge] {
+					linked[edge] = true
+					var a, b = find(previous), find(t.register)
+					if a == b {
+						return true
+					}
+					parent[a] = b
+				}
+			}
+			previous = t.register
+		}
+	}
+	return false
+}
+
+// genericJoin orders the variables for a generic join: the most shared
+// variable first, then always a variable connected to ones already chosen so
+// each step is constrained by the last.
+func (plan *Plan) genericJoin(patterns []*pattern, stats Statistics) *PlanStep {
+	var uses = make(map[int]int)
+	var terms = make(map[int]planTerm)
+	var registers []int
+	for _, p := range patterns {
+		for _, t := range p.terms {
+			if t.constant != nil {
+				continue
+			}
+			if _, ok := terms[t.register]; !ok {
+				terms[t.register] = t
+				registers = append(registers, t.register)
+			}
+			uses[t.register]++
+		}
+	}
+	sort.Ints(registers)
+
+	var step = &PlanStep{join: patterns}
+	var chosen = make(map[int]bool)
+	var connected = func(r int) bool {
+		for _, p := range patterns {
+			var mentions, touches = false, false
+			for _, t := range p.terms {
+				if t.constant == nil {
+					mentions = mentions || t.register == r
+					touches = touches || chosen[t.register]
+				}
+			}
+			if mentions && touches {
+				return true
+			}
+		}
+		return false
+	}
+	for len(step.order) < len(registers) {
+		var best = -1
+		var bestConnected = false
+		for _, r := range registers {
+			if chosen[r] {
+				continue
+			}
+			var isConnected = connected(r)
+			if best < 0 || (isConnected && !bestConnected) || (isConnected == bestConnected && uses[r] > uses[best]) {
+				best, bestConnected = r, isConnected
+			}
+		}
+		chosen[best] = true
+		step.order = append(step.order, terms[best])
+	}
+	var estimate = 0
+	for _, p := range patterns {
+		if e := p.estimate(stats, map[int]bool{}); estimate == 0 || e < estimate {
+			estimate = e
+		}
+	}
+	step.estimate = estimate
+	return step
+}
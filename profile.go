@@ -0,0 +1,303 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// Profiling
+//------------------------------------------------------------------------------
+
+// A Profile is what running a plan cost, step by step. A view's profile
+// covers its whole life: the first run and every change it follows after.
+type Profile struct {
+	Steps   []*StepProfile
+	byStep  map[*PlanStep]*StepProfile
+	current *StepProfile // the step running now, which lookups are charged to
+}
+
+// A StepProfile is one step's share of a profile
+type StepProfile struct {
+	Step       *PlanStep
+	In         int            // rows that reached the step
+	Out        int            // rows it passed on
+	Lookups    map[string]int // lookups in the edb, by the index that served them
+	total      time.Duration
+	downstream time.Duration
+}
+
+// Time is how long the step took, not counting the steps after it
+func (step *StepProfile) Time() time.Duration {
+	return step.total - step.downstream
+}
+
+func newProfile(plan *Plan) *Profile {
+	var profile = &Profile{byStep: make(map[*PlanStep]*StepProfile)}
+	for _, step := range plan.steps {
+		var stepProfile = &StepProfile{Step: step, Lookups: make(map[string]int)}
+		profile.Steps = append(profile.Steps, stepProfile)
+		profile.byStep[step] = stepProfile
+	}
+	return profile
+}
+
+func (profile *Profile) step(step *PlanStep) *StepProfile {
+	return profile.byStep[step]
+}
+
+// Time is how long the plan took altogether
+func (profile *Profile) Time() time.Duration {
+	var total time.Duration
+	for _, step := range profile.Steps {
+		total += step.Time()
+	}
+	return total
+}
+
+func isRow(op value.Operator) bool {
+	return op == value.OpInsert || op == value.OpRemove
+}
+
+// input wraps a step's compiled function so the rows going in are counted
+// and the time it runs, and the lookups it makes meanwhile, are charged to it
+func (profile *Profile) input(step *StepProfile, run func(value.Operator, []value.Value)) func(value.Operator, []value.Value) {
+	return func(op value.Operator, row []value.Value) {
+		if isRow(op) {
+			step.In++
+		}
+		var previous = profile.current
+		profile.current = step
+		var start = time.Now()
+		run(op, row)
+		step.total += time.Since(start)
+		profile.current = previous
+	}
+}
+
+// output counts the rows a step passes on, and takes the time the steps
+// after it spend off its own
+func (step *StepProfile) output(next func(value.Operator, []value.Value)) func(value.Operator, []value.Value) {
+	return func(op value.Operator, row []value.Value) {
+		if isRow(op) {
+			step.Out++
+		}
+		var start = time.Now()
+		next(op, row)
+		step.downstream += time.Since(start)
+	}
+}
+
+// profiledRelation is a context that charges each lookup to the step making
+// it, under the index scanEdb uses for it
+type profiledRelation struct {
+	context
+	profile *Profile
+}
+
+func (r *profiledRelation) lookup(e, a, v value.Value) {
+	if step := r.profile.current; step != nil {
+		step.Lookups[indexFor([3]bool{e != nil, a != nil, v != nil})]++
+	}
+}
+
+func (r *profiledRelation) Scan(e, a, v value.Value, f func(e, a, v value.Value)) {
+	r.lookup(e, a, v)
+	r.context.Scan(e, a, v, f)
+}
+
+func (r *profiledRelation) Contains(e, a, v value.Value) bool {
+	r.lookup(e, a, v)
+	return r.context.Contains(e, a, v)
+}
+
+// Count reads an index's sizes, which is only a lookup when something is
+// known
+func (r *profiledRelation) Count(e, a, v value.Value) int {
+	if r.CanSeek(e, a, v) {
+		r.lookup(e, a, v)
+	}
+	return r.context.Count(e, a, v)
+}
+
+//------------------------------------------------------------------------------
+// Explaining
+//------------------------------------------------------------------------------
+
+// An Explanation is how a block runs: its stratum, its plan and the index
+// each scan starts from, and when it ran profiled, what running it cost
+type Explanation struct {
+	Query   *QueryNode
+	Stratum int
+	Plan    *Plan
+	Indexes []string // for each step; "" for expressions and nots
+	Profile *Profile
+	Results int
+}
+
+// Explain plans queries against stats, which may be nil, without running them
+func Explain(queries []*QueryNode, stats Statistics) ([]*Explanation, error) {
+	var strata, err = Stratify(queries)
+	if err != nil {
+		return nil, err
+	}
+	var stratum = make(map[*QueryNode]int)
+	for ix, members := range strata {
+		for _, query := range members {
+			stratum[query] = ix
+		}
+	}
+	var explanations []*Explanation
+	for _, query := range queries {
+		var plan, err = PlanQuery(query, stats, JoinAuto)
+		if err != nil {
+			return nil, err
+		}
+		explanations = append(explanations, &Explanation{Query: query, Stratum: stratum[query], Plan: plan, Indexes: plan.indexes()})
+	}
+	return explanations, nil
+}
+
+// Explain is how each of the runtime's blocks runs, profiled if it came from
+// NewProfiledRuntime
+func (runtime *Runtime) Explain() []*Explanation {
+	var explanations []*Explanation
+	for _, block := range runtime.blocks {
+		explanations = append(explanations, &Explanation{
+			Query:   block.query,
+			Stratum: block.stratum,
+			Plan:    block.plan,
+			Indexes: block.plan.indexes(),
+			Profile: block.profile,
+			Results: len(block.view.Rows()),
+		})
+	}
+	return explanations
+}
+
+// indexes is the index each scan step looks facts up with, given what the
+// steps before it bind. A generic join binds a variable at a time, so which
+// index it uses varies as it goes.
+func (plan *Plan) indexes() []string {
+	var bound = make(map[int]bool)
+	var known = func(t planTerm) bool {
+		return t.constant != nil || bound[t.register]
+	}
+	var result []string
+	for _, step := range plan.steps {
+		switch {
+		case step.not != nil:
+			// a not binds nothing the steps after it see
+			result = append(result, "")
+		case step.join != nil:
+			result = append(result, "varies")
+			for _, t := range step.order {
+				bound[t.register] = true
+			}
+		case step.pattern != nil:
+			var terms = step.pattern.terms
+			result = append(result, indexFor([3]bool{known(terms[0]), known(terms[1]), known(terms[2])}))
+			for _, t := range terms {
+				if t.constant == nil {
+					bound[t.register] = true
+				}
+			}
+		default:
+			result = append(result, "")
+			for _, binding := range step.expression.bindings {
+				if !binding.IsConstant() {
+					bound[plan.registers[binding.variable]] = true
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (explanation *Explanation) title() string {
+	var name = explanation.Query.name
+	if name == "" {
+		name = explanation.Query.id
+	}
+	return strconv.Quote(name) + " (" + explanation.Query.id + "), stratum " + strconv.Itoa(explanation.Stratum)
+}
+
+func lookupsText(lookups map[string]int) string {
+	var parts []string
+	for _, index := range orderedKeys(MapToInterfaces(lookups)) {
+		parts = append(parts, index+" "+strconv.Itoa(lookups[index]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ExplanationsText lays explanations out as a table of steps for each block
+func ExplanationsText(explanations []*Explanation) string {
+	var out strings.Builder
+	for ix, explanation := range explanations {
+		if ix > 0 {
+			out.WriteString("\n")
+		}
+		var title = explanation.title()
+		var profile = explanation.Profile
+		if profile != nil {
+			title += ", " + strconv.Itoa(explanation.Results) + " results in " + profile.Time().String()
+		}
+		out.WriteString(title + "\n")
+		if len(explanation.Plan.steps) == 0 {
+			continue
+		}
+		// steps can be long, so they go last where they don't push the
+		// other columns out
+		var table = tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+		if profile != nil {
+			table.Write([]byte("  #\tindex\tin\tout\ttime\tlookups\tstep\n"))
+		} else {
+			table.Write([]byte("  #\tindex\tstep\n"))
+		}
+		for ix, step := range explanation.Plan.steps {
+			var line = "  " + strconv.Itoa(ix+1) + "\t" + explanation.Indexes[ix] + "\t"
+			if profile != nil {
+				var stepProfile = profile.Steps[ix]
+				line += strconv.Itoa(stepProfile.In) + "\t" + strconv.Itoa(stepProfile.Out) + "\t" + stepProfile.Time().String() + "\t" + lookupsText(stepProfile.Lookups) + "\t"
+			}
+			table.Write([]byte(line + step.String() + "\n"))
+		}
+		table.Flush()
+	}
+	return out.String()
+}
+
+// ExplanationsDocument is explanations for export. Times are in nanoseconds.
+func ExplanationsDocument(explanations []*Explanation) []interface{} {
+	var list = []interface{}{}
+	for _, explanation := range explanations {
+		var doc = newObject().set("id", explanation.Query.id).set("name", explanation.Query.name)
+		doc.set("stratum", explanation.Stratum)
+		var steps = []interface{}{}
+		for ix, step := range explanation.Plan.steps {
+			var item = newObject().set("step", step.String())
+			if explanation.Indexes[ix] != "" {
+				item.set("index", explanation.Indexes[ix])
+			}
+			if profile := explanation.Profile; profile != nil {
+				var stepProfile = profile.Steps[ix]
+				item.set("in", stepProfile.In).set("out", stepProfile.Out).set("time", int(stepProfile.Time()))
+				var lookups = newObject()
+				for _, index := range orderedKeys(MapToInterfaces(stepProfile.Lookups)) {
+					lookups.set(index, stepProfile.Lookups[index])
+				}
+				item.set("lookups", lookups)
+			}
+			steps = append(steps, item)
+		}
+		doc.set("steps", steps)
+		if explanation.Profile != nil {
+			doc.set("results", explanation.Results).set("time", int(explanation.Profile.Time()))
+		}
+		list = append(list, doc)
+	}
+	return list
+}
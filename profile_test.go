@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"strings"
+	"testing"
+)
+
+func TestProfiledRuntime(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var edge = value.NewText("edge")
+	for i := int64(0); i < 5; i++ {
+		insert(c, value.NewNumberFromInt(i), edge, value.NewNumberFromInt(i+1))
+	}
+	var runtime, err = NewProfiledRuntime(c, pathQueries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var explanations = runtime.Explain()
+	var extend = explanations[1]
+	if len(extend.Indexes) != 2 || extend.Indexes[0] != "ave" || extend.Indexes[1] != "ave" {
+		t.Fatalf("expected both scans to use ave, the attribute being known, got %v\n%v", extend.Indexes, extend.Plan)
+	}
+	var first, second = extend.Profile.Steps[0], extend.Profile.Steps[1]
+	if first.Out == 0 || first.Out != second.In || second.Out == 0 {
+		t.Fatalf("expected rows to flow from one step to the next, got %v→%v and %v→%v", first.In, first.Out, second.In, second.Out)
+	}
+	if first.Lookups["ave"] == 0 || second.Lookups["ave"] != second.In {
+		t.Fatalf("expected each step's lookups under the index it uses, got %v and %v", first.Lookups, second.Lookups)
+	}
+	if extend.Results != 10 {
+		t.Fatalf("expected the 10 paths longer than an edge, got %v", extend.Results)
+	}
+
+	static, err := Explain(pathQueries(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without statistics, edge goes first and binds the entity path is looked up by
+	if static[1].Profile != nil || strings.Join(static[1].Indexes, " ") != "ave eav" {
+		t.Fatalf("expected an unprofiled ave scan followed by an eav one, got %v", static[1].Indexes)
+	}
+	if text := ExplanationsText(explanations); !strings.Contains(text, `"paths extend" (paths extend), stratum 0, 10 results`) {
+		t.Fatalf("unexpected explanation:\n%v", text)
+	}
+}
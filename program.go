@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/witheve/evingo/parser"
+	"github.com/witheve/evingo/value"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LoadProgramFile reads either an .e source file or a fact file (.json or
+// .f) and builds every root query in it. Parse errors come back as
+// diagnostics so they can be reported alongside Validate's; anything that
+// stops the program from loading at all comes back as the error.
+func LoadProgramFile(path string) ([]*QueryNode, []Diagnostic, error) {
+	if filepath.Ext(path) == ".e" {
+		program, err := parser.ParseFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return queriesFromProgram(program, path)
+	}
+	facts, err := ReadFactFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	queries, err := queriesFromFacts(facts)
+	return queries, nil, err
+}
+
+// LoadProgramString is LoadProgramFile for source that isn't in a file. name
+// stands in for the path in diagnostics.
+func LoadProgramString(name string, code string) ([]*QueryNode, []Diagnostic, error) {
+	return queriesFromProgram(parser.ParseString(code), name)
+}
+
+func queriesFromProgram(program *parser.Program, path string) ([]*QueryNode, []Diagnostic, error) {
+	var diagnostics []Diagnostic
+	for _, parseError := range program.Errors {
+		diagnostics = append(diagnostics, Diagnostic{SeverityError, parseError.Line, path, parseError.Message})
+	}
+	facts, err := FactsFromProgram(program)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	queries, err := queriesFromFacts(facts)
+	return queries, diagnostics, err
+}
+
+func queriesFromFacts(facts *[]Fact) ([]*QueryNode, error) {
+	tagMap, err := IndexEntitiesByTag(FactsToEntities(facts))
+	if err != nil {
+		return nil, err
+	}
+	return TagMapToQueries(tagMap)
+}
+
+// ReadFactFile reads a JSON (.json) or plain text (.f) fact file
+func ReadFactFile(path string) (*[]Fact, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".f" {
+		return ReadFactsFromText(raw)
+	}
+	return ReadFactsFromJson(raw)
+}
+
+// LoadEdbFile reads a fact file as data rather than as a program
+func LoadEdbFile(path string) (*edb, error) {
+	var db = NewEdb()
+	if err := LoadFacts(context{e: *db}, path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// LoadFacts adds a fact file's facts to c's bag in one transaction
+func LoadFacts(c context, path string) error {
+	facts, err := ReadFactFile(path)
+	if err != nil {
+		return err
+	}
+	var tx = c.Begin()
+	for _, fact := range *facts {
+		tx.Insert(value.NewText(fact.entity), value.NewText(fact.attribute), fact.value)
+	}
+	_, err = tx.Commit()
+	return err
+}
+
+// CheckQueries validates each query and checks that they stratify together
+func CheckQueries(queries []*QueryNode) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, query := range queries {
+		diagnostics = append(diagnostics, query.Validate()...)
+	}
+	if _, err := Stratify(queries); err != nil {
+		diagnostics = append(diagnostics, err.(*StratificationError).Diagnostic())
+	}
+	return diagnostics
+}
+
+// openBags makes a bag for each of specs, a name optionally followed by = and
+// a fact file to fill the bag from. The context runs in the first bag and
+// reads them all; with no specs it's one empty bag called "session".
+func openBags(specs []string) (context, error) {
+	if len(specs) == 0 {
+		specs = []string{"session"}
+	}
+	var bags = NewBags()
+	var names []string
+	for _, spec := range specs {
+		var name, path = spec, ""
+		if ix := strings.Index(spec, "="); ix >= 0 {
+			name, path = spec[:ix], spec[ix+1:]
+		}
+		if name == "" {
+			return context{}, errors.New("'" + spec + "' doesn't name a bag")
+		}
+		if _, err := bags.Create(name, value.Uuid{}); err != nil {
+			return context{}, err
+		}
+		if path != "" {
+			c, err := bags.Context(value.Uuid{}, name)
+			if err != nil {
+				return context{}, err
+			}
+			if err := LoadFacts(c, path); err != nil {
+				return context{}, err
+			}
+		}
+		names = append(names, name)
+	}
+	return bags.Context(value.Uuid{}, names...)
+}
+
+// RunProgram runs a program to a fixpoint in the bags openBags makes of bags,
+// and returns the facts it leaves in the first of them, sorted. Problems the
+// checker finds come back as diagnostics and stop the program before it runs.
+func RunProgram(path string, bags []string) ([][3]value.Value, []Diagnostic, error) {
+	queries, diagnostics, err := LoadProgramFile(path)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	diagnostics = append(diagnostics, CheckQueries(queries)...)
+	if HasErrors(diagnostics) {
+		return nil, diagnostics, nil
+	}
+	c, err := openBags(bags)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	runtime, err := NewRuntime(c, queries)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		return nil, diagnostics, err
+	}
+	var facts [][3]value.Value
+	scan(context{e: c.e}, nil, nil, nil, func(e, a, v value.Value) {
+		facts = append(facts, [3]value.Value{e, a, v})
+	})
+	sort.Slice(facts, func(i, j int) bool {
+		return rowString(facts[i][:]) < rowString(facts[j][:])
+	})
+	return facts, diagnostics, nil
+}
+
+// ProfileProgram runs a program the way RunProgram does, with data's facts
+// in the bag first if data isn't "", and explains how each block ran
+func ProfileProgram(path string, data string) ([]*Explanation, []Diagnostic, error) {
+	queries, diagnostics, err := LoadProgramFile(path)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	diagnostics = append(diagnostics, CheckQueries(queries)...)
+	if HasErrors(diagnostics) {
+		return nil, diagnostics, nil
+	}
+	var bags = NewBags()
+	if _, err := bags.Create("session", value.Uuid{}); err != nil {
+		return nil, diagnostics, err
+	}
+	c, err := bags.Context(value.Uuid{}, "session")
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	if data != "" {
+		if err := LoadFacts(c, data); err != nil {
+			return nil, diagnostics, err
+		}
+	}
+	runtime, err := NewProfiledRuntime(c, queries)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		return nil, diagnostics, err
+	}
+	return runtime.Explain(), diagnostics, nil
+}
+
+// FactsToJson writes facts the way ReadFactsFromJson reads them
+func FactsToJson(facts [][3]value.Value) string {
+	var field = func(v value.Value) string {
+		switch v := v.(type) {
+		case *value.Number:
+			return v.String()
+		case *value.Boolean:
+			return v.String()
+		}
+		var raw, _ = json.Marshal(textOf(v))
+		return string(raw)
+	}
+	var lines []string
+	for _, fact := range facts {
+		lines = append(lines, "  ["+field(fact[0])+", "+field(fact[1])+", "+field(fact[2])+"]")
+	}
+	if len(lines) == 0 {
+		return "[]"
+	}
+	return "[\n" + strings.Join(lines, ",\n") + "\n]"
+}
+
+// textOf is a value as a program would write it, without the quotes Text's
+// String adds
+func textOf(v value.Value) string {
+	if text, ok := v.(*value.Text); ok {
+		return text.Value()
+	}
+	return v.String()
+}
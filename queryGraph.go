@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/witheve/evingo/parser"
 	"github.com/witheve/evingo/value"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -110,6 +113,10 @@ func StringFromIdList(coll interface{}) string {
 	var result = "["
 	var slice = SliceToInterfaces(coll)
 	for _, item := range slice {
+		if v := reflect.ValueOf(item); v.Kind() == reflect.Ptr && v.IsNil() {
+			result += "nil, "
+			continue
+		}
 		var stringer, ok = item.(fmt.Stringer)
 		panicOnNotOk(ok, "Unable to coerce item to Stringer")
 		var id = GetId(stringer)
@@ -169,16 +176,28 @@ func (tagMap TagMap) String() string {
 	return result[:len(result)-2] + "\n}"
 }
 
+// A binding ties a field of its source to either a variable or a constant.
+// Exactly one of variable or constant is set.
 type BindingNode struct {
 	id       string
 	variable *VariableNode
+	constant value.Value
 	field    string
 	source   SourceNode
+	line     int // 0 if the binding didn't come from source text
+}
+
+func (binding *BindingNode) IsConstant() bool {
+	return binding.variable == nil
 }
 
 func (binding *BindingNode) String() string {
 	var result = "Binding<" + binding.id + ">{"
-	result += "variable: " + binding.variable.id + ", "
+	if binding.IsConstant() {
+		result += "constant: " + binding.constant.String() + ", "
+	} else {
+		result += "variable: " + binding.variable.id + ", "
+	}
 	result += "field: " + binding.field + ", "
 	result += "source: " + GetId(binding.source)
 	return result + "}"
@@ -188,6 +207,7 @@ type VariableNode struct {
 	id       string
 	name     string
 	bindings []*BindingNode
+	line     int
 }
 
 func (variable *VariableNode) String() string {
@@ -205,12 +225,26 @@ type SourceNode interface {
 type ScanNode struct {
 	id       string
 	bindings []*BindingNode
+	line     int
 }
 
 func (source *ScanNode) Bindings() *[]*BindingNode {
 	return &source.bindings
 }
 
+// Constants returns the fields of the scan that are pre-bound to constants,
+// keyed by field name. The executor treats these as filters on the scan
+// rather than as outputs.
+func (source *ScanNode) Constants() map[string]value.Value {
+	var constants = make(map[string]value.Value)
+	for _, binding := range source.bindings {
+		if binding.IsConstant() {
+			constants[binding.field] = binding.constant
+		}
+	}
+	return constants
+}
+
 func (source *ScanNode) String() string {
 	return "Scan<" + source.id + ">{bindings: (" + strconv.Itoa(len(source.bindings)) + ") " + StringFromIdList(source.bindings) + "}"
 }
@@ -221,28 +255,61 @@ type ExpressionNode struct {
 	bindings   []*BindingNode
 	projection []*VariableNode
 	grouping   []*VariableNode // ix's must be monotonically ordered integers
+	line       int
 }
 
 func (source *ExpressionNode) Bindings() *[]*BindingNode {
 	return &source.bindings
 }
 
+// IsAggregate reports whether the expression folds rows together. min and
+// max are both aggregates and functions of two arguments, so for those it
+// depends on whether the expression binds a "value" or has a projection or
+// grouping.
+func (source *ExpressionNode) IsAggregate() bool {
+	if !value.IsAggregate(source.operator) {
+		return false
+	}
+	if _, isFunction := value.LookupSignature(source.operator); !isFunction {
+		return true
+	}
+	if len(source.projection) > 0 || len(source.grouping) > 0 {
+		return true
+	}
+	for _, binding := range source.bindings {
+		if binding.field == "value" {
+			return true
+		}
+	}
+	return false
+}
+
+// Signature looks up the aggregate or function signature the expression uses
+func (source *ExpressionNode) Signature() (*value.Signature, bool) {
+	if source.IsAggregate() {
+		return value.LookupAggregate(source.operator)
+	}
+	return value.LookupSignature(source.operator)
+}
+
 func (source *ExpressionNode) String() string {
 	var result = "Expression<" + source.id + ">{"
 	result += "\n  operator: " + source.operator + ","
 	result += "\n  bindings: (" + strconv.Itoa(len(source.bindings)) + ") " + StringFromIdList(source.bindings) + ","
 	result += "\n  projection: (" + strconv.Itoa(len(source.projection)) + ") " + StringFromIdList(source.projection) + ","
-	result += "\n  grouping: (" + strconv.Itoa(len(source.grouping)) + ") " + StringFromIdList(source.projection)
+	result += "\n  grouping: (" + strconv.Itoa(len(source.grouping)) + ") " + StringFromIdList(source.grouping)
 	return result + "\n}"
 }
 
 type MutateNode struct {
 	id       string
 	operator string // add, remove, update
+	forever  bool   // what it adds outlasts the block that added it
 	bindings []*BindingNode
+	line     int
 }
 
-func (source MutateNode) Bindings() *[]*BindingNode {
+func (source *MutateNode) Bindings() *[]*BindingNode {
 	return &source.bindings
 }
 
@@ -287,6 +354,7 @@ type QueryNode struct {
 	nots        map[string]*NotNode
 	unions      map[string]*UnionNode
 	chooses     map[string]*ChooseNode
+	line        int
 }
 
 func (query QueryNode) String() string {
@@ -302,6 +370,15 @@ func (query QueryNode) String() string {
 	return result + "\n}"
 }
 
+// label is how messages name a query: its name, and its line if it has one
+func (query *QueryNode) label() string {
+	var result = "'" + query.name + "'"
+	if query.line > 0 {
+		result += " (line " + strconv.Itoa(query.line) + ")"
+	}
+	return result
+}
+
 func NewQuery(id string) *QueryNode {
 	return &QueryNode{
 		id:          id,
@@ -309,6 +386,7 @@ func NewQuery(id string) *QueryNode {
 		variables:   make(map[string]*VariableNode),
 		expressions: make(map[string]*ExpressionNode),
 		scans:       make(map[string]*ScanNode),
+		mutates:     make(map[string]*MutateNode),
 		nots:        make(map[string]*NotNode),
 		unions:      make(map[string]*UnionNode),
 		chooses:     make(map[string]*ChooseNode),
@@ -319,34 +397,82 @@ func NewQuery(id string) *QueryNode {
 // Fact Fns
 //------------------------------------------------------------------------------
 
-func ReadFactsFromJson(raw []byte) *[]Fact {
-	var parsed [][]interface{}
-	err := json.Unmarshal(raw, &parsed)
-	if err != nil {
-		panic(err)
+func ReadFactsFromJson(raw []byte) (*[]Fact, error) {
+	var parsed []interface{}
+	var decoder = json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
 	}
 
+	var errs LoadErrors
 	var facts []Fact
-	for k, v := range parsed {
-		var fact = &Fact{entity: v[0].(string), attribute: v[1].(string)}
+	for k, raw := range parsed {
+		var v, ok = raw.([]interface{})
+		if !ok || len(v) != 3 {
+			errs.addFact(k, "", "expected an [entity, attribute, value] triple, got "+fmt.Sprint(raw))
+			continue
+		}
+		var entity, entityOk = v[0].(string)
+		var attribute, attributeOk = v[1].(string)
+		if !entityOk || !attributeOk {
+			errs.addFact(k, fmt.Sprint(v[0]), "entity and attribute must be strings")
+			continue
+		}
+		var fact = &Fact{entity: entity, attribute: attribute}
 
 		switch val := v[2].(type) {
 		case string:
 			fact.value = value.NewText(val)
-		case int64:
-			fact.value = value.NewNumberFromInt(val)
-		case float64:
-			fact.value = value.NewNumberFromFloat(val)
+		case json.Number:
+			if i, err := val.Int64(); err == nil {
+				fact.value = value.NewNumberFromInt(i)
+			} else if f, err := val.Float64(); err == nil {
+				fact.value = value.NewNumberFromFloat(f)
+			} else {
+				errs.addFact(k, entity, "invalid number "+val.String())
+				continue
+			}
 		case bool:
 			fact.value = value.NewBoolean(val)
 		default:
-			fmt.Println("Unknown node type:", k)
-			panic("Unknown node type!")
+			errs.addFact(k, entity, fmt.Sprintf("unsupported value type for attribute '%s': %v", attribute, val))
+			continue
 		}
 		facts = append(facts, *fact)
 	}
 
-	return &facts
+	return &facts, errs.err()
+}
+
+// ReadFactsFromText reads the plain fact format of .f files: one
+// "entity attribute value" fact per line, with the value running to the end
+// of the line. Values that parse as numbers are numbers, a quoted value is
+// text without its quotes, and blank lines are skipped.
+func ReadFactsFromText(raw []byte) (*[]Fact, error) {
+	var errs LoadErrors
+	var facts []Fact
+	for k, line := range strings.Split(string(raw), "\n") {
+		var fields = strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			errs.addFact(k, fields[0], "expected 'entity attribute value', got '"+strings.TrimSpace(line)+"'")
+			continue
+		}
+		var fact = Fact{entity: fields[0], attribute: fields[1]}
+		var rest = strings.Join(fields[2:], " ")
+		if len(rest) >= 2 && strings.HasPrefix(rest, "\"") && strings.HasSuffix(rest, "\"") {
+			fact.value = value.NewText(rest[1 : len(rest)-1])
+		} else if number, err := value.ParseNumber(rest); err == nil {
+			fact.value = number
+		} else {
+			fact.value = value.NewText(rest)
+		}
+		facts = append(facts, fact)
+	}
+	return &facts, errs.err()
 }
 
 // !!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!
@@ -390,13 +516,19 @@ func IndexEntitiesById(entities []*Entity) *map[string]*Entity {
 	return &entityMap
 }
 
-func IndexEntitiesByTag(entities []*Entity) *TagMap {
+func IndexEntitiesByTag(entities []*Entity) (*TagMap, error) {
+	var errs LoadErrors
 	var tagMap = make(TagMap)
 	var untagged = make([]*Entity, 0)
 	for _, entity := range entities {
 		var tagValue, ok = entity.attributes["tag"]
 		if ok {
-			var tag = tagValue.(*value.Text).Value()
+			var tagText, isText = tagValue.(*value.Text)
+			if !isText {
+				errs.add(entity.entity, "tag must be a string, got "+tagValue.String())
+				continue
+			}
+			var tag = tagText.Value()
 			var tagged, ok = tagMap[tag]
 			if !ok {
 				tagged = make([]*Entity, 0)
@@ -409,7 +541,7 @@ func IndexEntitiesByTag(entities []*Entity) *TagMap {
 		}
 	}
 	tagMap["$$untagged"] = untagged
-	return &tagMap
+	return &tagMap, errs.err()
 }
 
 type EntityFilter func(*Entity) bool
@@ -450,13 +582,63 @@ func SomeEntity(filter EntityFilter, entities []*Entity) *Entity {
 // QueryGraph Fns
 //------------------------------------------------------------------------------
 
-func QueryFromEntity(root *Entity, tagMap *TagMap) *QueryNode {
+// textAttribute fetches a required string attribute off of entity, recording
+// a load error if it's missing or has the wrong type.
+func textAttribute(entity *Entity, attribute string, errs *LoadErrors) (string, bool) {
+	var raw, ok = entity.attributes[attribute]
+	if !ok {
+		errs.add(entity.entity, "missing required attribute '"+attribute+"'")
+		return "", false
+	}
+	var text, isText = raw.(*value.Text)
+	if !isText {
+		errs.add(entity.entity, "attribute '"+attribute+"' must be a string, got "+raw.String())
+		return "", false
+	}
+	return text.Value(), true
+}
+
+// lineAttribute is the source line an entity was compiled from, or 0 for
+// entities that were written as facts directly.
+func lineAttribute(entity *Entity) int {
+	if line, ok := entity.attributes["line"].(*value.Number); ok {
+		return int(line.Value().IntPart())
+	}
+	return 0
+}
+
+// bindingSourceErrors reports bindings without a source, or whose source
+// isn't a scan, expression or mutate of any query. Each query only builds the
+// bindings of its own sources, so these would otherwise go missing without a
+// word, or be reported once by every query.
+func bindingSourceErrors(tagMap *TagMap) LoadErrors {
+	var errs LoadErrors
+	var sources = make(map[string]bool)
+	for _, tag := range []string{"scan", "expression", "mutate"} {
+		for _, entity := range (*tagMap)[tag] {
+			sources[entity.entity] = true
+		}
+	}
+	for _, binding := range (*tagMap)["binding"] {
+		if _, ok := binding.attributes["source"]; !ok {
+			errs.add(binding.entity, "binding has no source")
+			continue
+		}
+		var source, ok = textAttribute(binding, "source", &errs)
+		if ok && !sources[source] {
+			errs.add(binding.entity, "binding's source '"+source+"' is not a scan, expression or mutate")
+		}
+	}
+	return errs
+}
+
+func QueryFromEntity(root *Entity, tagMap *TagMap) (*QueryNode, error) {
+	var errs LoadErrors
 	var query = NewQuery(root.entity)
-	var nameValue = root.attributes["name"]
-	if nameValue != nil {
-		query.name = nameValue.(*value.Text).Value()
+	query.line = lineAttribute(root)
+	if _, ok := root.attributes["name"]; ok {
+		query.name, _ = textAttribute(root, "name", &errs)
 	}
-	var sourceEntities = make(map[string]*Entity)
 	var sources = make(map[string]SourceNode)
 
 	var queryValue = value.NewText(query.id)
@@ -468,39 +650,65 @@ func QueryFromEntity(root *Entity, tagMap *TagMap) *QueryNode {
 
 	// Prebuild everything that's going to cross-link (variables, scans, expressions, mutates)
 	for _, entity := range *variableEntities {
-		query.variables[entity.entity] = &VariableNode{id: entity.entity, name: entity.attributes["name"].(*value.Text).Value()}
+		var name, ok = textAttribute(entity, "name", &errs)
+		if !ok {
+			name = entity.entity
+		}
+		query.variables[entity.entity] = &VariableNode{id: entity.entity, name: name, line: lineAttribute(entity)}
 	}
 	for _, entity := range scanEntities {
-		query.scans[entity.entity] = &ScanNode{id: entity.entity}
-		sourceEntities[entity.entity] = entity
+		query.scans[entity.entity] = &ScanNode{id: entity.entity, line: lineAttribute(entity)}
 		sources[entity.entity] = query.scans[entity.entity]
 	}
 	for _, entity := range expressionEntities {
-		query.expressions[entity.entity] = &ExpressionNode{id: entity.entity, operator: entity.attributes["operator"].(*value.Text).Value()}
-		sourceEntities[entity.entity] = entity
+		var operator, _ = textAttribute(entity, "operator", &errs)
+		query.expressions[entity.entity] = &ExpressionNode{id: entity.entity, operator: operator, line: lineAttribute(entity)}
 		sources[entity.entity] = query.expressions[entity.entity]
 	}
 	for _, entity := range mutateEntities {
-		query.mutates[entity.entity] = &MutateNode{id: entity.entity, operator: entity.attributes["operator"].(*value.Text).Value()}
-		sourceEntities[entity.entity] = entity
+		var operator, _ = textAttribute(entity, "operator", &errs)
+		var forever, _ = entity.attributes["forever"].(*value.Boolean)
+		query.mutates[entity.entity] = &MutateNode{id: entity.entity, operator: operator, forever: forever != nil && forever.Value(), line: lineAttribute(entity)}
 		sources[entity.entity] = query.mutates[entity.entity]
 	}
 
-	// Build the binding nodes and link them into their variables and sources
-	for _, variableEntity := range *variableEntities {
-		var variable, ok = query.variables[variableEntity.entity]
-		panicOnNotOk(ok, "Query '"+query.name+"' does not contain variable '"+variableEntity.entity+"'")
-		for _, bindingEntity := range FilterEntities(EntityAttributeEquals("variable", value.NewText(variable.id)), (*tagMap)["binding"]) {
-			var binding = &BindingNode{id: bindingEntity.entity, field: bindingEntity.attributes["field"].(*value.Text).Value()}
+	// Build the binding nodes and link them into their sources, and into their
+	// variables if they aren't bound to a constant
+	for _, bindingEntity := range (*tagMap)["binding"] {
+		var sourceId, ok = bindingEntity.attributes["source"].(*value.Text)
+		if !ok {
+			// bindingSourceErrors reports it
+			continue
+		}
+		var source, isLocal = sources[sourceId.Value()]
+		if !isLocal {
+			// belongs to some other query, or to none, which
+			// bindingSourceErrors reports
+			continue
+		}
+		var field, fieldOk = textAttribute(bindingEntity, "field", &errs)
+		if !fieldOk {
+			continue
+		}
+		var binding = &BindingNode{id: bindingEntity.entity, field: field, line: lineAttribute(bindingEntity)}
+		binding.source = source
+		if constant, isConstant := bindingEntity.attributes["constant"]; isConstant {
+			binding.constant = constant
+		} else {
+			var variableId, ok = textAttribute(bindingEntity, "variable", &errs)
+			if !ok {
+				continue
+			}
+			var variable, isVariable = query.variables[variableId]
+			if !isVariable {
+				errs.add(bindingEntity.entity, "query '"+query.id+"' does not contain variable '"+variableId+"'")
+				continue
+			}
 			binding.variable = variable
-			var sourceId = bindingEntity.attributes["source"].(*value.Text).Value()
-			var source, ok = sources[sourceId]
-			panicOnNotOk(ok, "Query '"+query.name+"' does not contain source '"+sourceId+"' for binding '"+bindingEntity.entity+"'")
-			binding.source = source
-			var bindings = source.Bindings()
-			*bindings = append(*bindings, binding)
 			variable.bindings = append(variable.bindings, binding)
 		}
+		var bindings = source.Bindings()
+		*bindings = append(*bindings, binding)
 	}
 
 	// Link projection and grouping variables to expression nodes
@@ -508,36 +716,207 @@ func QueryFromEntity(root *Entity, tagMap *TagMap) *QueryNode {
 		var expressionValue = value.NewText(id)
 
 		for _, projectionEntity := range FilterEntities(EntityAttributeEquals("expression", expressionValue), (*tagMap)["projection"]) {
-			var variableId = projectionEntity.attributes["variable"].(*value.Text).Value()
-			var variable, ok = query.variables[variableId]
-			panicOnNotOk(ok, "Query '"+query.name+"' does not contain variable '"+variableId+"' for projection '"+projectionEntity.entity+"'")
+			var variableId, ok = textAttribute(projectionEntity, "variable", &errs)
+			if !ok {
+				continue
+			}
+			variable, ok := query.variables[variableId]
+			if !ok {
+				errs.add(projectionEntity.entity, "query '"+query.id+"' does not contain variable '"+variableId+"'")
+				continue
+			}
 			expression.projection = append(expression.projection, variable)
 		}
 
 		var groupings = make(map[int64]*VariableNode)
+		var maxIx int64 = -1
 		for _, groupingEntity := range FilterEntities(EntityAttributeEquals("expression", expressionValue), (*tagMap)["grouping"]) {
-			var ix = groupingEntity.attributes["ix"].(*value.Number).Value().IntPart()
-			var variableId = groupingEntity.attributes["variable"].(*value.Text).Value()
-			var variable, ok = query.variables[variableId]
-			panicOnNotOk(ok, "Query '"+query.name+"' does not contain variable '"+variableId+"' for grouping '"+groupingEntity.entity+"'")
+			var ixNumber, isNumber = groupingEntity.attributes["ix"].(*value.Number)
+			if !isNumber {
+				errs.add(groupingEntity.entity, "grouping must have a numeric 'ix'")
+				continue
+			}
+			var ix = ixNumber.Value().IntPart()
+			if ix < 0 {
+				errs.add(groupingEntity.entity, "grouping 'ix' must not be negative")
+				continue
+			}
+			var variableId, ok = textAttribute(groupingEntity, "variable", &errs)
+			if !ok {
+				continue
+			}
+			variable, ok := query.variables[variableId]
+			if !ok {
+				errs.add(groupingEntity.entity, "query '"+query.id+"' does not contain variable '"+variableId+"'")
+				continue
+			}
 			groupings[ix] = variable
+			if ix > maxIx {
+				maxIx = ix
+			}
 		}
-		var sortedGroupings = make([]*VariableNode, len(groupings))
+		// gaps in the ix's are left as nil for Validate to report
+		var sortedGroupings = make([]*VariableNode, maxIx+1)
 		for ix, variable := range groupings {
 			sortedGroupings[ix] = variable
 		}
 		expression.grouping = sortedGroupings
 	}
 
-	return query
-}
+	// A #not names its body, a #query of its own whose parent is this one
+	var queries = IndexEntitiesById((*tagMap)["query"])
+	for _, notEntity := range FilterEntities(queryChildFilter, (*tagMap)["not"]) {
+		var bodyId, ok = textAttribute(notEntity, "body", &errs)
+		if !ok {
+			continue
+		}
+		var bodyEntity, isQuery = (*queries)[bodyId]
+		if !isQuery {
+			errs.add(notEntity.entity, "not body '"+bodyId+"' is not a query")
+			continue
+		}
+		var body, err = QueryFromEntity(bodyEntity, tagMap)
+		if err != nil {
+			errs = append(errs, err.(LoadErrors)...)
+			continue
+		}
+		query.nots[notEntity.entity] = &NotNode{id: notEntity.entity, body: body}
+	}
 
-func TagMapToQueryGraph(tagMap *TagMap) *QueryNode {
+	return query, errs.err()
+}
 
+func TagMapToQueryGraph(tagMap *TagMap) (*QueryNode, error) {
 	var root = SomeEntity(EntityAttributeEquals("parent", nil), (*tagMap)["query"])
 	if root == nil {
-		panic("Unable to find root query!")
+		return nil, LoadErrors{{index: -1, msg: "unable to find a root query (a #query without a parent)"}}
+	}
+	var query, err = QueryFromEntity(root, tagMap)
+	var errs = bindingSourceErrors(tagMap)
+	if err != nil {
+		errs = append(err.(LoadErrors), errs...)
+	}
+	return query, errs.err()
+}
+
+// TagMapToQueries builds every root query in the tag map, ordered by where
+// they appear in the source (or by id for fact files without positions).
+func TagMapToQueries(tagMap *TagMap) ([]*QueryNode, error) {
+	var roots = FilterEntities(EntityAttributeEquals("parent", nil), (*tagMap)["query"])
+	var errs = bindingSourceErrors(tagMap)
+	var queries []*QueryNode
+	for _, root := range roots {
+		var query, err = QueryFromEntity(root, tagMap)
+		if err != nil {
+			errs = append(errs, err.(LoadErrors)...)
+			continue
+		}
+		queries = append(queries, query)
+	}
+	sort.Sort(queriesBySource(queries))
+	return queries, errs.err()
+}
+
+type queriesBySource []*QueryNode
+
+func (qs queriesBySource) Len() int      { return len(qs) }
+func (qs queriesBySource) Swap(i, j int) { qs[i], qs[j] = qs[j], qs[i] }
+func (qs queriesBySource) Less(i, j int) bool {
+	if qs[i].line != qs[j].line {
+		return qs[i].line < qs[j].line
+	}
+	return qs[i].id < qs[j].id
+}
+
+// FactsFromProgram converts the facts of a parsed program into the same form
+// ReadFactsFromJson produces.
+func FactsFromProgram(program *parser.Program) (*[]Fact, error) {
+	var errs LoadErrors
+	var facts []Fact
+	for k, raw := range program.Facts {
+		var fact = Fact{entity: raw.Entity, attribute: raw.Attribute}
+		switch val := raw.Value.(type) {
+		case string:
+			fact.value = value.NewText(val)
+		case parser.Number:
+			var number, err = value.ParseNumber(string(val))
+			if err != nil {
+				errs.addFact(k, raw.Entity, "invalid number "+string(val))
+				continue
+			}
+			fact.value = number
+		case int:
+			fact.value = value.NewNumberFromInt(int64(val))
+		case bool:
+			fact.value = value.NewBoolean(val)
+		default:
+			panic(fmt.Sprintf("Parser produced an unknown value type for %v", raw))
+		}
+		facts = append(facts, fact)
+	}
+	return &facts, errs.err()
+}
+
+// LoadQueryGraph runs the whole EAV pipeline over a JSON fact file: facts,
+// entities, tag map and finally the query graph. Problems at each stage are
+// collected rather than panicking, and the first stage that fails stops the
+// load.
+func LoadQueryGraph(raw []byte) (*QueryNode, error) {
+	var facts, err = ReadFactsFromJson(raw)
+	if err != nil {
+		return nil, err
+	}
+	tagMap, err := IndexEntitiesByTag(FactsToEntities(facts))
+	if err != nil {
+		return nil, err
+	}
+	return TagMapToQueryGraph(tagMap)
+}
+
+//------------------------------------------------------------------------------
+// Load Errors
+//------------------------------------------------------------------------------
+
+type LoadError struct {
+	index  int    // position of the offending fact in the source, or -1
+	entity string // offending entity, if known
+	msg    string
+}
+
+func (err *LoadError) Error() string {
+	var result = ""
+	if err.index >= 0 {
+		result += "fact " + strconv.Itoa(err.index) + ": "
+	}
+	if err.entity != "" {
+		result += "'" + err.entity + "': "
+	}
+	return result + err.msg
+}
+
+// LoadErrors aggregates every problem found while loading so a broken
+// program file can be fixed in one pass.
+type LoadErrors []*LoadError
+
+func (errs LoadErrors) Error() string {
+	var result = strconv.Itoa(len(errs)) + " problem(s) loading query graph:"
+	for _, err := range errs {
+		result += "\n  " + err.Error()
+	}
+	return result
+}
+
+func (errs *LoadErrors) add(entity string, msg string) {
+	*errs = append(*errs, &LoadError{index: -1, entity: entity, msg: msg})
+}
+
+func (errs *LoadErrors) addFact(index int, entity string, msg string) {
+	*errs = append(*errs, &LoadError{index: index, entity: entity, msg: msg})
+}
+
+func (errs LoadErrors) err() error {
+	if len(errs) == 0 {
+		return nil
 	}
-	fmt.Println("query root entity", root.String())
-	return QueryFromEntity(root, tagMap)
+	return errs
 }
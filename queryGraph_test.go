@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"testing"
+)
+
+// twoQueries is a fact file with a root query each for q1 and q2, and
+// whatever extra facts a test adds
+func twoQueries(extra string) []byte {
+	return []byte(`[
+		["q1", "tag", "query"], ["q2", "tag", "query"],
+		["x", "tag", "variable"], ["x", "query", "q1"], ["x", "name", "x"],
+		["y", "tag", "variable"], ["y", "query", "q2"], ["y", "name", "y"],
+		["s1", "tag", "scan"], ["s1", "query", "q1"],
+		["s2", "tag", "scan"], ["s2", "query", "q2"],
+		["s1b1", "tag", "binding"], ["s1b1", "source", "s1"], ["s1b1", "field", "entity"], ["s1b1", "variable", "x"],
+		["s2b1", "tag", "binding"], ["s2b1", "source", "s2"], ["s2b1", "field", "entity"], ["s2b1", "variable", "y"]` + extra + `
+	]`)
+}
+
+func loadQueries(raw []byte) ([]*QueryNode, error) {
+	facts, err := ReadFactsFromJson(raw)
+	if err != nil {
+		return nil, err
+	}
+	return queriesFromFacts(facts)
+}
+
+func TestBindingSources(t *testing.T) {
+	queries, err := loadQueries(twoQueries(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range queries {
+		for _, scan := range query.scans {
+			if len(scan.bindings) != 1 {
+				t.Fatalf("expected each query to keep only its own binding, got %v in %v", len(scan.bindings), query.id)
+			}
+		}
+	}
+
+	_, err = loadQueries(twoQueries(`, ["s1b2", "tag", "binding"], ["s1b2", "source", "s9"], ["s1b2", "field", "attribute"], ["s1b2", "constant", "name"]`))
+	if errs, ok := err.(LoadErrors); !ok || len(errs) != 1 || errs[0].Error() != "'s1b2': binding's source 's9' is not a scan, expression or mutate" {
+		t.Fatalf("expected a binding with a typo'd source to be an error, got %v", err)
+	}
+}
+
+func TestReadFactsFromJson(t *testing.T) {
+	facts, err := ReadFactsFromJson([]byte(`[["a", "n", 12], ["a", "f", 1.5], ["a", "big", 12345678901234567890], ["a", "t", "text"], ["a", "b", true]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"12", "1.5", "12345678901234567000", `"text"`, "true"}
+	for ix, fact := range *facts {
+		if fact.value.String() != expected[ix] {
+			t.Errorf("fact %v: expected %v, got %v", ix, expected[ix], fact.value.String())
+		}
+	}
+
+	_, err = ReadFactsFromJson([]byte(`[["a", "n"], [1, "n", 2], ["a", "n", null], ["a", "n", 1e999], ["a", "n", 3]]`))
+	var errs, ok = err.(LoadErrors)
+	if !ok || len(errs) != 4 {
+		t.Fatalf("expected a problem with each of the first four facts, got %v", err)
+	}
+	for ix, expected := range []string{
+		"fact 0: expected an [entity, attribute, value] triple, got [a n]",
+		"fact 1: '1': entity and attribute must be strings",
+		"fact 2: 'a': unsupported value type for attribute 'n': <nil>",
+		"fact 3: 'a': invalid number 1e999",
+	} {
+		if errs[ix].Error() != expected {
+			t.Errorf("expected %q, got %q", expected, errs[ix].Error())
+		}
+	}
+	if _, err := ReadFactsFromJson([]byte(`{"a": 1}`)); err == nil {
+		t.Error("expected a file that isn't a list of facts to be an error")
+	}
+}
+
+func TestFactsToJsonRoundTrip(t *testing.T) {
+	var facts = [][3]value.Value{
+		{value.NewText("a"), value.NewText("n"), value.NewNumberFromFloat(1.5)},
+		{value.NewText("a"), value.NewText("t"), value.NewText("true")},
+		{value.NewText("a"), value.NewText("b"), value.NewBoolean(true)},
+		{value.NewText("a"), value.NewText("c"), value.NewBoolean(false)},
+	}
+	read, err := ReadFactsFromJson([]byte(FactsToJson(facts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*read) != len(facts) {
+		t.Fatalf("expected %v facts back, got %v", len(facts), len(*read))
+	}
+	for ix, fact := range *read {
+		if !fact.value.Equals(facts[ix][2]) {
+			t.Errorf("fact %v: expected %v, got %v", ix, facts[ix][2], fact.value)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range []struct {
+		extra    string
+		expected string
+	}{
+		{`, ["s1b2", "tag", "binding"], ["s1b2", "field", "value"], ["s1b2", "variable", "x"]`, "'s1b2': binding has no source"},
+		{`, ["s1b2", "tag", "binding"], ["s1b2", "source", "s1"], ["s1b2", "field", "value"], ["s1b2", "variable", "z"]`, "'s1b2': query 'q1' does not contain variable 'z'"},
+		{`, ["s1b2", "tag", "binding"], ["s1b2", "source", "s1"], ["s1b2", "field", 3], ["s1b2", "variable", "x"]`, "'s1b2': attribute 'field' must be a string, got 3"},
+		{`, ["e1", "tag", "expression"], ["e1", "query", "q1"]`, "'e1': missing required attribute 'operator'"},
+		{`, ["e1", "tag", "expression"], ["e1", "query", "q1"], ["e1", "operator", "count"], ["g1", "tag", "grouping"], ["g1", "expression", "e1"], ["g1", "variable", "x"]`, "'g1': grouping must have a numeric 'ix'"},
+		{`, ["e1", "tag", "expression"], ["e1", "query", "q1"], ["e1", "operator", "count"], ["g1", "tag", "grouping"], ["g1", "expression", "e1"], ["g1", "ix", -1], ["g1", "variable", "x"]`, "'g1': grouping 'ix' must not be negative"},
+		{`, ["e1", "tag", "expression"], ["e1", "query", "q1"], ["e1", "operator", "count"], ["p1", "tag", "projection"], ["p1", "expression", "e1"], ["p1", "variable", "y"]`, "'p1': query 'q1' does not contain variable 'y'"},
+		{`, ["n1", "tag", "not"], ["n1", "query", "q1"], ["n1", "body", "x"]`, "'n1': not body 'x' is not a query"},
+		{`, ["w", "tag", 7]`, "'w': tag must be a string, got 7"},
+	} {
+		_, err := loadQueries(twoQueries(test.extra))
+		var errs, ok = err.(LoadErrors)
+		if !ok || len(errs) != 1 || errs[0].Error() != test.expected {
+			t.Errorf("expected %q, got %v", test.expected, err)
+		}
+	}
+
+	_, err := LoadQueryGraph([]byte(`[["q1", "tag", "query"], ["q1", "parent", "q2"]]`))
+	if err == nil || err.Error() != "1 problem(s) loading query graph:\n  unable to find a root query (a #query without a parent)" {
+		t.Errorf("expected no root query to be an error, got %v", err)
+	}
+}
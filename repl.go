@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"github.com/witheve/evingo/value"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// REPL
+//------------------------------------------------------------------------------
+
+// A Repl is a live bag you can load programs and facts into, query, and
+// change a statement at a time. Programs it loads keep running: every change
+// is followed by running their blocks to a fixpoint again.
+//
+// A line that is a whole query runs as soon as it's entered. Statements that
+// need more than one line (anything starting with add, remove or update, or
+// with an attribute ending in a colon) carry on until a blank line, as does
+// anything after :begin.
+type Repl struct {
+	bags       *Bags
+	c          context
+	queries    []*QueryNode // the blocks of every program loaded
+	runtime    *Runtime
+	undo       []uint64 // the commit before each change :undo can take back
+	history    []string
+	saveTo     string // file history is kept in between sessions, if any
+	pending    []string
+	statements int
+	out        io.Writer
+}
+
+var replHelp = `Enter a query to see its results, or a statement to change the bag:
+  #person name age
+  add
+    #person name: "Ada" age: 36
+Meta-commands:
+  :load <file>      load a program (.e) or facts (.json, .f)
+  :facts [entity]   print every fact, or one entity's
+  :bags             list the bags
+  :plan [query]     show how a query, or every loaded block, will run
+  :undo             take back the last change
+  :begin            start a statement that runs at the next blank line
+  :history          list what's been entered
+  :complete <word>  list the tags and attributes a word could be
+  :help             this
+  :quit             leave`
+
+// NewRepl starts a REPL on an empty "session" bag, writing to out
+func NewRepl(out io.Writer) (*Repl, error) {
+	var repl = &Repl{bags: NewBags(), out: out}
+	if _, err := repl.bags.Create("session", value.Uuid{}); err != nil {
+		return nil, err
+	}
+	c, err := repl.bags.Context(value.Uuid{}, "session")
+	if err != nil {
+		return nil, err
+	}
+	repl.c = c
+	return repl, nil
+}
+
+// Prompt is what to show before the next line
+func (repl *Repl) Prompt() string {
+	if len(repl.pending) > 0 {
+		return "... "
+	}
+	return "eve> "
+}
+
+// History is every line entered so far, oldest first
+func (repl *Repl) History() []string {
+	return repl.history
+}
+
+// KeepHistory picks up the history saved in path, and saves new lines to it
+func (repl *Repl) KeepHistory(path string) {
+	if raw, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(raw), "\n") {
+			if line != "" {
+				repl.history = append(repl.history, line)
+			}
+		}
+	}
+	repl.saveTo = path
+}
+
+func (repl *Repl) remember(line string) {
+	repl.history = append(repl.history, line)
+	if repl.saveTo == "" {
+		return
+	}
+	if file, err := os.OpenFile(repl.saveTo, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		file.WriteString(line + "\n")
+		file.Close()
+	}
+}
+
+// Interrupt throws away the statement being entered
+func (repl *Repl) Interrupt() {
+	repl.pending = nil
+}
+
+func (repl *Repl) printf(format string, args ...interface{}) {
+	fmt.Fprintf(repl.out, format, args...)
+}
+
+// Line handles one line of input. It returns false once the REPL is done.
+func (repl *Repl) Line(line string) bool {
+	if strings.TrimSpace(line) != "" {
+		repl.remember(line)
+	}
+	if len(repl.pending) > 0 {
+		if strings.TrimSpace(line) == "" {
+			repl.statement(repl.pending)
+			repl.pending = nil
+		} else {
+			repl.pending = append(repl.pending, line)
+		}
+		return true
+	}
+	var trimmed = strings.TrimSpace(line)
+	switch {
+	case trimmed == "":
+	case strings.HasPrefix(trimmed, ":"):
+		return repl.meta(trimmed)
+	case continues(trimmed):
+		repl.pending = []string{line}
+	default:
+		repl.statement([]string{line})
+	}
+	return true
+}
+
+// continues reports whether a first line needs more lines after it
+func continues(line string) bool {
+	var first = strings.Fields(line)[0]
+	return first == "add" || first == "remove" || first == "update" || strings.HasSuffix(line, ":")
+}
+
+// End runs whatever statement was still being entered
+func (repl *Repl) End() {
+	if len(repl.pending) > 0 {
+		repl.statement(repl.pending)
+		repl.pending = nil
+	}
+}
+
+func (repl *Repl) meta(line string) bool {
+	var fields = strings.Fields(line)
+	var rest = strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+	switch fields[0] {
+	case ":quit", ":q":
+		return false
+	case ":help":
+		repl.printf("%s\n", replHelp)
+	case ":load":
+		if rest == "" {
+			repl.printf("usage: :load <file>\n")
+		} else if err := repl.Load(rest); err != nil {
+			repl.printf("error: %v\n", err)
+		}
+	case ":facts":
+		repl.facts(rest)
+	case ":bags":
+		for _, bag := range repl.bags.Visible(repl.c.user) {
+			var marker = " "
+			if bag.Id == repl.c.bag {
+				marker = "*"
+			}
+			var count = 0
+			scan(context{e: *bag.db}, nil, nil, nil, func(e, a, v value.Value) { count++ })
+			repl.printf("%s %s (%v facts)\n", marker, bag.Name, count)
+		}
+	case ":plan":
+		repl.plan(rest)
+	case ":undo":
+		repl.undoLast()
+	case ":begin":
+		repl.pending = []string{}
+		if rest != "" {
+			repl.pending = append(repl.pending, rest)
+		}
+	case ":history":
+		for ix, entry := range repl.history {
+			repl.printf("%4d  %s\n", ix+1, entry)
+		}
+	case ":complete":
+		repl.printf("%s\n", strings.Join(repl.Complete(rest), "  "))
+	default:
+		repl.printf("unknown command %s, try :help\n", fields[0])
+	}
+	return true
+}
+
+//------------------------------------------------------------------------------
+// Loading and changing the bag
+//------------------------------------------------------------------------------
+
+// Load adds a program's blocks to the running ones, or a fact file's facts
+// to the bag
+func (repl *Repl) Load(path string) error {
+	if filepath.Ext(path) != ".e" {
+		var before = repl.c.e.LastCommit()
+		if err := LoadFacts(repl.c, path); err != nil {
+			return err
+		}
+		repl.undo = append(repl.undo, before)
+		return repl.settle()
+	}
+	queries, diagnostics, err := LoadProgramFile(path)
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		diagnostics = append(diagnostics, query.Validate()...)
+	}
+	if repl.report(path, diagnostics) {
+		return nil
+	}
+	return repl.restart(append(repl.queries, queries...))
+}
+
+// report prints diagnostics, returning whether any were errors
+func (repl *Repl) report(name string, diagnostics []Diagnostic) bool {
+	for _, diagnostic := range diagnostics {
+		repl.printf("%s: %s\n", name, diagnostic.String())
+	}
+	return HasErrors(diagnostics)
+}
+
+// restart runs queries in place of the blocks running now
+func (repl *Repl) restart(queries []*QueryNode) error {
+	runtime, err := NewRuntime(repl.c, queries)
+	if err != nil {
+		return err
+	}
+	if repl.runtime != nil {
+		repl.runtime.Close()
+	}
+	repl.queries, repl.runtime = queries, runtime
+	var before = repl.c.e.LastCommit()
+	if err := repl.settle(); err != nil {
+		return err
+	}
+	if repl.c.e.LastCommit() != before {
+		repl.undo = append(repl.undo, before)
+	}
+	return nil
+}
+
+// settle runs the loaded blocks to a fixpoint after a change
+func (repl *Repl) settle() error {
+	if repl.runtime == nil {
+		return nil
+	}
+	_, err := repl.runtime.Run()
+	return err
+}
+
+// compile turns lines of a statement into a query of its own
+func (repl *Repl) compile(lines []string) (*QueryNode, bool) {
+	repl.statements++
+	var name = "statement " + strconv.Itoa(repl.statements)
+	var code = name + "\n"
+	for _, line := range lines {
+		code += "  " + line + "\n"
+	}
+	queries, diagnostics, err := LoadProgramString(name, code)
+	if err != nil {
+		repl.printf("error: %v\n", err)
+		return nil, false
+	}
+	if len(queries) != 1 {
+		repl.report(name, diagnostics)
+		repl.printf("error: expected a query\n")
+		return nil, false
+	}
+	diagnostics = append(diagnostics, queries[0].Validate()...)
+	if repl.report(name, diagnostics) {
+		return nil, false
+	}
+	return queries[0], true
+}
+
+// statement runs a query and either prints its results or, if it has
+// mutates, applies them as one transaction
+func (repl *Repl) statement(lines []string) {
+	var query, ok = repl.compile(lines)
+	if !ok {
+		return
+	}
+	plan, err := PlanQuery(query, &repl.c.e, JoinAuto)
+	if err != nil {
+		repl.printf("error: %v\n", err)
+		return
+	}
+	var rows [][]value.Value
+	if err := plan.Run(repl.c, func(row []value.Value) { rows = append(rows, row) }); err != nil {
+		repl.printf("error: %v\n", err)
+		return
+	}
+	if len(query.mutates) == 0 {
+		repl.results(plan, rows)
+		return
+	}
+	var block = newBlock(query, plan)
+	var tx = repl.c.Begin()
+	for _, row := range rows {
+		for _, m := range block.mutations(repl.c, row) {
+			if m.op == value.OpRemove {
+				tx.Remove(m.fact[0], m.fact[1], m.fact[2])
+			} else {
+				tx.Insert(m.fact[0], m.fact[1], m.fact[2])
+			}
+		}
+	}
+	var before = repl.c.e.LastCommit()
+	commit, err := tx.Commit()
+	if err != nil {
+		repl.printf("error: %v\n", err)
+		return
+	}
+	repl.undo = append(repl.undo, before)
+	if err := repl.settle(); err != nil {
+		repl.printf("error: %v\n", err)
+	}
+	var added, removed = repl.c.e.Diff(before, 0)
+	repl.printf("commit %v: %v facts changed (%v added, %v removed)\n", commit.Id, len(added)+len(removed), len(added), len(removed))
+}
+
+// undoLast puts the bag back the way it was before the last change,
+// including whatever the loaded blocks did in response to it
+func (repl *Repl) undoLast() {
+	if len(repl.undo) == 0 {
+		repl.printf("nothing to undo\n")
+		return
+	}
+	var before = repl.undo[len(repl.undo)-1]
+	repl.undo = repl.undo[:len(repl.undo)-1]
+	var added, removed = repl.c.e.Diff(before, 0)
+	var tx = repl.c.Begin()
+	for _, fact := range added {
+		tx.Remove(fact[0], fact[1], fact[2])
+	}
+	for _, fact := range removed {
+		tx.Insert(fact[0], fact[1], fact[2])
+	}
+	if _, err := tx.Commit(); err != nil {
+		repl.printf("error: %v\n", err)
+		return
+	}
+	repl.printf("undid %v added and %v removed facts\n", len(added), len(removed))
+}
+
+//------------------------------------------------------------------------------
+// Printing
+//------------------------------------------------------------------------------
+
+// results prints a query's rows as a table of its named variables
+func (repl *Repl) results(plan *Plan, rows [][]value.Value) {
+	var columns []*VariableNode
+	for _, variable := range sortedVariables(plan.query) {
+		if !strings.HasPrefix(variable.name, "$") {
+			columns = append(columns, variable)
+		}
+	}
+	var lines []string
+	var seen = make(map[string]bool)
+	for _, row := range rows {
+		var cells []string
+		for _, variable := range columns {
+			var v = row[plan.registers[variable]]
+			if v == nil {
+				cells = append(cells, "-")
+			} else {
+				cells = append(cells, v.String())
+			}
+		}
+		var line = strings.Join(cells, "  ")
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	var header []string
+	for _, variable := range columns {
+		header = append(header, variable.name)
+	}
+	repl.printf("%s\n", strings.Join(header, "  "))
+	for _, line := range lines {
+		repl.printf("%s\n", line)
+	}
+	repl.printf("(%v results)\n", len(lines))
+}
+
+func (repl *Repl) facts(entity string) {
+	var e value.Value
+	if entity != "" {
+		e = value.NewText(entity)
+	}
+	var lines []string
+	scan(repl.c, e, nil, nil, func(e, a, v value.Value) {
+		lines = append(lines, textOf(e)+" "+textOf(a)+" "+v.String())
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		repl.printf("%s\n", line)
+	}
+}
+
+func (repl *Repl) plan(code string) {
+	var queries = repl.queries
+	if code != "" {
+		var query, ok = repl.compile([]string{code})
+		if !ok {
+			return
+		}
+		queries = []*QueryNode{query}
+	}
+	if len(queries) == 0 {
+		repl.printf("no blocks loaded; try :plan <query>\n")
+	}
+	for _, query := range queries {
+		plan, err := PlanQuery(query, &repl.c.e, JoinAuto)
+		if err != nil {
+			repl.printf("error: %v\n", err)
+			continue
+		}
+		repl.printf("%s\n", plan.String())
+	}
+}
+
+// Complete lists what the last word of line could be: tags after a #,
+// otherwise attributes, all drawn from the facts in the bag
+func (repl *Repl) Complete(line string) []string {
+	var word = line
+	if ix := strings.LastIndexAny(line, " \t,:"); ix >= 0 {
+		word = line[ix+1:]
+	}
+	var tag = value.NewText("tag")
+	var candidates = make(map[string]bool)
+	if strings.HasPrefix(word, "#") {
+		scan(repl.c, nil, tag, nil, func(e, a, v value.Value) {
+			candidates["#"+textOf(v)] = true
+		})
+	} else {
+		scan(repl.c, nil, nil, nil, func(e, a, v value.Value) {
+			candidates[textOf(a)] = true
+		})
+	}
+	var result []string
+	for candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			result = append(result, candidate)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Close stops the loaded blocks
+func (repl *Repl) Close() {
+	if repl.runtime != nil {
+		repl.runtime.Close()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReplStatementsAndUndo(t *testing.T) {
+	var out bytes.Buffer
+	var repl, err = NewRepl(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repl.Close()
+	for _, line := range []string{
+		"add",
+		`  #person name: "Ada" age: 36`,
+		`  #person name: "Bob" age: 20`,
+		"",
+		":begin #person name age",
+		"age > 25",
+		"",
+	} {
+		repl.Line(line)
+	}
+	if !strings.Contains(out.String(), `"Ada"`) || strings.Contains(out.String(), `"Bob"  `) || !strings.Contains(out.String(), "(1 results)") {
+		t.Fatalf("expected only Ada to be over 25, got:\n%v", out.String())
+	}
+	if completions := repl.Complete("#pe"); len(completions) != 1 || completions[0] != "#person" {
+		t.Fatalf("expected #pe to complete to #person, got %v", completions)
+	}
+
+	out.Reset()
+	repl.Line(":undo")
+	repl.Line("#person name")
+	if !strings.Contains(out.String(), "(0 results)") {
+		t.Fatalf("expected undo to take both people back out, got:\n%v", out.String())
+	}
+}
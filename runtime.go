@@ -0,0 +1,574 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Blocks
+//------------------------------------------------------------------------------
+
+// A Block is a query whose results change the edb through its mutates. A
+// fact a block adds lasts as long as some result of the block asks for it:
+// once the last one goes, so does the fact, unless it was added forever or
+// another block added it too. The same goes for every fact a block added when
+// the block itself is reloaded away. Support is counted, so facts a recursive
+// block derived from each other in a cycle hold each other up and stay.
+// Removes and updates commit, the same as if they had come from outside.
+type Block struct {
+	query       *QueryNode
+	key         string // what the entities it makes up are named after
+	plan        *Plan
+	view        *View
+	effects     []*effect
+	stratum     int
+	fresh       map[string][]value.Value // results whose mutates haven't run yet
+	order       []string
+	produced    map[string][3]value.Value // facts that go when the block does
+	supports    map[string][]string       // the facts each result's adds asked for
+	support     map[string]int            // how many results ask for each fact
+	unsupported []string                  // facts whose last result went, to retract
+	profile     *Profile                  // nil unless the runtime is profiling
+}
+
+// an effect is one fact a mutate adds, removes or updates per result row
+type effect struct {
+	mutate *MutateNode
+	terms  [3]planTerm
+}
+
+type mutation struct {
+	op      value.Operator
+	fact    [3]value.Value
+	block   *Block
+	forever bool
+	add     bool // a plain add, which the result it came from supports
+}
+
+func (block *Block) String() string {
+	return block.query.label()
+}
+
+// effects breaks mutates down the way patterns breaks down scans. Object-style
+// mutates without a $$ENTITY get an entity made up for them.
+func (plan *Plan) effects(mutate *MutateNode) []*effect {
+	var triple = [3]planTerm{{register: -2}, {register: -2}, {register: -2}}
+	var isTriple = true
+	var entity = planTerm{register: -1}
+	for _, binding := range mutate.bindings {
+		switch binding.field {
+		case "entity":
+			triple[0] = plan.term(binding)
+		case "attribute":
+			triple[1] = plan.term(binding)
+		case "value":
+			triple[2] = plan.term(binding)
+		case "$$ENTITY":
+			entity = plan.term(binding)
+			isTriple = false
+		default:
+			isTriple = false
+		}
+	}
+	if isTriple {
+		return []*effect{{mutate, triple}}
+	}
+	var effects []*effect
+	for _, binding := range mutate.bindings {
+		if binding.field == "$$ENTITY" {
+			continue
+		}
+		var attribute = planTerm{constant: value.NewText(binding.field), register: -1}
+		effects = append(effects, &effect{mutate, [3]planTerm{entity, attribute, plan.term(binding)}})
+	}
+	return effects
+}
+
+// generateId makes up an entity for a mutate whose entity the query doesn't
+// bind. It depends only on the result row, so the same result always makes
+// the same entity, and every mutate in the block that uses the same variable
+// agrees on it.
+func generateId(key string, row []value.Value) value.Value {
+	var h = fnv.New64a()
+	h.Write([]byte(key))
+	for _, v := range row {
+		h.Write([]byte{0})
+		if v != nil {
+			h.Write([]byte(v.String()))
+		}
+	}
+	return value.NewText(key + "|" + strconv.FormatUint(h.Sum64(), 36))
+}
+
+func (block *Block) resolve(e *effect, row []value.Value) ([3]value.Value, bool) {
+	var fact [3]value.Value
+	for ix, t := range e.terms {
+		switch {
+		case t.constant != nil:
+			fact[ix] = t.constant
+		case t.register >= 0 && row[t.register] != nil:
+			fact[ix] = row[t.register]
+		case t.variable != nil:
+			// an entity some mutate in the block makes up, which can also
+			// be another mutate's value
+			fact[ix] = generateId(block.key+"."+t.variable.name, row)
+		case ix == 0:
+			fact[ix] = generateId(block.key+"."+e.mutate.id, row)
+		default:
+			// the validator reports unbound values
+			return fact, false
+		}
+	}
+	return fact, true
+}
+
+func newBlock(query *QueryNode, plan *Plan) *Block {
+	var block = &Block{
+		query:    query,
+		key:      query.id,
+		plan:     plan,
+		fresh:    make(map[string][]value.Value),
+		produced: make(map[string][3]value.Value),
+		supports: make(map[string][]string),
+		support:  make(map[string]int),
+	}
+	for _, id := range sortedKeys(query.mutates) {
+		block.effects = append(block.effects, plan.effects(query.mutates[id])...)
+	}
+	return block
+}
+
+// Stratum is the block's place in the order Stratify puts blocks in
+func (block *Block) Stratum() int {
+	return block.stratum
+}
+
+// follow keeps track of the block's results. A new one is fresh until its
+// mutates run. A result that goes before then never runs them; one that goes
+// after takes its support from the facts it added.
+func (block *Block) follow(op value.Operator, row []value.Value) {
+	var key = rowString(row)
+	if op == value.OpRemove {
+		if _, ok := block.fresh[key]; ok {
+			delete(block.fresh, key)
+			return
+		}
+		for _, fact := range block.supports[key] {
+			if block.support[fact]--; block.support[fact] == 0 {
+				block.unsupported = append(block.unsupported, fact)
+			}
+		}
+		delete(block.supports, key)
+		return
+	}
+	if _, ok := block.fresh[key]; !ok {
+		block.fresh[key] = row
+		block.order = append(block.order, key)
+	}
+}
+
+// pending reports whether the block has anything for Run to do
+func (block *Block) pending() bool {
+	return len(block.fresh) > 0 || len(block.unsupported) > 0
+}
+
+// take is the mutations for every fresh result, oldest first, and then the
+// retractions of facts the block added that no result asks for any more
+func (runtime *Runtime) take(block *Block) []mutation {
+	var result []mutation
+	for _, key := range block.order {
+		var row, ok = block.fresh[key]
+		if !ok {
+			continue
+		}
+		var mutations = block.mutations(runtime.c, row)
+		for _, m := range mutations {
+			if m.add {
+				var fact = rowString(m.fact[:])
+				block.supports[key] = append(block.supports[key], fact)
+				block.support[fact]++
+			}
+		}
+		result = append(result, mutations...)
+	}
+	block.fresh = make(map[string][]value.Value)
+	block.order = nil
+
+	for _, key := range block.unsupported {
+		var fact, ok = block.produced[key]
+		if !ok || block.support[key] > 0 {
+			continue
+		}
+		delete(block.support, key)
+		delete(block.produced, key)
+		if runtime.owned(key) {
+			continue
+		}
+		result = append(result, mutation{value.OpRemove, fact, block, false, false})
+	}
+	block.unsupported = nil
+	return result
+}
+
+// mutations are the changes a new result row asks for
+func (block *Block) mutations(c context, row []value.Value) []mutation {
+	var result []mutation
+	for _, e := range block.effects {
+		var fact, ok = block.resolve(e, row)
+		if !ok {
+			continue
+		}
+		var forever = e.mutate.forever
+		switch e.mutate.operator {
+		case "remove":
+			result = append(result, mutation{value.OpRemove, fact, block, forever, false})
+		case "update":
+			// update replaces whatever the attribute had
+			scan(c, fact[0], fact[1], nil, func(e, a, v value.Value) {
+				if !v.Equals(fact[2]) {
+					result = append(result, mutation{value.OpRemove, [3]value.Value{e, a, v}, block, forever, false})
+				}
+			})
+			result = append(result, mutation{value.OpInsert, fact, block, forever, false})
+		default:
+			result = append(result, mutation{value.OpInsert, fact, block, forever, !forever})
+		}
+	}
+	return result
+}
+
+//------------------------------------------------------------------------------
+// Runtime
+//------------------------------------------------------------------------------
+
+// DefaultMaxIterations is how many rounds Run allows before deciding a
+// program will never settle
+const DefaultMaxIterations = 1000
+
+// A Runtime runs a program's blocks against an edb. Every block is a view on
+// the edb, so changes flow into results on their own; Run applies what the
+// results ask for, round after round, until a round changes nothing.
+//
+// Blocks run stratum by stratum. A result's mutates only run once every
+// earlier stratum has settled, so a block never acts on a not or an
+// aggregate that is still going to change; results that come and go while
+// earlier strata are running never get to mutate at all.
+type Runtime struct {
+	c             context
+	blocks        []*Block
+	forever       map[string]bool // facts some block added forever
+	keys          map[string]bool // every block key handed out
+	profiling     bool
+	MaxIterations int
+}
+
+// FixpointError is what Run returns when the program doesn't settle. Blocks
+// are the ones that were still changing the edb in the last round.
+type FixpointError struct {
+	Iterations int
+	Blocks     []*Block
+}
+
+func (err *FixpointError) Error() string {
+	var names []string
+	for _, block := range err.Blocks {
+		names = append(names, block.String())
+	}
+	return "no fixpoint after " + strconv.Itoa(err.Iterations) + " iterations; still changing: " + strings.Join(names, ", ")
+}
+
+// NewRuntime stratifies queries, plans each against c and opens a view for it
+func NewRuntime(c context, queries []*QueryNode) (*Runtime, error) {
+	return newRuntime(c, queries, false)
+}
+
+// NewProfiledRuntime is NewRuntime with every block's view profiled, for
+// finding out what a program spends its time on. See Runtime.Explain.
+func NewProfiledRuntime(c context, queries []*QueryNode) (*Runtime, error) {
+	return newRuntime(c, queries, true)
+}
+
+func newRuntime(c context, queries []*QueryNode, profiling bool) (*Runtime, error) {
+	var strata, err = Stratify(queries)
+	if err != nil {
+		return nil, err
+	}
+	var stratum = make(map[*QueryNode]int)
+	for ix, members := range strata {
+		for _, query := range members {
+			stratum[query] = ix
+		}
+	}
+	var runtime = &Runtime{c: c, forever: make(map[string]bool), keys: make(map[string]bool), profiling: profiling, MaxIterations: DefaultMaxIterations}
+	for _, query := range queries {
+		var plan, err = PlanQuery(query, &c.e, JoinAuto)
+		if err != nil {
+			runtime.Close()
+			return nil, err
+		}
+		var block = newBlock(query, plan)
+		block.stratum = stratum[query]
+		runtime.open(block)
+		runtime.blocks = append(runtime.blocks, block)
+	}
+	return runtime, nil
+}
+
+// open starts a block's view, with every result it already has fresh. The
+// block gets a key no other block has had, so a reloaded program, whose ids
+// start from q1 again, never makes up an entity a kept block already made,
+// or one a removed block left behind forever.
+func (runtime *Runtime) open(block *Block) {
+	for n := 2; runtime.keys[block.key]; n++ {
+		block.key = block.query.id + "-" + strconv.Itoa(n)
+	}
+	runtime.keys[block.key] = true
+	if runtime.profiling {
+		block.profile = newProfile(block.plan)
+	}
+	block.view = newView(block.plan, runtime.c, block.profile)
+	if len(block.effects) == 0 {
+		return
+	}
+	for _, row := range block.view.Rows() {
+		block.follow(value.OpInsert, row)
+	}
+	block.view.Watch(block.follow)
+}
+
+func sortedKeys(mutates map[string]*MutateNode) []string {
+	var keys []string
+	for key := range mutates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Run applies what fresh results ask for until there are none left,
+// returning how many rounds it took. Each round runs the lowest stratum with
+// anything to do and commits everything it asks for as one transaction.
+func (runtime *Runtime) Run() (int, error) {
+	var iterations = 0
+	for {
+		var round []mutation
+		var stratum = -1
+		for _, block := range runtime.blocks {
+			if block.pending() && (stratum < 0 || block.stratum < stratum) {
+				stratum = block.stratum
+			}
+		}
+		if stratum < 0 {
+			return iterations, nil
+		}
+		for _, block := range runtime.blocks {
+			if block.stratum == stratum {
+				round = append(round, runtime.take(block)...)
+			}
+		}
+		if iterations >= runtime.MaxIterations {
+			var involved []*Block
+			var seen = make(map[*Block]bool)
+			for _, m := range round {
+				if !seen[m.block] && m.changes(runtime.c) {
+					seen[m.block] = true
+					involved = append(involved, m.block)
+				}
+			}
+			if len(involved) == 0 {
+				continue
+			}
+			return iterations, &FixpointError{iterations, involved}
+		}
+		iterations++
+		var tx = runtime.c.Begin()
+		for _, m := range round {
+			if m.op == value.OpRemove {
+				tx.Remove(m.fact[0], m.fact[1], m.fact[2])
+			} else {
+				tx.Insert(m.fact[0], m.fact[1], m.fact[2])
+			}
+		}
+		commit, err := tx.Commit()
+		if err != nil {
+			return iterations, err
+		}
+		runtime.own(round, commit)
+		for _, block := range runtime.blocks {
+			if err := block.view.Err(); err != nil {
+				return iterations, &blockError{block, err}
+			}
+		}
+	}
+}
+
+// own records which block each fact a commit inserted came from. A block also
+// owns what it asked for that another block already had, so the fact stays
+// while either of them does; facts that were there some other way belong to
+// nobody.
+func (runtime *Runtime) own(round []mutation, commit Commit) {
+	var inserted = make(map[string]bool)
+	for _, change := range commit.Changes {
+		if change.Op == value.OpInsert {
+			inserted[rowString(change.Fact[:])] = true
+		}
+	}
+	for _, m := range round {
+		if m.op != value.OpInsert {
+			continue
+		}
+		var key = rowString(m.fact[:])
+		if !inserted[key] && !runtime.owned(key) {
+			continue
+		}
+		if m.forever {
+			runtime.forever[key] = true
+		} else {
+			m.block.produced[key] = m.fact
+		}
+	}
+}
+
+func (runtime *Runtime) owned(key string) bool {
+	if runtime.forever[key] {
+		return true
+	}
+	for _, block := range runtime.blocks {
+		if _, ok := block.produced[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// changes reports whether applying the mutation would do anything
+func (m mutation) changes(c context) bool {
+	return c.Contains(m.fact[0], m.fact[1], m.fact[2]) != (m.op == value.OpInsert)
+}
+
+type blockError struct {
+	block *Block
+	err   error
+}
+
+func (err *blockError) Error() string {
+	return "in " + err.block.String() + ": " + err.err.Error()
+}
+
+// Blocks are the runtime's blocks in program order
+func (runtime *Runtime) Blocks() []*Block {
+	return runtime.blocks
+}
+
+// Close stops every block's view following the edb
+func (runtime *Runtime) Close() {
+	for _, block := range runtime.blocks {
+		block.view.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+// Reloading
+//------------------------------------------------------------------------------
+
+// A Reload is what Runtime.Reload changed
+type Reload struct {
+	Added     []*Block
+	Removed   []*Block
+	Retracted int // facts taken out because the blocks that added them went
+}
+
+// Reload swaps the runtime's program for queries. Blocks that same matches
+// to a query carry on as they are, results and all; the rest of the old
+// blocks stop, and the facts they added go with them unless they were added
+// forever or another block added them too. Queries without a block get a new
+// one, which acts on whatever results it has as soon as Run is called.
+//
+// Nothing changes if the new program doesn't stratify or plan.
+func (runtime *Runtime) Reload(queries []*QueryNode, same func(*Block, *QueryNode) bool) (*Reload, error) {
+	var kept = make(map[*QueryNode]*Block)
+	var matched = make(map[*Block]bool)
+	for _, query := range queries {
+		for _, block := range runtime.blocks {
+			if !matched[block] && same(block, query) {
+				kept[query] = block
+				matched[block] = true
+				break
+			}
+		}
+	}
+	var program []*QueryNode
+	for _, query := range queries {
+		if block, ok := kept[query]; ok {
+			program = append(program, block.query)
+		} else {
+			program = append(program, query)
+		}
+	}
+	var strata, err = Stratify(program)
+	if err != nil {
+		return nil, err
+	}
+	var stratum = make(map[*QueryNode]int)
+	for ix, members := range strata {
+		for _, query := range members {
+			stratum[query] = ix
+		}
+	}
+	var reload = &Reload{}
+	var blocks []*Block
+	for _, query := range queries {
+		if block, ok := kept[query]; ok {
+			blocks = append(blocks, block)
+			continue
+		}
+		var plan, err = PlanQuery(query, &runtime.c.e, JoinAuto)
+		if err != nil {
+			return nil, err
+		}
+		var block = newBlock(query, plan)
+		reload.Added = append(reload.Added, block)
+		blocks = append(blocks, block)
+	}
+
+	var tx = runtime.c.Begin()
+	for _, block := range runtime.blocks {
+		if matched[block] {
+			continue
+		}
+		block.view.Close()
+		reload.Removed = append(reload.Removed, block)
+		for key, fact := range block.produced {
+			if runtime.forever[key] || ownedBy(key, blocks) {
+				continue
+			}
+			tx.Remove(fact[0], fact[1], fact[2])
+		}
+	}
+	runtime.blocks = blocks
+	for _, block := range runtime.blocks {
+		block.stratum = stratum[block.query]
+	}
+	commit, err := tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	reload.Retracted = len(commit.Changes)
+	for _, block := range reload.Added {
+		runtime.open(block)
+	}
+	return reload, nil
+}
+
+func ownedBy(key string, blocks []*Block) bool {
+	for _, block := range blocks {
+		if _, ok := block.produced[key]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// pathQueries are the two rules of transitive closure over "edge":
+// every edge is a path, and an edge followed by a path is a path
+func pathQueries() []*QueryNode {
+	var edge, path = value.NewText("edge"), value.NewText("path")
+	var rule = func(id string, second value.Value) *QueryNode {
+		var query = NewQuery(id)
+		query.name = id
+		for _, name := range []string{"a", "b", "c"} {
+			query.variables[name] = &VariableNode{id: name, name: name}
+		}
+		var triple = func(source SourceNode, from string, attribute value.Value, to string) []*BindingNode {
+			return []*BindingNode{
+				{id: from + "e", field: "entity", variable: query.variables[from], source: source},
+				{id: from + "a", field: "attribute", constant: attribute, source: source},
+				{id: from + "v", field: "value", variable: query.variables[to], source: source},
+			}
+		}
+		var first = &ScanNode{id: "s1"}
+		first.bindings = triple(first, "a", edge, "b")
+		query.scans[first.id] = first
+		var to = "b"
+		if second != nil {
+			var next = &ScanNode{id: "s2"}
+			next.bindings = triple(next, "b", second, "c")
+			query.scans[next.id] = next
+			to = "c"
+		}
+		var add = &MutateNode{id: "m1", operator: "add"}
+		add.bindings = triple(add, "a", path, to)
+		query.mutates[add.id] = add
+		return query
+	}
+	return []*QueryNode{rule("edges are paths", nil), rule("paths extend", path)}
+}
+
+func TestTransitiveClosure(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var edge, path = value.NewText("edge"), value.NewText("path")
+	var node = func(n int64) value.Value { return value.NewNumberFromInt(n) }
+	for i := int64(0); i < 5; i++ {
+		insert(c, node(i), edge, node(i+1))
+	}
+	var runtime, err = NewRuntime(c, pathQueries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var paths = 0
+	scan(c, nil, path, nil, func(e, a, v value.Value) { paths++ })
+	if paths != 15 {
+		t.Fatalf("expected 15 paths over a chain of 6 nodes, found %v", paths)
+	}
+
+	// closing the chain into a cycle connects everything
+	insert(c, node(5), edge, node(0))
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	paths = 0
+	scan(c, nil, path, nil, func(e, a, v value.Value) { paths++ })
+	if paths != 36 {
+		t.Fatalf("expected 36 paths around a cycle of 6 nodes, found %v", paths)
+	}
+}
+
+func TestIterationLimit(t *testing.T) {
+	// counting up forever: every number adds the next one
+	var query = NewQuery("count up")
+	query.name = "count up"
+	var n, next = &VariableNode{id: "n", name: "n"}, &VariableNode{id: "next", name: "next"}
+	query.variables["n"], query.variables["next"] = n, next
+	var number = value.NewText("number")
+	var s = &ScanNode{id: "s1"}
+	s.bindings = []*BindingNode{
+		{id: "se", field: "entity", constant: number, source: s},
+		{id: "sa", field: "attribute", constant: number, source: s},
+		{id: "sv", field: "value", variable: n, source: s},
+	}
+	query.scans[s.id] = s
+	var plus = &ExpressionNode{id: "e1", operator: "+"}
+	plus.bindings = []*BindingNode{
+		{id: "ea", field: "a", variable: n, source: plus},
+		{id: "eb", field: "b", constant: value.NewNumberFromInt(1), source: plus},
+		{id: "er", field: "return", variable: next, source: plus},
+	}
+	query.expressions[plus.id] = plus
+	var m = &MutateNode{id: "m1", operator: "add"}
+	m.bindings = []*BindingNode{
+		{id: "me", field: "entity", constant: number, source: m},
+		{id: "ma", field: "attribute", constant: number, source: m},
+		{id: "mv", field: "value", variable: next, source: m},
+	}
+	query.mutates[m.id] = m
+
+	var c = context{e: *NewEdb()}
+	insert(c, number, number, value.NewNumberFromInt(0))
+	var runtime, err = NewRuntime(c, []*QueryNode{query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Close()
+	runtime.MaxIterations = 10
+	var iterations, runErr = runtime.Run()
+	var fixpointErr, ok = runErr.(*FixpointError)
+	if !ok {
+		t.Fatalf("expected a FixpointError, got %v", runErr)
+	}
+	if iterations != 10 || len(fixpointErr.Blocks) != 1 || fixpointErr.Blocks[0].query != query {
+		t.Fatalf("expected 'count up' to be blamed after 10 iterations, got %v", runErr)
+	}
+}
+
+// unlinked marks nodes with an edge but no path back to themselves, which
+// has to wait for every path to be known
+func unlinked() *QueryNode {
+	var query = NewQuery("unlinked")
+	query.name = "unlinked"
+	var a = &VariableNode{id: "a", name: "a"}
+	query.variables["a"] = a
+	var s = &ScanNode{id: "s1"}
+	s.bindings = []*BindingNode{
+		{id: "se", field: "entity", variable: a, source: s},
+		{id: "sa", field: "attribute", constant: value.NewText("edge"), source: s},
+	}
+	query.scans[s.id] = s
+	var body = NewQuery("unlinked.not")
+	var back = &ScanNode{id: "s2"}
+	back.bindings = []*BindingNode{
+		{id: "be", field: "entity", variable: a, source: back},
+		{id: "ba", field: "attribute", constant: value.NewText("path"), source: back},
+		{id: "bv", field: "value", variable: a, source: back},
+	}
+	body.scans[back.id] = back
+	query.nots["n1"] = &NotNode{id: "n1", body: body}
+	var m = &MutateNode{id: "m1", operator: "add"}
+	m.bindings = []*BindingNode{
+		{id: "me", field: "$$ENTITY", variable: a, source: m},
+		{id: "mt", field: "tag", constant: value.NewText("unlinked"), source: m},
+	}
+	query.mutates[m.id] = m
+	return query
+}
+
+func TestStratify(t *testing.T) {
+	var paths = pathQueries()
+	var strata, err = Stratify(append(paths, unlinked()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strata) != 2 || len(strata[0]) != 2 || strata[1][0].id != "unlinked" {
+		t.Fatalf("expected the path rules to run before 'unlinked', got %v strata", len(strata))
+	}
+
+	// marking nodes that aren't marked yet depends on itself through the not
+	var guarded = unlinked()
+	guarded.nots["n1"].body.scans["s2"].bindings[1].constant = value.NewText("tag")
+	guarded.nots["n1"].body.scans["s2"].bindings[2] = &BindingNode{id: "bv", field: "value", constant: value.NewText("unlinked")}
+	_, err = Stratify([]*QueryNode{guarded})
+	if _, ok := err.(*StratificationError); !ok {
+		t.Fatalf("expected recursion through not to be rejected, got %v", err)
+	}
+}
+
+func TestRunUnlinked(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var edge = value.NewText("edge")
+	for _, pair := range [][2]int64{{0, 1}, {1, 0}, {2, 3}} {
+		insert(c, value.NewNumberFromInt(pair[0]), edge, value.NewNumberFromInt(pair[1]))
+	}
+	var runtime, err = NewRuntime(c, append(pathQueries(), unlinked()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Close()
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var marked = func() []string {
+		var result []string
+		scan(c, nil, value.NewText("tag"), value.NewText("unlinked"), func(e, a, v value.Value) {
+			result = append(result, e.String())
+		})
+		return result
+	}
+	if found := marked(); len(found) != 1 || found[0] != "2" {
+		t.Fatalf("expected only 2 to be unlinked, since 0 and 1 have a path back, got %v", found)
+	}
+
+	// a path back takes the mark away, since nothing supports it any more
+	var back = [3]value.Value{value.NewNumberFromInt(3), edge, value.NewNumberFromInt(2)}
+	insert(c, back[0], back[1], back[2])
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if found := marked(); len(found) != 0 {
+		t.Fatalf("expected nothing to be unlinked once 3 links back to 2, got %v", found)
+	}
+	remove(c, back[0], back[1], back[2])
+	if _, err := runtime.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if found := marked(); len(found) != 1 || found[0] != "2" {
+		t.Fatalf("expected 2 to be unlinked again, got %v", found)
+	}
+	var paths = 0
+	scan(c, nil, value.NewText("path"), nil, func(e, a, v value.Value) { paths++ })
+	if paths != 5 {
+		t.Fatalf("expected the paths through 3 -> 2 to be retracted, leaving 5, found %v", paths)
+	}
+}
+
+func TestTransactionCommitsAtomically(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var edge = value.NewText("edge")
+	var node = func(n int64) value.Value { return value.NewNumberFromInt(n) }
+	insert(c, node(0), edge, node(1))
+
+	// a commit listener sees the whole commit and nothing before it
+	var seen []Commit
+	var unlisten = c.e.OnCommit(func(commit Commit) {
+		var edges = 0
+		scan(c, nil, edge, nil, func(e, a, v value.Value) { edges++ })
+		if edges != 2 {
+			t.Errorf("commit %v: listener saw %v edges, expected 2", commit.Id, edges)
+		}
+		seen = append(seen, commit)
+	})
+	defer unlisten()
+
+	var tx = c.Begin()
+	tx.Insert(node(1), edge, node(2))
+	tx.Insert(node(2), edge, node(3))
+	tx.Remove(node(0), edge, node(1))
+	tx.Insert(node(0), edge, node(1)) // the last change to a fact wins
+	tx.Remove(node(2), edge, node(3))
+	if c.Contains(node(1), edge, node(2)) {
+		t.Fatal("uncommitted insert is visible")
+	}
+	var commit, err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (0, 1) was already there and (2, 3) was never added
+	if commit.Id != 1 || len(commit.Changes) != 1 || len(seen) != 1 {
+		t.Fatalf("expected commit 1 with one change, got %v", commit)
+	}
+	if _, err := tx.Commit(); err == nil {
+		t.Fatal("expected committing twice to fail")
+	}
+	var next, _ = c.Begin().Commit()
+	if next.Id != 2 || c.e.LastCommit() != 2 {
+		t.Fatalf("expected transaction ids to go up by one, got %v", next.Id)
+	}
+}
+
+func TestAsOfAndDiff(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var edge = value.NewText("edge")
+	var node = func(n int64) value.Value { return value.NewNumberFromInt(n) }
+	var commit = func(change func(tx *Transaction)) uint64 {
+		var tx = c.Begin()
+		change(tx)
+		var commit, err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commit.Id
+	}
+	var edges = func(c context) int {
+		var count = 0
+		scan(c, nil, edge, nil, func(e, a, v value.Value) { count++ })
+		return count
+	}
+	var first = commit(func(tx *Transaction) {
+		tx.Insert(node(0), edge, node(1))
+		tx.Insert(node(1), edge, node(2))
+	})
+	var second = commit(func(tx *Transaction) {
+		tx.Remove(node(0), edge, node(1))
+		tx.Insert(node(2), edge, node(3))
+	})
+	commit(func(tx *Transaction) { tx.Insert(node(0), edge, node(1)) })
+
+	if edges(c.AsOf(first)) != 2 || edges(c.AsOf(second)) != 2 || edges(c) != 3 {
+		t.Fatalf("expected 2, 2 and 3 edges, got %v, %v and %v", edges(c.AsOf(first)), edges(c.AsOf(second)), edges(c))
+	}
+	if !c.AsOf(first).Contains(node(0), edge, node(1)) || c.AsOf(second).Contains(node(0), edge, node(1)) {
+		t.Fatal("expected (0, 1) to be there after the first commit and gone after the second")
+	}
+	var added, removed = c.e.Diff(first, second)
+	if len(added) != 1 || len(removed) != 1 || !removed[0][0].Equals(node(0)) {
+		t.Fatalf("expected one fact added and (0, 1) removed, got %v and %v", added, removed)
+	}
+	added, removed = c.e.Diff(second, 0)
+	if len(added) != 1 || len(removed) != 0 {
+		t.Fatalf("expected (0, 1) back since the second commit, got %v and %v", added, removed)
+	}
+	if _, err := c.AsOf(first).Begin().Commit(); err == nil {
+		t.Fatal("expected committing to the past to fail")
+	}
+	var pointingAt = func(c context, n int64) int {
+		var count = 0
+		scan(c, nil, nil, node(n), func(e, a, v value.Value) { count++ })
+		return count
+	}
+	if pointingAt(c.AsOf(first), 1) != 1 || pointingAt(c.AsOf(second), 1) != 0 || pointingAt(c.AsOf(second), 3) != 1 {
+		t.Fatal("expected reading the past by value to find what pointed at each node then")
+	}
+
+	// forgetting what was gone by the second commit leaves it, and everything
+	// since, as it was
+	c.e.Forget(second)
+	if edges(c.AsOf(second)) != 2 || edges(c) != 3 || pointingAt(c.AsOf(second), 1) != 0 {
+		t.Fatalf("expected 2 and 3 edges after forgetting, got %v and %v", edges(c.AsOf(second)), edges(c))
+	}
+	if edges(c.AsOf(first)) != 1 {
+		t.Fatalf("expected the first commit to have lost (0, 1), got %v edges", edges(c.AsOf(first)))
+	}
+	added, removed = c.e.Diff(second, 0)
+	if len(added) != 1 || len(removed) != 0 {
+		t.Fatalf("expected (0, 1) back since the second commit, got %v and %v", added, removed)
+	}
+}
+
+func TestRunCounterExample(t *testing.T) {
+	var facts, diagnostics, err = RunProgram("examples/counter.e", nil)
+	if err != nil || HasErrors(diagnostics) {
+		t.Fatal(err, diagnostics)
+	}
+	var children, counters = 0, 0
+	for _, fact := range facts {
+		switch textOf(fact[1]) {
+		case "children":
+			children++
+		case "count":
+			if !fact[2].Equals(value.NewNumberFromInt(0)) {
+				t.Fatalf("expected the counter to start at 0, got %v", fact[2])
+			}
+			counters++
+		}
+	}
+	if children != 3 || counters != 1 {
+		t.Fatalf("expected one counter drawn with 3 children, got %v counters and %v children", counters, children)
+	}
+}
+
+func TestRunProgramInBags(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var write = func(name string, code string) string {
+		var path = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var program = write("greet.e", "greet\n  #person name\n  add\n    #greeting who: name\n")
+	var people = write("people.json", `[["p1", "tag", "person"], ["p1", "name", "Ada"]]`)
+
+	facts, diagnostics, err := RunProgram(program, []string{"session", "people=" + people})
+	if err != nil || HasErrors(diagnostics) {
+		t.Fatal(err, diagnostics)
+	}
+	var greeted = false
+	for _, fact := range facts {
+		if textOf(fact[1]) == "name" {
+			t.Fatalf("expected only the facts in the program's own bag, got %v", fact)
+		}
+		greeted = greeted || textOf(fact[1]) == "who" && textOf(fact[2]) == "Ada"
+	}
+	if !greeted {
+		t.Fatalf("expected Ada from the people bag to be greeted, got %v", facts)
+	}
+	if _, _, err := RunProgram(program, []string{"=" + people}); err == nil {
+		t.Fatal("expected a bag without a name to be an error")
+	}
+
+	// a block that counts what it adds to can't be stratified
+	var growing = write("grow.e", "grow\n  #person name\n  n = count(given: name)\n  add\n    #person name: n\n")
+	facts, diagnostics, err = RunProgram(growing, nil)
+	if err != nil || facts != nil || !HasErrors(diagnostics) || !strings.Contains(diagnostics[len(diagnostics)-1].msg, "aggregate") {
+		t.Fatalf("expected the recursion through count to be reported, got %v %v", diagnostics, err)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Dependencies
+//------------------------------------------------------------------------------
+
+// An access is the part of the edb a block reads or writes: one attribute, or
+// any attribute if it isn't known until the block runs. Tags are also keyed
+// by their value, since blocks nearly always look for one tag in particular.
+type access struct {
+	attribute string // "" for any attribute
+	tag       string // for attribute "tag", "" for any tag
+}
+
+func (a access) String() string {
+	switch {
+	case a.attribute == "":
+		return "any attribute"
+	case a.tag != "":
+		return "#" + a.tag
+	}
+	return "'" + a.attribute + "'"
+}
+
+func (a access) overlaps(b access) bool {
+	if a.attribute == "" || b.attribute == "" {
+		return true
+	}
+	if a.attribute != b.attribute {
+		return false
+	}
+	return a.tag == "" || b.tag == "" || a.tag == b.tag
+}
+
+type dependencyKind int
+
+const (
+	dependsPositively dependencyKind = iota
+	dependsThroughNot
+	dependsThroughAggregate
+)
+
+// a dependency is reader reading something writer writes
+type dependency struct {
+	writer *QueryNode
+	reader *QueryNode
+	access access
+	kind   dependencyKind
+}
+
+func (d *dependency) String() string {
+	return d.reader.label() + " reads " + d.access.String() + ", which " + d.writer.label() + " writes"
+}
+
+// accesses works out what a scan or mutate touches from its bindings, the
+// same way patterns and effects break them into triples
+func accesses(bindings []*BindingNode) []access {
+	var attribute, tag, isTriple = "", "", true
+	var result []access
+	for _, binding := range bindings {
+		switch binding.field {
+		case "entity", "$$ENTITY":
+		case "attribute":
+			if binding.IsConstant() {
+				attribute = textOf(binding.constant)
+			}
+		case "value":
+			if binding.IsConstant() {
+				tag = textOf(binding.constant)
+			}
+		default:
+			isTriple = false
+			var a = access{attribute: binding.field}
+			if binding.field == "tag" && binding.IsConstant() {
+				a.tag = textOf(binding.constant)
+			}
+			result = append(result, a)
+		}
+	}
+	if !isTriple {
+		return result
+	}
+	if attribute != "tag" {
+		tag = ""
+	}
+	return []access{{attribute, tag}}
+}
+
+// reads collects what a query reads, with nots and unions and chooses
+// included. Everything read by a query with an aggregate feeds the aggregate.
+func reads(query *QueryNode, kind dependencyKind, f func(a access, kind dependencyKind)) {
+	if kind == dependsPositively {
+		for _, expression := range query.expressions {
+			if expression.IsAggregate() {
+				kind = dependsThroughAggregate
+			}
+		}
+	}
+	for _, scan := range query.scans {
+		for _, a := range accesses(scan.bindings) {
+			f(a, kind)
+		}
+	}
+	for _, not := range query.nots {
+		reads(not.body, dependsThroughNot, f)
+	}
+	for _, union := range query.unions {
+		for _, member := range union.members {
+			reads(member, kind, f)
+		}
+	}
+	for _, choose := range query.chooses {
+		for _, member := range choose.members {
+			reads(member, kind, f)
+		}
+	}
+}
+
+func writes(query *QueryNode) []access {
+	var result []access
+	for _, mutate := range query.mutates {
+		result = append(result, accesses(mutate.bindings)...)
+	}
+	return result
+}
+
+// dependencies finds every (writer, reader) pair, keeping the worst kind
+// when a reader depends on a writer more than one way
+func dependencies(queries []*QueryNode) map[*QueryNode][]*dependency {
+	var writers = make(map[*QueryNode][]access)
+	for _, query := range queries {
+		writers[query] = writes(query)
+	}
+	var result = make(map[*QueryNode][]*dependency)
+	for _, reader := range queries {
+		var found = make(map[*QueryNode]*dependency)
+		reads(reader, dependsPositively, func(read access, kind dependencyKind) {
+			for _, writer := range queries {
+				for _, write := range writers[writer] {
+					if !read.overlaps(write) {
+						continue
+					}
+					if existing, ok := found[writer]; !ok || kind > existing.kind {
+						found[writer] = &dependency{writer, reader, read, kind}
+					}
+				}
+			}
+		})
+		for _, writer := range queries {
+			if d, ok := found[writer]; ok {
+				result[writer] = append(result[writer], d)
+			}
+		}
+	}
+	return result
+}
+
+//------------------------------------------------------------------------------
+// Stratification
+//------------------------------------------------------------------------------
+
+// StratificationError is a cycle of blocks that feed each other through a
+// not or an aggregate, which has no single right answer.
+type StratificationError struct {
+	Cycle []*dependency
+}
+
+func (err *StratificationError) Error() string {
+	var through = "not"
+	for _, d := range err.Cycle {
+		if d.kind == dependsThroughAggregate {
+			through = "an aggregate"
+		}
+	}
+	var steps []string
+	for _, d := range err.Cycle {
+		steps = append(steps, d.String())
+	}
+	return "recursion through " + through + ": " + strings.Join(steps, "; ")
+}
+
+// Diagnostic reports the error against the block the cycle starts at
+func (err *StratificationError) Diagnostic() Diagnostic {
+	var first = err.Cycle[0].reader
+	return Diagnostic{SeverityError, first.line, first.id, err.Error()}
+}
+
+// Stratify orders queries into strata: every query that reads what another
+// writes is in the same stratum or a later one, and strictly later if it
+// reads it through a not or an aggregate, so each stratum can run to a
+// fixpoint knowing that everything it negates or aggregates over is done.
+// Queries keep their program order within a stratum.
+func Stratify(queries []*QueryNode) ([][]*QueryNode, error) {
+	var edges = dependencies(queries)
+	var components = stronglyConnected(queries, edges)
+
+	var component = make(map[*QueryNode]int)
+	for ix, members := range components {
+		for _, query := range members {
+			component[query] = ix
+		}
+	}
+	for _, members := range components {
+		for _, writer := range members {
+			for _, d := range edges[writer] {
+				if d.kind != dependsPositively && component[d.reader] == component[writer] {
+					return nil, &StratificationError{cycle(d, edges, component)}
+				}
+			}
+		}
+	}
+
+	// components come out of stronglyConnected with writers before readers
+	var stratum = make([]int, len(components))
+	var deepest = 0
+	for ix, members := range components {
+		for _, writer := range members {
+			for _, d := range edges[writer] {
+				var to = component[d.reader]
+				if to == ix {
+					continue
+				}
+				var needed = stratum[ix]
+				if d.kind != dependsPositively {
+					needed++
+				}
+				if needed > stratum[to] {
+					stratum[to] = needed
+				}
+				if stratum[to] > deepest {
+					deepest = stratum[to]
+				}
+			}
+		}
+	}
+	var strata = make([][]*QueryNode, deepest+1)
+	for _, query := range queries {
+		var s = stratum[component[query]]
+		strata[s] = append(strata[s], query)
+	}
+	return strata, nil
+}
+
+// stronglyConnected is Tarjan's algorithm. It returns components in
+// topological order, so every dependency goes from an earlier component to a
+// later one or stays inside a component.
+func stronglyConnected(queries []*QueryNode, edges map[*QueryNode][]*dependency) [][]*QueryNode {
+	var index = make(map[*QueryNode]int)
+	var lowlink = make(map[*QueryNode]int)
+	var onStack = make(map[*QueryNode]bool)
+	var stack []*QueryNode
+	var components [][]*QueryNode
+	var next = 0
+	var connect func(query *QueryNode)
+	connect = func(query *QueryNode) {
+		index[query], lowlink[query] = next, next
+		next++
+		stack = append(stack, query)
+		onStack[query] = true
+		for _, d := range edges[query] {
+			if _, visited := index[d.reader]; !visited {
+				connect(d.reader)
+				if lowlink[d.reader] < lowlink[query] {
+					lowlink[query] = lowlink[d.reader]
+				}
+			} else if onStack[d.reader] && index[d.reader] < lowlink[query] {
+				lowlink[query] = index[d.reader]
+			}
+		}
+		if lowlink[query] == index[query] {
+			var members []*QueryNode
+			for {
+				var top = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				members = append(members, top)
+				if top == query {
+					break
+				}
+			}
+			components = append(components, members)
+		}
+	}
+	for _, query := range queries {
+		if _, visited := index[query]; !visited {
+			connect(query)
+		}
+	}
+	// Tarjan finishes readers before writers, so flip it
+	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
+		components[i], components[j] = components[j], components[i]
+	}
+	return components
+}
+
+// cycle finds the way back from bad's reader to its writer, so the error can
+// show the whole loop starting with the offending dependency
+func cycle(bad *dependency, edges map[*QueryNode][]*dependency, component map[*QueryNode]int) []*dependency {
+	var via = map[*QueryNode]*dependency{bad.reader: nil}
+	var queue = []*QueryNode{bad.reader}
+	for len(queue) > 0 && via[bad.writer] == nil && bad.writer != bad.reader {
+		var query = queue[0]
+		queue = queue[1:]
+		for _, d := range edges[query] {
+			if _, seen := via[d.reader]; seen || component[d.reader] != component[bad.writer] {
+				continue
+			}
+			via[d.reader] = d
+			queue = append(queue, d.reader)
+		}
+	}
+	var path = []*dependency{bad}
+	for at := bad.writer; at != bad.reader; at = via[at].writer {
+		path = append(path, via[at])
+	}
+	return path
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+// Line editing
+//------------------------------------------------------------------------------
+
+// A lineReader reads lines for the REPL. On a terminal it edits them itself,
+// with up and down for history and tab for completion; anywhere else it just
+// reads lines.
+type lineReader struct {
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+	restore  string // stty settings to put back
+}
+
+var errInterrupted = errors.New("interrupted")
+
+func newLineReader(in *os.File, out io.Writer) *lineReader {
+	var reader = &lineReader{in: bufio.NewReader(in), out: out}
+	if info, err := in.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		reader.terminal = true
+	}
+	return reader
+}
+
+func stty(args ...string) (string, error) {
+	var cmd = exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	var out, err = cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// raw puts the terminal into character-at-a-time mode, falling back on
+// plain lines if it can't
+func (reader *lineReader) raw() {
+	var saved, err = stty("-g")
+	if err == nil {
+		_, err = stty("raw", "-echo")
+	}
+	if err != nil {
+		reader.terminal = false
+		return
+	}
+	reader.restore = saved
+}
+
+func (reader *lineReader) cooked() {
+	if reader.restore != "" {
+		stty(reader.restore)
+		reader.restore = ""
+	}
+}
+
+// ReadLine reads a line, returning io.EOF at the end of input
+func (reader *lineReader) ReadLine(prompt string, history []string, complete func(string) []string) (string, error) {
+	if reader.terminal {
+		reader.raw()
+	}
+	if !reader.terminal {
+		io.WriteString(reader.out, prompt)
+		var line, err = reader.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer reader.cooked()
+
+	var buffer []rune
+	var position = len(history) // where in history up and down are
+	var draft []rune            // what was typed before going up
+	var redraw = func() {
+		io.WriteString(reader.out, "\r\033[K"+prompt+string(buffer))
+	}
+	redraw()
+	for {
+		var r, _, err = reader.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			io.WriteString(reader.out, "\r\n")
+			return string(buffer), nil
+		case 3: // ctrl-c
+			io.WriteString(reader.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // ctrl-d
+			if len(buffer) == 0 {
+				io.WriteString(reader.out, "\r\n")
+				return "", io.EOF
+			}
+		case 127, 8: // backspace
+			if len(buffer) > 0 {
+				buffer = buffer[:len(buffer)-1]
+			}
+		case '\t':
+			buffer = reader.complete(buffer, complete)
+		case 27: // escape sequences: up and down arrows
+			if next, _, _ := reader.in.ReadRune(); next != '[' {
+				continue
+			}
+			var key, _, _ = reader.in.ReadRune()
+			if key == 'A' && position > 0 {
+				if position == len(history) {
+					draft = buffer
+				}
+				position--
+				buffer = []rune(history[position])
+			} else if key == 'B' && position < len(history) {
+				position++
+				if position == len(history) {
+					buffer = draft
+				} else {
+					buffer = []rune(history[position])
+				}
+			}
+		default:
+			if r >= ' ' {
+				buffer = append(buffer, r)
+			}
+		}
+		redraw()
+	}
+}
+
+// complete fills in the last word as far as every candidate agrees, and
+// lists the candidates when there's more than one
+func (reader *lineReader) complete(buffer []rune, complete func(string) []string) []rune {
+	var line = string(buffer)
+	var candidates = complete(line)
+	if len(candidates) == 0 {
+		return buffer
+	}
+	var common = candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	var start = strings.LastIndexAny(line, " \t,:") + 1
+	if len(candidates) > 1 {
+		io.WriteString(reader.out, "\r\n"+strings.Join(candidates, "  ")+"\r\n")
+	}
+	if len(common) > len(line)-start {
+		line = line[:start] + common
+	}
+	return []rune(line)
+}
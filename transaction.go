@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"github.com/witheve/evingo/value"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// Transactions
+//------------------------------------------------------------------------------
+
+// A Transaction collects inserts and removes against one bag and applies them
+// all at once when it commits. Nothing outside the transaction sees any of
+// its changes until then, and readers going through Read never see some of
+// them without the rest.
+type Transaction struct {
+	c       context
+	changes []Change
+	index   map[string]int // fact key to its change, so the last one wins
+	done    bool
+}
+
+// A Change is one fact a transaction adds (OpInsert) or removes (OpRemove)
+type Change struct {
+	Op   value.Operator
+	Fact [3]value.Value
+}
+
+// A Commit is what a transaction did: its id and the changes that took
+// effect, leaving out inserts of facts that were already there and removes of
+// facts that weren't.
+type Commit struct {
+	Id      uint64
+	Changes []Change
+}
+
+// A CommitListener hears about each commit after it's complete
+type CommitListener func(commit Commit)
+
+// commits serialises an edb's transactions. Fact listeners run while the lock
+// is held, which is how views stay in step with the edb; commit listeners run
+// once it's released.
+type commits struct {
+	lock      sync.RWMutex
+	last      uint64
+	applying  bool // a commit holds the lock, so fact listeners should wait for it
+	listeners *commitListeners
+}
+
+type commitListeners struct {
+	lock sync.Mutex
+	fs   map[*CommitListener]struct{}
+}
+
+var errTransactionDone = errors.New("transaction has already been committed or aborted")
+var errCommitToPast = errors.New("can't commit to a context read as of an earlier commit")
+
+// Begin starts a transaction against c's bag
+func (c context) Begin() *Transaction {
+	return &Transaction{c: c, index: make(map[string]int)}
+}
+
+func (tx *Transaction) change(op value.Operator, e, a, v value.Value) {
+	var fact = [3]value.Value{e, a, v}
+	var key = rowString(fact[:])
+	if ix, ok := tx.index[key]; ok {
+		tx.changes[ix].Op = op
+		return
+	}
+	tx.index[key] = len(tx.changes)
+	tx.changes = append(tx.changes, Change{op, fact})
+}
+
+// Insert adds a fact when the transaction commits
+func (tx *Transaction) Insert(e, a, v value.Value) {
+	tx.change(value.OpInsert, e, a, v)
+}
+
+// Remove takes a fact out when the transaction commits
+func (tx *Transaction) Remove(e, a, v value.Value) {
+	tx.change(value.OpRemove, e, a, v)
+}
+
+// Abort throws the transaction's changes away
+func (tx *Transaction) Abort() {
+	tx.done = true
+	tx.changes = nil
+}
+
+// Commit applies the transaction's changes in the order they were made and
+// returns what it did. Transaction ids go up by one with every commit to the
+// bag, including ones that turn out to change nothing.
+func (tx *Transaction) Commit() (Commit, error) {
+	if tx.done {
+		return Commit{}, errTransactionDone
+	}
+	tx.done = true
+	if tx.c.asOf != 0 {
+		return Commit{}, errCommitToPast
+	}
+	var db = &tx.c.e
+	db.commits.lock.Lock()
+	db.commits.applying = true
+	var commit = Commit{}
+	for _, change := range tx.changes {
+		var f = change.Fact
+		var changed bool
+		if change.Op == value.OpRemove {
+			changed = remove(tx.c, f[0], f[1], f[2])
+		} else {
+			changed = insert(tx.c, f[0], f[1], f[2])
+		}
+		if changed {
+			commit.Changes = append(commit.Changes, change)
+		}
+	}
+	db.commits.last++
+	commit.Id = db.commits.last
+	db.commits.applying = false
+	db.commits.lock.Unlock()
+
+	var listeners = db.commits.listeners
+	listeners.lock.Lock()
+	var fs []CommitListener
+	for f := range listeners.fs {
+		fs = append(fs, *f)
+	}
+	listeners.lock.Unlock()
+	for _, f := range fs {
+		f(commit)
+	}
+	return commit, nil
+}
+
+// OnCommit calls f after every commit from now on, until the returned
+// function is called
+func (db *edb) OnCommit(f CommitListener) func() {
+	var key = &f
+	var listeners = db.commits.listeners
+	listeners.lock.Lock()
+	listeners.fs[key] = struct{}{}
+	listeners.lock.Unlock()
+	return func() {
+		listeners.lock.Lock()
+		delete(listeners.fs, key)
+		listeners.lock.Unlock()
+	}
+}
+
+// LastCommit is the id of the most recent commit, 0 if there hasn't been one
+func (db *edb) LastCommit() uint64 {
+	db.commits.lock.RLock()
+	defer db.commits.lock.RUnlock()
+	return db.commits.last
+}
+
+// Read runs f while no transaction is committing, so everything f scans
+// comes from the same commit. f mustn't commit a transaction itself.
+func (c context) Read(f func()) {
+	c.e.commits.lock.RLock()
+	defer c.e.commits.lock.RUnlock()
+	f()
+}
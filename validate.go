@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+//------------------------------------------------------------------------------
+// Diagnostics
+//------------------------------------------------------------------------------
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+type Diagnostic struct {
+	severity Severity
+	line     int    // 0 when the offending node has no source position
+	node     string // id of the offending node
+	msg      string
+}
+
+func (d Diagnostic) String() string {
+	var result = ""
+	if d.line > 0 {
+		result += "line " + strconv.Itoa(d.line) + ": "
+	}
+	result += string(d.severity) + ": " + d.msg
+	if d.line == 0 {
+		result += " ('" + d.node + "')"
+	}
+	return result
+}
+
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type byPosition []Diagnostic
+
+func (ds byPosition) Len() int      { return len(ds) }
+func (ds byPosition) Swap(i, j int) { ds[i], ds[j] = ds[j], ds[i] }
+func (ds byPosition) Less(i, j int) bool {
+	if ds[i].line != ds[j].line {
+		return ds[i].line < ds[j].line
+	}
+	if ds[i].node != ds[j].node {
+		return ds[i].node < ds[j].node
+	}
+	return ds[i].msg < ds[j].msg
+}
+
+//------------------------------------------------------------------------------
+// Validation
+//------------------------------------------------------------------------------
+
+type validator struct {
+	diagnostics []Diagnostic
+}
+
+func (v *validator) report(severity Severity, line int, node string, msg string) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{severity, line, node, msg})
+}
+
+// firstLine picks the first known position out of its arguments, so a
+// diagnostic can fall back from a binding to its source to its query
+func firstLine(lines ...int) int {
+	for _, line := range lines {
+		if line > 0 {
+			return line
+		}
+	}
+	return 0
+}
+
+// Validate checks a query for problems the loader can't see: variables that
+// are read but never bound, operators we don't know about, malformed
+// groupings, and so on. It never modifies the query.
+func (query *QueryNode) Validate() []Diagnostic {
+	var v = &validator{}
+	v.query(query, make(map[string]bool))
+	sort.Sort(byPosition(v.diagnostics))
+	return v.diagnostics
+}
+
+// boundVariables collects the variables that a query itself can produce
+// values for: anything a scan binds, or that an expression outputs.
+func boundVariables(query *QueryNode) map[*VariableNode]bool {
+	var bound = make(map[*VariableNode]bool)
+	for _, scan := range query.scans {
+		for _, binding := range scan.bindings {
+			if !binding.IsConstant() {
+				bound[binding.variable] = true
+			}
+		}
+	}
+	for _, expression := range query.expressions {
+		var signature, ok = expression.Signature()
+		if !ok {
+			continue
+		}
+		for _, binding := range expression.bindings {
+			if !binding.IsConstant() && signature.IsOutput(binding.field) {
+				bound[binding.variable] = true
+			}
+		}
+	}
+	return bound
+}
+
+// outer holds the names of variables bound by enclosing queries, which is how
+// the bodies of nots, unions and chooses see their parent's variables.
+func (v *validator) query(query *QueryNode, outer map[string]bool) {
+	var bound = boundVariables(query)
+	var isBound = func(variable *VariableNode) bool {
+		return bound[variable] || outer[variable.name]
+	}
+	var inner = make(map[string]bool)
+	for name := range outer {
+		inner[name] = true
+	}
+	for variable := range bound {
+		inner[variable.name] = true
+	}
+
+	for _, variable := range query.variables {
+		if len(variable.bindings) == 0 {
+			v.report(SeverityWarning, firstLine(variable.line, query.line), variable.id, "variable '"+variable.name+"' is never used")
+		}
+	}
+
+	for _, expression := range query.expressions {
+		var line = firstLine(expression.line, query.line)
+		var signature, ok = expression.Signature()
+		if !ok {
+			v.report(SeverityError, line, expression.id, "unknown operator '"+expression.operator+"'")
+			continue
+		}
+		var seen = make(map[string]bool)
+		for _, binding := range expression.bindings {
+			var bindingLine = firstLine(binding.line, line)
+			if !signature.HasField(binding.field) {
+				v.report(SeverityError, bindingLine, binding.id, "operator '"+expression.operator+"' has no field '"+binding.field+"'")
+				continue
+			}
+			seen[signature.Canonical(binding.field)] = true
+			if !binding.IsConstant() && !signature.IsOutput(binding.field) && !isBound(binding.variable) {
+				v.report(SeverityError, bindingLine, binding.id, "variable '"+binding.variable.name+"' is used by '"+expression.operator+"' but never bound")
+			}
+		}
+		for _, input := range signature.Inputs {
+			if !seen[input] {
+				v.report(SeverityError, line, expression.id, "operator '"+expression.operator+"' is missing its '"+input+"' argument")
+			}
+		}
+		for _, variable := range expression.projection {
+			if !isBound(variable) {
+				v.report(SeverityError, line, expression.id, "projection variable '"+variable.name+"' is never bound")
+			}
+		}
+		for ix, variable := range expression.grouping {
+			if variable == nil {
+				v.report(SeverityError, line, expression.id, "grouping has a gap at ix "+strconv.Itoa(ix))
+			} else if !isBound(variable) {
+				v.report(SeverityError, line, expression.id, "grouping variable '"+variable.name+"' is never bound")
+			}
+		}
+	}
+
+	// entities mutates make up can be the values of other mutates, which is
+	// how nested objects get attached to their parents
+	var generated = make(map[*VariableNode]bool)
+	for _, mutate := range query.mutates {
+		for _, binding := range mutate.bindings {
+			if binding.field == "entity" && !binding.IsConstant() && !isBound(binding.variable) {
+				generated[binding.variable] = true
+			}
+		}
+	}
+	for _, mutate := range query.mutates {
+		var line = firstLine(mutate.line, query.line)
+		switch mutate.operator {
+		case "add", "remove", "update":
+		default:
+			v.report(SeverityError, line, mutate.id, "unknown mutate operator '"+mutate.operator+"'")
+		}
+		for _, binding := range mutate.bindings {
+			// an unbound entity is how a mutate asks for a fresh entity
+			if binding.IsConstant() || binding.field == "entity" || isBound(binding.variable) || generated[binding.variable] {
+				continue
+			}
+			v.report(SeverityError, firstLine(binding.line, line), binding.id, "variable '"+binding.variable.name+"' is mutated but never bound")
+		}
+	}
+
+	var negated = make(map[string]bool)
+	for _, not := range query.nots {
+		v.query(not.body, inner)
+		for _, variable := range not.body.variables {
+			negated[variable.name] = true
+		}
+	}
+	for _, variable := range query.variables {
+		if !isBound(variable) && negated[variable.name] {
+			v.report(SeverityError, firstLine(variable.line, query.line), variable.id, "variable '"+variable.name+"' is only bound inside a negation")
+		}
+	}
+
+	for _, union := range query.unions {
+		for _, member := range union.members {
+			v.query(member, inner)
+		}
+	}
+	for _, choose := range query.chooses {
+		for _, member := range choose.members {
+			v.query(member, inner)
+		}
+	}
+}
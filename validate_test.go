@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/witheve/evingo/parser"
+	"github.com/witheve/evingo/value"
+	"path/filepath"
+	"testing"
+)
+
+// testQuery builds queries for tests a node at a time. A string term is a
+// variable of that name, made on first use; anything else is a constant.
+type testQuery struct {
+	*QueryNode
+	bindings int
+}
+
+func newTestQuery(id string) *testQuery {
+	return &testQuery{QueryNode: NewQuery(id)}
+}
+
+func (q *testQuery) variable(name string) *VariableNode {
+	if variable, ok := q.variables[name]; ok {
+		return variable
+	}
+	var variable = &VariableNode{id: name, name: name}
+	q.variables[name] = variable
+	return variable
+}
+
+func (q *testQuery) bind(source SourceNode, terms ...interface{}) {
+	for ix := 0; ix < len(terms); ix += 2 {
+		q.bindings++
+		var binding = &BindingNode{id: "b" + value.NewNumberFromInt(int64(q.bindings)).String(), field: terms[ix].(string), source: source}
+		if name, ok := terms[ix+1].(string); ok {
+			binding.variable = q.variable(name)
+			binding.variable.bindings = append(binding.variable.bindings, binding)
+		} else {
+			binding.constant = terms[ix+1].(value.Value)
+		}
+		var bindings = source.Bindings()
+		*bindings = append(*bindings, binding)
+	}
+}
+
+func (q *testQuery) scan(id string, terms ...interface{}) *ScanNode {
+	var scan = &ScanNode{id: id}
+	q.scans[id] = scan
+	q.bind(scan, terms...)
+	return scan
+}
+
+func (q *testQuery) expression(id string, operator string, terms ...interface{}) *ExpressionNode {
+	var expression = &ExpressionNode{id: id, operator: operator}
+	q.expressions[id] = expression
+	q.bind(expression, terms...)
+	return expression
+}
+
+func (q *testQuery) mutate(id string, operator string, terms ...interface{}) *MutateNode {
+	var mutate = &MutateNode{id: id, operator: operator}
+	q.mutates[id] = mutate
+	q.bind(mutate, terms...)
+	return mutate
+}
+
+func (q *testQuery) not(id string, body *testQuery) {
+	q.nots[id] = &NotNode{id: id, body: body.QueryNode}
+}
+
+func TestValidate(t *testing.T) {
+	var text = func(s string) value.Value { return value.NewText(s) }
+	var one = value.NewNumberFromInt(1)
+	for _, test := range []struct {
+		name     string
+		build    func(q *testQuery)
+		expected []string
+	}{
+		{"a valid query", func(q *testQuery) {
+			q.scan("s1", "entity", "p", "attribute", text("age"), "value", "age")
+			q.expression("e1", "+", "a", "age", "b", one, "return", "older")
+			q.mutate("m1", "add", "entity", "p", "attribute", text("older"), "value", "older")
+		}, nil},
+		{"an unused variable", func(q *testQuery) {
+			q.variable("lonely")
+		}, []string{"warning: variable 'lonely' is never used ('lonely')"}},
+		{"an unknown operator", func(q *testQuery) {
+			q.expression("e1", "frobnicate", "a", one)
+		}, []string{"error: unknown operator 'frobnicate' ('e1')"}},
+		{"a field the operator doesn't have", func(q *testQuery) {
+			q.expression("e1", "+", "a", one, "b", one, "c", one)
+		}, []string{"error: operator '+' has no field 'c' ('b3')"}},
+		{"an input nothing binds", func(q *testQuery) {
+			q.expression("e1", "+", "a", "x", "b", one, "return", "y")
+		}, []string{"error: variable 'x' is used by '+' but never bound ('b1')"}},
+		{"a missing argument", func(q *testQuery) {
+			q.expression("e1", "+", "a", one, "return", "y")
+		}, []string{"error: operator '+' is missing its 'b' argument ('e1')"}},
+		{"an aggregate without its value", func(q *testQuery) {
+			q.scan("s1", "entity", "x", "attribute", text("tag"), "value", text("person"))
+			var sum = q.expression("e1", "sum", "return", "n")
+			sum.projection = []*VariableNode{q.variable("x")}
+		}, []string{"error: operator 'sum' is missing its 'value' argument ('e1')"}},
+		{"an unbound projection and grouping", func(q *testQuery) {
+			var count = q.expression("e1", "count", "return", "n")
+			count.projection = []*VariableNode{q.variable("x")}
+			count.grouping = []*VariableNode{nil, q.variable("g")}
+		}, []string{
+			"error: grouping has a gap at ix 0 ('e1')",
+			"error: grouping variable 'g' is never bound ('e1')",
+			"error: projection variable 'x' is never bound ('e1')",
+			"warning: variable 'g' is never used ('g')",
+			"warning: variable 'x' is never used ('x')",
+		}},
+		{"an unknown mutate operator", func(q *testQuery) {
+			q.mutate("m1", "frobnicate", "entity", text("e"), "attribute", text("a"), "value", one)
+		}, []string{"error: unknown mutate operator 'frobnicate' ('m1')"}},
+		{"a mutated value nothing binds", func(q *testQuery) {
+			q.mutate("m1", "add", "entity", "fresh", "attribute", text("a"), "value", "x")
+		}, []string{"error: variable 'x' is mutated but never bound ('b3')"}},
+		{"a nested entity a mutate makes", func(q *testQuery) {
+			q.mutate("m1", "add", "entity", "parent", "attribute", text("child"), "value", "child")
+			q.mutate("m2", "add", "entity", "child", "attribute", text("a"), "value", one)
+		}, nil},
+		{"a variable only a not binds", func(q *testQuery) {
+			q.scan("s1", "entity", "p", "attribute", text("tag"), "value", text("person"))
+			var body = newTestQuery("body")
+			body.scan("s2", "entity", "p", "attribute", text("pet"), "value", "pet")
+			q.not("n1", body)
+			q.mutate("m1", "add", "entity", "p", "attribute", text("pet"), "value", "pet")
+		}, []string{
+			"error: variable 'pet' is mutated but never bound ('b6')",
+			"error: variable 'pet' is only bound inside a negation ('pet')",
+		}},
+		{"a problem inside a not", func(q *testQuery) {
+			q.scan("s1", "entity", "p", "attribute", text("tag"), "value", text("person"))
+			var body = newTestQuery("body")
+			body.expression("e1", "+", "a", "p", "b", "nothing", "return", "r")
+			q.not("n1", body)
+		}, []string{"error: variable 'nothing' is used by '+' but never bound ('b2')"}},
+	} {
+		var q = newTestQuery("q1")
+		test.build(q)
+		var diagnostics = q.Validate()
+		var got []string
+		for _, diagnostic := range diagnostics {
+			got = append(got, diagnostic.String())
+		}
+		if len(got) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+			continue
+		}
+		for ix := range got {
+			if got[ix] != test.expected[ix] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+				break
+			}
+		}
+	}
+}
+
+func TestFactsFromProgramExamples(t *testing.T) {
+	// the examples that have mistakes in them
+	var mistakes = map[string]bool{"examples/chat.e": true, "examples/clock.e": true, "examples/numbers.e": true}
+	paths, _ := filepath.Glob("examples/*.e")
+	if len(paths) == 0 {
+		t.Fatal("expected some examples")
+	}
+	for _, path := range paths {
+		program, err := parser.ParseFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		facts, err := FactsFromProgram(program)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		queries, err := queriesFromFacts(facts)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if len(queries) == 0 {
+			t.Errorf("%s: expected some queries", path)
+		}
+		var diagnostics []Diagnostic
+		for _, parseError := range program.Errors {
+			diagnostics = append(diagnostics, Diagnostic{SeverityError, parseError.Line, path, parseError.Message})
+		}
+		for _, query := range queries {
+			if query.line == 0 {
+				t.Errorf("%s: expected '%s' to know its line", path, query.name)
+			}
+			diagnostics = append(diagnostics, query.Validate()...)
+		}
+		if HasErrors(diagnostics) != mistakes[path] {
+			t.Errorf("%s: unexpected diagnostics %v", path, diagnostics)
+		}
+	}
+
+	program := parser.ParseString("people\n  #person name\n")
+	facts, err := FactsFromProgram(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := queriesFromFacts(facts)
+	if err != nil || len(queries) != 1 {
+		t.Fatalf("expected one query, got %v %v", queries, err)
+	}
+	var query = queries[0]
+	if query.name != "people" || query.line != 1 || len(query.scans) != 2 || len(query.variables) != 2 {
+		t.Fatalf("expected a scan each for the tag and name of a person, got %v", query)
+	}
+}
@@ -0,0 +1,362 @@
+package value
+
+import (
+	"errors"
+	"github.com/witheve/evingo/decimal"
+	"strings"
+)
+
+// Aggregate accumulates the values of one group. Values come and go as rows
+// are inserted and removed, so every aggregate has to be able to take a
+// value back out. Result is nil for an aggregate that has nothing in it.
+type Aggregate interface {
+	Add(v Value) error
+	Remove(v Value) error
+	Result() Value
+}
+
+var aggregates = map[string]func() Aggregate{
+	"count": func() Aggregate { return &countAggregate{} },
+	"sum":   func() Aggregate { return &sumAggregate{} },
+	"avg":   func() Aggregate { return &avgAggregate{} },
+	"min":   func() Aggregate { return newExtremumAggregate(-1) },
+	"max":   func() Aggregate { return newExtremumAggregate(1) },
+}
+
+var aggregateSignatures = map[string]*Signature{
+	"count": {Outputs: []string{"return"}},
+	"sum":   reducing,
+	"avg":   reducing,
+	"min":   reducing,
+	"max":   reducing,
+}
+
+// IsAggregate reports whether operator folds many rows into one. min and max
+// are also functions of two arguments; see LookupAggregate.
+func IsAggregate(operator string) bool {
+	_, ok := aggregates[operator]
+	return ok
+}
+
+// LookupAggregate finds the signature of an aggregate
+func LookupAggregate(operator string) (*Signature, bool) {
+	var s, ok = aggregateSignatures[operator]
+	return s, ok
+}
+
+func asNumber(v Value) (decimal.Decimal, error) {
+	n, ok := v.(*Number)
+	if !ok {
+		if v == nil {
+			return decimal.Zero, errors.New("expected a number, got nothing")
+		}
+		return decimal.Zero, errors.New("expected a number, got " + v.String())
+	}
+	return n.d, nil
+}
+
+type countAggregate struct {
+	count int64
+}
+
+func (a *countAggregate) Add(v Value) error {
+	a.count++
+	return nil
+}
+
+func (a *countAggregate) Remove(v Value) error {
+	a.count--
+	return nil
+}
+
+func (a *countAggregate) Result() Value {
+	if a.count == 0 {
+		return nil
+	}
+	return NewNumberFromInt(a.count)
+}
+
+type sumAggregate struct {
+	count int64
+	sum   decimal.Decimal
+}
+
+func (a *sumAggregate) Add(v Value) error {
+	d, err := asNumber(v)
+	if err != nil {
+		return err
+	}
+	a.count++
+	a.sum = a.sum.Add(d)
+	return nil
+}
+
+func (a *sumAggregate) Remove(v Value) error {
+	d, err := asNumber(v)
+	if err != nil {
+		return err
+	}
+	a.count--
+	a.sum = a.sum.Sub(d)
+	return nil
+}
+
+func (a *sumAggregate) Result() Value {
+	if a.count == 0 {
+		return nil
+	}
+	return &Number{a.sum}
+}
+
+type avgAggregate struct {
+	sumAggregate
+}
+
+func (a *avgAggregate) Result() Value {
+	if a.count == 0 {
+		return nil
+	}
+	return &Number{a.sum.Div(decimal.New(a.count, 0))}
+}
+
+// extremumAggregate is min (direction -1) or max (direction 1). It keeps
+// every value it has seen so removing the current extremum can find the
+// next one.
+type extremumAggregate struct {
+	direction int
+	values    map[string]*countedValue
+	current   Value
+}
+
+type countedValue struct {
+	v     Value
+	count int
+}
+
+func newExtremumAggregate(direction int) *extremumAggregate {
+	return &extremumAggregate{direction: direction, values: make(map[string]*countedValue)}
+}
+
+// Compare orders numbers numerically and text lexically. Anything else,
+// including comparing a number with text, is an error.
+func Compare(a, b Value) (int, error) {
+	switch x := a.(type) {
+	case *Number:
+		if y, ok := b.(*Number); ok {
+			return x.d.Cmp(y.d), nil
+		}
+	case *Text:
+		if y, ok := b.(*Text); ok {
+			return strings.Compare(x.s, y.s), nil
+		}
+	}
+	return 0, errors.New("can't compare " + describe(a) + " with " + describe(b))
+}
+
+func describe(v Value) string {
+	if v == nil {
+		return "nothing"
+	}
+	return v.String()
+}
+
+func (a *extremumAggregate) better(v Value, than Value) (bool, error) {
+	if than == nil {
+		return true, nil
+	}
+	cmp, err := Compare(v, than)
+	return cmp*a.direction > 0, err
+}
+
+func (a *extremumAggregate) Add(v Value) error {
+	if better, err := a.better(v, a.current); err != nil {
+		return err
+	} else if better {
+		a.current = v
+	}
+	key := v.String()
+	if cv, ok := a.values[key]; ok {
+		cv.count++
+	} else {
+		a.values[key] = &countedValue{v, 1}
+	}
+	return nil
+}
+
+func (a *extremumAggregate) Remove(v Value) error {
+	key := v.String()
+	cv, ok := a.values[key]
+	if !ok {
+		return errors.New("removing " + key + " which was never added")
+	}
+	cv.count--
+	if cv.count > 0 {
+		return nil
+	}
+	delete(a.values, key)
+	if a.current != nil && a.current.Equals(v) {
+		a.current = nil
+		for _, other := range a.values {
+			if better, _ := a.better(other.v, a.current); better {
+				a.current = other.v
+			}
+		}
+	}
+	return nil
+}
+
+func (a *extremumAggregate) Result() Value {
+	return a.current
+}
+
+//------------------------------------------------------------------------------
+// Aggregate evaluator
+//------------------------------------------------------------------------------
+
+type aggregateGroup struct {
+	grouping  []Value
+	members   map[string]int // projection and value key -> how many rows carry it
+	aggregate Aggregate
+	emitted   Value // what next last saw for this group, nil if nothing
+}
+
+func rowKey(row []Value, registers []int) string {
+	var key []string
+	for _, r := range registers {
+		key = append(key, describe(row[r]))
+	}
+	return strings.Join(key, "\x00")
+}
+
+func readRegisters(k Node, key string) []int {
+	n, ok := k.Lookup(key)
+	if !ok {
+		return nil
+	}
+	var registers []int
+	for _, child := range n.Children() {
+		registers = append(registers, registerIndex(child.value))
+	}
+	return registers
+}
+
+// buildAggregate folds the rows it's given into one row per group. Rows are
+// deduplicated on the projection registers and the value first (on the whole
+// row if there is no projection), so a value only counts once however many
+// ways the query found it, and a remove takes out the value its insert put
+// in. Changes are held until OpFlush, at which point every group that
+// changed sends next a remove of its old result and an insert of its new
+// one; that's what lets the aggregate be maintained incrementally as rows
+// are inserted and removed upstream.
+//
+// The node is {operator, grouping: {register...}, projection: {register...},
+// value: term, return: term}.
+func buildAggregate(env *Env, k Node, next evaluator) evaluator {
+	operator := k.(*Mapnode).m["operator"].(*Valnode).v.(*Text).Value()
+	newAggregate, ok := aggregates[operator]
+	if !ok {
+		return func(op Operator, row []Value) {
+			next(OpError, errorRow(errors.New("unknown aggregate '"+operator+"'")))
+		}
+	}
+	grouping := readRegisters(k, "grouping")
+	projection := readRegisters(k, "projection")
+	input, noInput := readTerm(k, "value")
+	result, err := readTerm(k, "return")
+	if err != nil {
+		return func(op Operator, row []Value) {
+			next(OpError, errorRow(errors.New(operator+" has nowhere to put its result")))
+		}
+	}
+
+	members := projection
+	if members != nil && noInput == nil && input.constant == nil {
+		members = append(append([]int(nil), projection...), input.register)
+	}
+
+	groups := make(map[string]*aggregateGroup)
+	dirty := make(map[string]*aggregateGroup)
+	width := 0
+
+	return func(op Operator, row []Value) {
+		switch op {
+		case OpInsert, OpRemove:
+			width = len(row)
+			groupKey := rowKey(row, grouping)
+			group, ok := groups[groupKey]
+			if !ok {
+				group = &aggregateGroup{members: make(map[string]int), aggregate: newAggregate()}
+				for _, r := range grouping {
+					group.grouping = append(group.grouping, row[r])
+				}
+				groups[groupKey] = group
+			}
+			memberKey := rowKey(row, members)
+			if members == nil {
+				memberKey = rowKey(row, wholeRow(len(row)))
+			}
+			var v Value
+			if noInput == nil {
+				v = input.resolve(row)
+			}
+			var err error
+			if op == OpInsert {
+				group.members[memberKey]++
+				if group.members[memberKey] == 1 {
+					err = group.aggregate.Add(v)
+				}
+			} else if group.members[memberKey] > 0 {
+				group.members[memberKey]--
+				if group.members[memberKey] == 0 {
+					delete(group.members, memberKey)
+					err = group.aggregate.Remove(v)
+				}
+			}
+			if err != nil {
+				next(OpError, errorRow(errors.New(operator+": "+err.Error())))
+				return
+			}
+			dirty[groupKey] = group
+		case OpFlush:
+			for groupKey, group := range dirty {
+				current := group.aggregate.Result()
+				if current != nil && group.emitted != nil && current.Equals(group.emitted) {
+					continue
+				}
+				if group.emitted != nil {
+					next(OpRemove, group.row(width, grouping, result, group.emitted))
+				}
+				if current != nil {
+					next(OpInsert, group.row(width, grouping, result, current))
+				}
+				group.emitted = current
+				if current == nil && len(group.members) == 0 {
+					delete(groups, groupKey)
+				}
+			}
+			dirty = make(map[string]*aggregateGroup)
+			next(op, row)
+		default:
+			next(op, row)
+		}
+	}
+}
+
+func wholeRow(width int) []int {
+	registers := make([]int, width)
+	for ix := range registers {
+		registers[ix] = ix
+	}
+	return registers
+}
+
+// row is the row an aggregate sends on: just the grouping and the result,
+// since the other registers don't mean anything once rows are folded
+func (group *aggregateGroup) row(width int, grouping []int, result term, v Value) []Value {
+	out := make([]Value, width)
+	for ix, r := range grouping {
+		out[r] = group.grouping[ix]
+	}
+	result.bind(out, v)
+	return out
+}
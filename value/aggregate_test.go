@@ -0,0 +1,83 @@
+package value
+
+import (
+	"testing"
+)
+
+// an aggregateStep adds a value, or with remove set takes one out, and then
+// expects the aggregate's result to read as result ("" for nothing)
+type aggregateStep struct {
+	remove bool
+	v      Value
+	result string
+}
+
+func add(v Value, result string) aggregateStep {
+	return aggregateStep{false, v, result}
+}
+
+func remove(v Value, result string) aggregateStep {
+	return aggregateStep{true, v, result}
+}
+
+func n(i int64) Value {
+	return NewNumberFromInt(i)
+}
+
+func TestAggregates(t *testing.T) {
+	var tests = []struct {
+		operator string
+		steps    []aggregateStep
+	}{
+		{"count", []aggregateStep{add(n(5), "1"), add(NewText("a"), "2"), remove(n(5), "1"), remove(NewText("a"), "")}},
+		{"sum", []aggregateStep{add(n(1), "1"), add(n(2), "3"), add(NewNumberFromFloat(0.5), "3.5"), remove(n(1), "2.5")}},
+		{"sum", []aggregateStep{add(n(-3), "-3"), remove(n(-3), "")}},
+		{"avg", []aggregateStep{add(n(1), "1"), add(n(2), "1.5"), add(n(6), "3"), remove(n(6), "1.5"), remove(n(1), "2"), remove(n(2), "")}},
+		{"min", []aggregateStep{add(n(3), "3"), add(n(1), "1"), add(n(2), "1"), remove(n(1), "2"), remove(n(3), "2"), remove(n(2), "")}},
+		{"max", []aggregateStep{add(n(3), "3"), add(n(1), "3"), add(n(7), "7"), remove(n(7), "3"), remove(n(3), "1")}},
+		// a value added twice stays the extremum until both are gone
+		{"min", []aggregateStep{add(n(1), "1"), add(n(1), "1"), add(n(4), "1"), remove(n(1), "1"), remove(n(1), "4")}},
+		{"max", []aggregateStep{add(NewText("apple"), `"apple"`), add(NewText("pear"), `"pear"`), remove(NewText("pear"), `"apple"`)}},
+	}
+	for _, test := range tests {
+		if _, ok := LookupAggregate(test.operator); !ok {
+			t.Fatalf("%v: no signature", test.operator)
+		}
+		var aggregate = aggregates[test.operator]()
+		for ix, step := range test.steps {
+			var err error
+			if step.remove {
+				err = aggregate.Remove(step.v)
+			} else {
+				err = aggregate.Add(step.v)
+			}
+			if err != nil {
+				t.Fatalf("%v step %v: %v", test.operator, ix, err)
+			}
+			var got = ""
+			if result := aggregate.Result(); result != nil {
+				got = result.String()
+			}
+			if got != step.result {
+				t.Errorf("%v step %v: expected %q, got %q", test.operator, ix, step.result, got)
+			}
+		}
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	if err := aggregates["sum"]().Add(NewText("a")); err == nil {
+		t.Errorf("expected sum of text to be an error")
+	}
+	if err := aggregates["avg"]().Add(nil); err == nil {
+		t.Errorf("expected avg of nothing to be an error")
+	}
+	var max = aggregates["max"]()
+	max.Add(n(1))
+	if err := max.Add(NewText("a")); err == nil {
+		t.Errorf("expected max of a number and text to be an error")
+	}
+	if err := aggregates["min"]().Remove(n(1)); err == nil {
+		t.Errorf("expected removing a value min never saw to be an error")
+	}
+}
@@ -1,5 +1,10 @@
 package value
 
+import (
+	"errors"
+	"strconv"
+)
+
 type Operator int
 
 const (
@@ -10,27 +15,251 @@ const (
 	OpError
 )
 
+// evaluators are pushed rows of registers, one register per query variable.
+// A nil register is one that hasn't been bound yet.
 type evaluator func(Operator, []Value)
-type builder func(Node, evaluator) evaluator
+type builder func(*Env, Node, evaluator) evaluator
+
+// Relation is what a scan reads from; the edb implements it. A nil e, a or
+// v is unbound.
+type Relation interface {
+	Scan(e, a, v Value, f func(e, a, v Value))
+}
+
+// Env is everything a builder can reach besides its own node
+type Env struct {
+	Relation Relation
+}
+
+// buildNot is an anti-join: a row goes on only if running the body with the
+// row's registers bound finds nothing. The node is {body: chain}; an empty
+// body always finds the row itself, so nothing gets through.
+func buildNot(env *Env, k Node, next evaluator) evaluator {
+	var found bool
+	bodyNode, _ := k.Lookup("body")
+	body := build(env, bodyNode, func(op Operator, row []Value) {
+		switch op {
+		case OpInsert:
+			found = true
+		case OpError:
+			next(op, row)
+		}
+	})
+	return func(op Operator, row []Value) {
+		if op != OpInsert && op != OpRemove {
+			next(op, row)
+			return
+		}
+		found = false
+		body(OpInsert, row)
+		if !found {
+			next(op, row)
+		}
+	}
+}
+
+// a term is either a constant (a Valnode) or a register ({register: n})
+type term struct {
+	constant Value
+	register int
+}
+
+func readTerm(k Node, key string) (term, error) {
+	n, ok := k.Lookup(key)
+	if !ok {
+		return term{}, errors.New("missing term '" + key + "'")
+	}
+	if v, ok := n.(*Valnode); ok {
+		return term{constant: v.v, register: -1}, nil
+	}
+	r, ok := n.Lookup("register")
+	if !ok {
+		return term{}, errors.New("term '" + key + "' is neither a constant nor a register")
+	}
+	return term{register: registerIndex(r)}, nil
+}
+
+func registerIndex(n Node) int {
+	return int(n.(*Valnode).v.(*Number).Value().IntPart())
+}
 
-func buildNot(k Node, next evaluator) evaluator {
-	return nil
+// resolve returns the term's value in row, or nil if it's an unbound register
+func (t term) resolve(row []Value) Value {
+	if t.register < 0 {
+		return t.constant
+	}
+	return row[t.register]
 }
 
-func buildSum(k Node, next evaluator) evaluator {
-	return nil
+// bind sets an unbound register, or checks that a bound one agrees with v
+func (t term) bind(row []Value, v Value) bool {
+	if t.register < 0 {
+		return t.constant.Equals(v)
+	}
+	if row[t.register] == nil {
+		row[t.register] = v
+		return true
+	}
+	return row[t.register].Equals(v)
 }
 
-func buildScan(k Node, next evaluator) evaluator {
-	return nil
+func errorRow(err error) []Value {
+	return []Value{NewText(err.Error())}
+}
+
+func buildScan(env *Env, k Node, next evaluator) evaluator {
+	var terms [3]term
+	for ix, key := range []string{"e", "a", "v"} {
+		t, err := readTerm(k, key)
+		if err != nil {
+			return func(op Operator, row []Value) {
+				next(OpError, errorRow(err))
+			}
+		}
+		terms[ix] = t
+	}
+	return func(op Operator, row []Value) {
+		if op != OpInsert && op != OpRemove {
+			next(op, row)
+			return
+		}
+		e, a, v := terms[0].resolve(row), terms[1].resolve(row), terms[2].resolve(row)
+		env.Relation.Scan(e, a, v, func(e, a, v Value) {
+			out := make([]Value, len(row))
+			copy(out, row)
+			if terms[0].bind(out, e) && terms[1].bind(out, a) && terms[2].bind(out, v) {
+				next(op, out)
+			}
+		})
+	}
+}
+
+// buildExpression runs a function over its argument terms, which are keyed
+// by position ("0", "1", ...), and binds its outputs, which are keyed by name.
+// An output that's already bound acts as a filter on the result instead, and
+// an operator with no outputs is a filter on its Boolean result.
+func buildExpression(env *Env, k Node, next evaluator) evaluator {
+	operator := k.(*Mapnode).m["operator"].(*Valnode).v.(*Text).Value()
+	signature := signatures[operator]
+	gen, ok := generators[operator]
+	if fn, isFunction := functions[operator]; isFunction {
+		gen, ok = generator(fn), true
+	}
+	if !ok {
+		return func(op Operator, row []Value) {
+			next(OpError, errorRow(errors.New("unknown operator '"+operator+"'")))
+		}
+	}
+	var args []term
+	for ix := 0; ; ix++ {
+		t, err := readTerm(k, strconv.Itoa(ix))
+		if err != nil {
+			break
+		}
+		args = append(args, t)
+	}
+	var outputs []term
+	var present []bool
+	for _, name := range signature.Outputs {
+		t, err := readTerm(k, name)
+		outputs = append(outputs, t)
+		present = append(present, err == nil)
+	}
+	return func(op Operator, row []Value) {
+		if op != OpInsert && op != OpRemove {
+			next(op, row)
+			return
+		}
+		values := make([]Value, len(args))
+		for ix, arg := range args {
+			values[ix] = arg.resolve(row)
+		}
+		err := gen(values, func(results []Value) {
+			if len(outputs) == 0 {
+				// filters return true to keep the row
+				if b, ok := results[0].(*Boolean); ok && b.Value() {
+					next(op, row)
+				}
+				return
+			}
+			out := make([]Value, len(row))
+			copy(out, row)
+			for ix, v := range results {
+				if present[ix] && !outputs[ix].bind(out, v) {
+					return
+				}
+			}
+			next(op, out)
+		})
+		if err != nil {
+			next(OpError, errorRow(errors.New(operator+": "+err.Error())))
+		}
+	}
 }
 
 // consider how to deal with the indices here
-var builders = map[string]builder{
-	"not":  buildNot,
-	"sum":  buildSum,
-	"scan": buildScan,
+var builders map[string]builder
+
+// builders is filled in here rather than where it's declared because
+// buildNot builds its body through it
+func init() {
+	builders = map[string]builder{
+		"not":        buildNot,
+		"scan":       buildScan,
+		"expression": buildExpression,
+		"join":       buildJoin,
+		"aggregate":  buildAggregate,
+	}
+}
+
+// Build compiles a chain of operator nodes ({op: ..., next: {...}}) into a
+// single evaluator that pushes every row that makes it through the chain
+// into final.
+func Build(env *Env, source Node, final func(Operator, []Value)) func(Operator, []Value) {
+	return build(env, source, final)
+}
+
+func build(env *Env, source Node, final evaluator) evaluator {
+	if source == nil {
+		return final
+	}
+	next := final
+	if n, ok := source.Lookup("next"); ok {
+		next = build(env, n, final)
+	}
+	opNode, ok := source.Lookup("op")
+	if !ok {
+		return final
+	}
+	op := opNode.(*Valnode).v.(*Text).Value()
+	b, ok := builders[op]
+	if !ok {
+		return func(Operator, []Value) {
+			final(OpError, errorRow(errors.New("no builder for '"+op+"'")))
+		}
+	}
+	return b(env, source, next)
+}
+
+//------------------------------------------------------------------------------
+// Plan nodes
+//------------------------------------------------------------------------------
+
+// NewRegisterNode is the plan term for register r
+func NewRegisterNode(r int) Node {
+	n := NewMapNode().(*Mapnode)
+	n.m["register"] = NewValnode(NewNumberFromInt(int64(r)))
+	return n
+}
+
+// NewOpNode starts a plan node for the builder named op
+func NewOpNode(op string) Node {
+	n := NewMapNode().(*Mapnode)
+	n.m["op"] = NewValnode(NewText(op))
+	return n
 }
 
-func build(source Node, final evaluator) {
+// Set adds a child to a map node, which is how plans are assembled
+func Set(n Node, key string, child Node) {
+	n.(*Mapnode).m[key] = child
 }
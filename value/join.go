@@ -0,0 +1,177 @@
+package value
+
+import (
+	"errors"
+)
+
+// Index is a Relation that can also answer membership and size questions,
+// which is what a generic join needs to intersect candidates instead of
+// enumerating every combination. CanSeek says whether a pattern can be
+// answered without walking the whole relation.
+type Index interface {
+	Relation
+	Contains(e, a, v Value) bool
+	Count(e, a, v Value) int
+	CanSeek(e, a, v Value) bool
+}
+
+type joinPattern [3]term
+
+func (p joinPattern) resolve(row []Value) (Value, Value, Value) {
+	return p[0].resolve(row), p[1].resolve(row), p[2].resolve(row)
+}
+
+func (p joinPattern) mentions(register int) bool {
+	for _, t := range p {
+		if t.register == register {
+			return true
+		}
+	}
+	return false
+}
+
+// buildJoin is a generic (worst-case optimal) join. Rather than joining the
+// patterns one at a time, it binds one variable at a time, in the order the
+// planner gives: the candidates for a variable come from whichever pattern
+// mentioning it is smallest right now, and each candidate is kept only if
+// every other pattern mentioning the variable agrees. Intermediate results
+// are never bigger than the final answer allows, which is what keeps cyclic
+// queries from blowing up the way pairwise joins do.
+//
+// The node is {patterns: {{e, a, v}, ...}, order: {register, ...}}.
+func buildJoin(env *Env, k Node, next evaluator) evaluator {
+	var fail = func(err error) evaluator {
+		return func(op Operator, row []Value) {
+			next(OpError, errorRow(err))
+		}
+	}
+	index, ok := env.Relation.(Index)
+	if !ok {
+		return fail(errors.New("join needs a relation that implements Index"))
+	}
+
+	var patterns []joinPattern
+	patternsNode, _ := k.Lookup("patterns")
+	orderNode, _ := k.Lookup("order")
+	if patternsNode == nil || orderNode == nil {
+		return fail(errors.New("join needs both patterns and an order"))
+	}
+	for _, child := range patternsNode.Children() {
+		var p joinPattern
+		for ix, key := range []string{"e", "a", "v"} {
+			t, err := readTerm(child.value, key)
+			if err != nil {
+				return fail(err)
+			}
+			p[ix] = t
+		}
+		patterns = append(patterns, p)
+	}
+	var order []int
+	var relevant [][]joinPattern
+	for _, child := range orderNode.Children() {
+		register := registerIndex(child.value)
+		order = append(order, register)
+		var mentioning []joinPattern
+		for _, p := range patterns {
+			if p.mentions(register) {
+				mentioning = append(mentioning, p)
+			}
+		}
+		relevant = append(relevant, mentioning)
+	}
+
+	// patterns made of nothing but constants are checked once up front
+	var closed []joinPattern
+	for _, p := range patterns {
+		if p[0].register < 0 && p[1].register < 0 && p[2].register < 0 {
+			closed = append(closed, p)
+		}
+	}
+
+	var join func(op Operator, depth int, row []Value)
+	join = func(op Operator, depth int, row []Value) {
+		if depth == len(order) {
+			next(op, row)
+			return
+		}
+		register := order[depth]
+		candidates := relevant[depth]
+		if row[register] != nil {
+			// bound before the join started, so just check it
+			for _, p := range candidates {
+				if e, a, v := p.resolve(row); !index.Contains(e, a, v) {
+					return
+				}
+			}
+			join(op, depth+1, row)
+			return
+		}
+		// enumerate the smallest pattern we can seek into; patterns we can't
+		// seek into aren't worth probing yet, and get checked once the
+		// variables that make them seekable are bound
+		best, bestCount, bestSeeks := -1, 0, false
+		for ix, p := range candidates {
+			e, a, v := p.resolve(row)
+			seeks := index.CanSeek(e, a, v)
+			count := index.Count(e, a, v)
+			if best < 0 || (seeks && !bestSeeks) || (seeks == bestSeeks && count < bestCount) {
+				best, bestCount, bestSeeks = ix, count, seeks
+			}
+		}
+		if best < 0 || bestCount == 0 {
+			return
+		}
+
+		seen := make(map[string]bool)
+		source := candidates[best]
+		e, a, v := source.resolve(row)
+		index.Scan(e, a, v, func(e, a, v Value) {
+			out := make([]Value, len(row))
+			copy(out, row)
+			if !source[0].bind(out, e) || !source[1].bind(out, a) || !source[2].bind(out, v) {
+				return
+			}
+			candidate := out[register]
+			key := candidate.String()
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			// only the variable we're binding at this depth carries forward;
+			// the source pattern's other variables get their turn later
+			out = make([]Value, len(row))
+			copy(out, row)
+			out[register] = candidate
+			for ix, p := range candidates {
+				if ix == best {
+					continue
+				}
+				pe, pa, pv := p.resolve(out)
+				if index.CanSeek(pe, pa, pv) && !index.Contains(pe, pa, pv) {
+					return
+				}
+			}
+			join(op, depth+1, out)
+		})
+	}
+
+	return func(op Operator, row []Value) {
+		if op != OpInsert && op != OpRemove {
+			next(op, row)
+			return
+		}
+		for _, p := range closed {
+			e, a, v := p.resolve(row)
+			if !index.Contains(e, a, v) {
+				return
+			}
+		}
+		join(op, 0, row)
+	}
+}
+
+// NewSetNode collects plan nodes where order matters but keys don't
+func NewSetNode(children []Node) Node {
+	return &Setnode{children}
+}
@@ -0,0 +1,256 @@
+package value
+
+import (
+	"errors"
+	"github.com/witheve/evingo/decimal"
+	"math"
+	"strconv"
+)
+
+// Signature describes the fields an expression operator reads and the fields
+// it binds. A binding may name a field directly, or refer to it by position,
+// counting the outputs first and then the inputs (so "0" is the result of
+// count and "1" is the value of set).
+type Signature struct {
+	Outputs []string
+	Inputs  []string
+}
+
+func (s *Signature) field(field string) (string, bool) {
+	var all = append(append([]string{}, s.Outputs...), s.Inputs...)
+	for ix, name := range all {
+		if field == name || field == strconv.Itoa(ix) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// IsOutput reports whether field is one the operator binds
+func (s *Signature) IsOutput(field string) bool {
+	var name, ok = s.field(field)
+	if !ok {
+		return false
+	}
+	for _, output := range s.Outputs {
+		if output == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasField reports whether field names any input or output of the operator
+func (s *Signature) HasField(field string) bool {
+	var _, ok = s.field(field)
+	return ok
+}
+
+// Canonical maps a positional field to its name
+func (s *Signature) Canonical(field string) string {
+	var name, _ = s.field(field)
+	return name
+}
+
+var (
+	filter   = &Signature{Inputs: []string{"a", "b"}}
+	unary    = &Signature{Outputs: []string{"return"}, Inputs: []string{"a"}}
+	binary   = &Signature{Outputs: []string{"return"}, Inputs: []string{"a", "b"}}
+	reducing = &Signature{Outputs: []string{"return"}, Inputs: []string{"value"}}
+)
+
+// LookupSignature finds the signature of a function. Aggregates have their
+// own, see LookupAggregate.
+func LookupSignature(operator string) (*Signature, bool) {
+	var s, ok = signatures[operator]
+	return s, ok
+}
+
+// A Function computes an expression's output from its inputs, in the order
+// the signature lists them. Filters return a Boolean. An input that isn't
+// bound arrives as nil.
+type Function func(args []Value) (Value, error)
+
+// A Generator is a function that can have any number of results, like
+// splitting a string. It calls emit once per result with the outputs in the
+// order the signature lists them.
+type Generator func(args []Value, emit func(outputs []Value)) error
+
+var signatures = make(map[string]*Signature)
+var functions = make(map[string]Function)
+var generators = make(map[string]Generator)
+
+// RegisterFunction makes a function available to expressions as operator,
+// replacing anything already registered under that name
+func RegisterFunction(operator string, signature *Signature, fn Function) {
+	signatures[operator] = signature
+	functions[operator] = fn
+	delete(generators, operator)
+}
+
+// RegisterGenerator is RegisterFunction for generators
+func RegisterGenerator(operator string, signature *Signature, g Generator) {
+	signatures[operator] = signature
+	generators[operator] = g
+	delete(functions, operator)
+}
+
+// generator lifts a function into a generator with a single result
+func generator(fn Function) Generator {
+	return func(args []Value, emit func(outputs []Value)) error {
+		v, err := fn(args)
+		if err != nil {
+			return err
+		}
+		emit([]Value{v})
+		return nil
+	}
+}
+
+//------------------------------------------------------------------------------
+// Type checking
+//------------------------------------------------------------------------------
+
+func argumentError(signature *Signature, ix int, expected string, got Value) error {
+	var name = signature.Inputs[ix]
+	if got == nil {
+		return errors.New("argument '" + name + "' should be " + expected + ", but it's unbound")
+	}
+	return errors.New("argument '" + name + "' should be " + expected + ", but got " + got.String())
+}
+
+func bound(signature *Signature, args []Value) error {
+	for ix, arg := range args {
+		if arg == nil {
+			return argumentError(signature, ix, "a value", arg)
+		}
+	}
+	return nil
+}
+
+// numeric wraps an arithmetic function so it only ever sees numbers
+func numeric(signature *Signature, f func(args []decimal.Decimal) (decimal.Decimal, error)) Function {
+	return func(args []Value) (Value, error) {
+		var ds = make([]decimal.Decimal, len(args))
+		for ix, arg := range args {
+			n, ok := arg.(*Number)
+			if !ok {
+				return nil, argumentError(signature, ix, "a number", arg)
+			}
+			ds[ix] = n.d
+		}
+		d, err := f(ds)
+		if err != nil {
+			return nil, err
+		}
+		return &Number{d}, nil
+	}
+}
+
+// trigonometric wraps a float function of an angle in degrees, which is
+// what programs write (30 * hours)
+func trigonometric(f func(float64) float64) Function {
+	return numeric(unary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		degrees, _ := args[0].Float64()
+		return decimal.NewFromFloat(f(degrees * math.Pi / 180)), nil
+	})
+}
+
+func comparison(test func(cmp int) bool) Function {
+	return func(args []Value) (Value, error) {
+		if err := bound(filter, args); err != nil {
+			return nil, err
+		}
+		cmp, err := Compare(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		return NewBoolean(test(cmp)), nil
+	}
+}
+
+func extremum(direction int) Function {
+	return func(args []Value) (Value, error) {
+		if err := bound(binary, args); err != nil {
+			return nil, err
+		}
+		cmp, err := Compare(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		if cmp*direction >= 0 {
+			return args[0], nil
+		}
+		return args[1], nil
+	}
+}
+
+//------------------------------------------------------------------------------
+// Built in functions
+//------------------------------------------------------------------------------
+
+func init() {
+	RegisterFunction("=", filter, func(args []Value) (Value, error) {
+		if err := bound(filter, args); err != nil {
+			return nil, err
+		}
+		return NewBoolean(args[0].Equals(args[1])), nil
+	})
+	RegisterFunction("not=", filter, func(args []Value) (Value, error) {
+		if err := bound(filter, args); err != nil {
+			return nil, err
+		}
+		return NewBoolean(!args[0].Equals(args[1])), nil
+	})
+	RegisterFunction("<", filter, comparison(func(cmp int) bool { return cmp < 0 }))
+	RegisterFunction(">", filter, comparison(func(cmp int) bool { return cmp > 0 }))
+	RegisterFunction("<=", filter, comparison(func(cmp int) bool { return cmp <= 0 }))
+	RegisterFunction(">=", filter, comparison(func(cmp int) bool { return cmp >= 0 }))
+
+	RegisterFunction("+", binary, numeric(binary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Add(args[1]), nil
+	}))
+	RegisterFunction("-", binary, numeric(binary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Sub(args[1]), nil
+	}))
+	RegisterFunction("*", binary, numeric(binary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Mul(args[1]), nil
+	}))
+	RegisterFunction("/", binary, numeric(binary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		if args[1].Equals(decimal.Zero) {
+			return decimal.Zero, errors.New("division by zero")
+		}
+		return args[0].Div(args[1]), nil
+	}))
+	RegisterFunction("mod", binary, numeric(binary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		if args[1].Equals(decimal.Zero) {
+			return decimal.Zero, errors.New("division by zero")
+		}
+		return args[0].Mod(args[1]), nil
+	}))
+	RegisterFunction("abs", unary, numeric(unary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Abs(), nil
+	}))
+	RegisterFunction("round", unary, numeric(unary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Round(0), nil
+	}))
+	RegisterFunction("floor", unary, numeric(unary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Floor(), nil
+	}))
+	RegisterFunction("ceiling", unary, numeric(unary, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Ceil(), nil
+	}))
+	RegisterFunction("min", binary, extremum(-1))
+	RegisterFunction("max", binary, extremum(1))
+
+	RegisterFunction("sin", unary, trigonometric(math.Sin))
+	RegisterFunction("cos", unary, trigonometric(math.Cos))
+	RegisterFunction("tan", unary, trigonometric(math.Tan))
+
+	RegisterFunction("set", unary, func(args []Value) (Value, error) {
+		if args[0] == nil {
+			return nil, errors.New("no value to set")
+		}
+		return args[0], nil
+	})
+}
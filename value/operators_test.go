@@ -0,0 +1,128 @@
+package value
+
+import (
+	"errors"
+	"github.com/witheve/evingo/decimal"
+	"math"
+	"testing"
+)
+
+func call(operator string, args ...Value) (Value, error) {
+	fn, ok := functions[operator]
+	if !ok {
+		return nil, errors.New("no function " + operator)
+	}
+	return fn(args)
+}
+
+func TestRegisterFunction(t *testing.T) {
+	var signature = &Signature{Outputs: []string{"return"}, Inputs: []string{"a"}}
+	RegisterGenerator("test-twice", signature, generator(func(args []Value) (Value, error) {
+		return args[0], nil
+	}))
+	RegisterFunction("test-twice", signature, numeric(signature, func(args []decimal.Decimal) (decimal.Decimal, error) {
+		return args[0].Add(args[0]), nil
+	}))
+	defer delete(signatures, "test-twice")
+	defer delete(functions, "test-twice")
+
+	if s, ok := LookupSignature("test-twice"); !ok || s != signature {
+		t.Fatalf("expected the registered signature, got %v", s)
+	}
+	if _, ok := generators["test-twice"]; ok {
+		t.Errorf("expected registering a function to replace the generator")
+	}
+	if v, err := call("test-twice", n(4)); err != nil || v.String() != "8" {
+		t.Errorf("expected 8, got %v (%v)", v, err)
+	}
+	if !signature.IsOutput("0") || signature.IsOutput("a") || signature.Canonical("1") != "a" || signature.HasField("b") {
+		t.Errorf("expected fields to be found by name and by position")
+	}
+	if _, ok := LookupSignature("count"); ok {
+		t.Errorf("expected count to only have an aggregate signature")
+	}
+}
+
+func TestOperatorTypes(t *testing.T) {
+	var tests = []struct {
+		operator string
+		args     []Value
+		err      string
+	}{
+		{"+", []Value{n(1), NewText("a")}, `argument 'b' should be a number, but got "a"`},
+		{"-", []Value{nil, n(1)}, "argument 'a' should be a number, but it's unbound"},
+		{"sin", []Value{NewBoolean(true)}, "argument 'a' should be a number, but got true"},
+		{"<", []Value{n(1), NewText("a")}, `can't compare 1 with "a"`},
+		{"=", []Value{n(1), nil}, "argument 'b' should be a value, but it's unbound"},
+		{"max", []Value{NewText("a"), n(1)}, `can't compare "a" with 1`},
+		{"/", []Value{n(1), n(0)}, "division by zero"},
+		{"mod", []Value{n(1), n(0)}, "division by zero"},
+		{"set", []Value{nil}, "no value to set"},
+	}
+	for _, test := range tests {
+		var v, err = call(test.operator, test.args...)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%v: expected error %q, got %v (%v)", test.operator, test.err, v, err)
+		}
+	}
+}
+
+func TestNumericFunctions(t *testing.T) {
+	var f = NewNumberFromFloat
+	var tests = []struct {
+		operator string
+		args     []Value
+		result   string
+	}{
+		{"+", []Value{n(2), f(0.5)}, "2.5"},
+		{"*", []Value{n(-3), n(4)}, "-12"},
+		{"/", []Value{n(1), n(4)}, "0.25"},
+		{"mod", []Value{n(7), n(3)}, "1"},
+		{"mod", []Value{f(7.5), n(2)}, "1.5"},
+		{"mod", []Value{n(-7), n(3)}, "-1"},
+		{"abs", []Value{n(-3)}, "3"},
+		{"round", []Value{f(2.4)}, "2"},
+		{"round", []Value{f(2.5)}, "3"},
+		{"round", []Value{f(-2.5)}, "-3"},
+		{"floor", []Value{f(-2.5)}, "-3"},
+		{"ceiling", []Value{f(2.1)}, "3"},
+		{"min", []Value{n(2), n(1)}, "1"},
+		{"max", []Value{NewText("a"), NewText("b")}, `"b"`},
+		{"<=", []Value{n(2), n(2)}, "true"},
+		{">", []Value{NewText("a"), NewText("b")}, "false"},
+		{"not=", []Value{n(1), NewText("1")}, "true"},
+	}
+	for _, test := range tests {
+		var v, err = call(test.operator, test.args...)
+		if err != nil {
+			t.Errorf("%v: %v", test.operator, err)
+		} else if v.String() != test.result {
+			t.Errorf("%v: expected %v, got %v", test.operator, test.result, v)
+		}
+	}
+}
+
+// trigonometry is in degrees, and only as exact as a float
+func TestTrigonometry(t *testing.T) {
+	var tests = []struct {
+		operator string
+		degrees  int64
+		result   float64
+	}{
+		{"sin", 30, 0.5},
+		{"sin", 90, 1},
+		{"cos", 60, 0.5},
+		{"cos", 180, -1},
+		{"tan", 45, 1},
+		{"sin", 0, 0},
+	}
+	for _, test := range tests {
+		var v, err = call(test.operator, n(test.degrees))
+		if err != nil {
+			t.Fatalf("%v: %v", test.operator, err)
+		}
+		if f, _ := v.(*Number).d.Float64(); math.Abs(f-test.result) > 1e-9 {
+			t.Errorf("%v(%v): expected %v, got %v", test.operator, test.degrees, test.result, v)
+		}
+	}
+}
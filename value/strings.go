@@ -0,0 +1,189 @@
+package value
+
+import (
+	"container/list"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	textual   = &Signature{Outputs: []string{"return"}, Inputs: []string{"text"}}
+	substring = &Signature{Outputs: []string{"return"}, Inputs: []string{"text", "from", "to"}}
+	splitting = &Signature{Outputs: []string{"token", "index"}, Inputs: []string{"text", "by"}}
+)
+
+func searching(needle string) *Signature {
+	return &Signature{Inputs: []string{"text", needle}}
+}
+
+// ToText is how a value reads when it's used as a string
+func ToText(v Value) string {
+	switch x := v.(type) {
+	case *Text:
+		return x.s
+	case *Number:
+		return x.d.String()
+	case *Boolean:
+		return strconv.FormatBool(x.b)
+	}
+	return v.String()
+}
+
+// texts wraps a string function so it only ever sees text
+func texts(signature *Signature, f func(args []string) (Value, error)) Function {
+	return func(args []Value) (Value, error) {
+		var ss = make([]string, len(args))
+		for ix, arg := range args {
+			t, ok := arg.(*Text)
+			if !ok {
+				return nil, argumentError(signature, ix, "text", arg)
+			}
+			ss[ix] = t.s
+		}
+		return f(ss)
+	}
+}
+
+// integer reads a whole number argument
+func integer(signature *Signature, args []Value, ix int) (int, error) {
+	n, ok := args[ix].(*Number)
+	if !ok || !n.d.Equals(n.d.Truncate(0)) {
+		return 0, argumentError(signature, ix, "a whole number", args[ix])
+	}
+	return int(n.d.IntPart()), nil
+}
+
+// how many compiled patterns to keep
+const regexCacheSize = 64
+
+// regexes are the patterns used most recently, most recent first, so a
+// pattern that's the same for every row compiles once while ones built per
+// row don't pile up
+var regexes = struct {
+	sync.Mutex
+	compiled map[string]*list.Element
+	order    *list.List
+}{compiled: make(map[string]*list.Element), order: list.New()}
+
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexes.Lock()
+	defer regexes.Unlock()
+	if element, ok := regexes.compiled[pattern]; ok {
+		regexes.order.MoveToFront(element)
+		return element.Value.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New("bad pattern: " + err.Error())
+	}
+	regexes.compiled[pattern] = regexes.order.PushFront(re)
+	if regexes.order.Len() > regexCacheSize {
+		var oldest = regexes.order.Back()
+		regexes.order.Remove(oldest)
+		delete(regexes.compiled, oldest.Value.(*regexp.Regexp).String())
+	}
+	return re, nil
+}
+
+//------------------------------------------------------------------------------
+// Built in string functions
+//------------------------------------------------------------------------------
+
+func init() {
+	// concat takes anything, so that "{name} is {age}" works
+	RegisterFunction("concat", binary, func(args []Value) (Value, error) {
+		if err := bound(binary, args); err != nil {
+			return nil, err
+		}
+		return NewText(ToText(args[0]) + ToText(args[1])), nil
+	})
+	RegisterFunction("length", textual, texts(textual, func(args []string) (Value, error) {
+		return NewNumberFromInt(int64(utf8.RuneCountInString(args[0]))), nil
+	}))
+	RegisterFunction("upper", textual, texts(textual, func(args []string) (Value, error) {
+		return NewText(strings.ToUpper(args[0])), nil
+	}))
+	RegisterFunction("lower", textual, texts(textual, func(args []string) (Value, error) {
+		return NewText(strings.ToLower(args[0])), nil
+	}))
+
+	// substring counts characters from 1, and includes both ends
+	RegisterFunction("substring", substring, func(args []Value) (Value, error) {
+		text, ok := args[0].(*Text)
+		if !ok {
+			return nil, argumentError(substring, 0, "text", args[0])
+		}
+		from, err := integer(substring, args, 1)
+		if err != nil {
+			return nil, err
+		}
+		to, err := integer(substring, args, 2)
+		if err != nil {
+			return nil, err
+		}
+		runes := []rune(text.s)
+		if from < 1 {
+			from = 1
+		}
+		if to > len(runes) {
+			to = len(runes)
+		}
+		if from > to {
+			return NewText(""), nil
+		}
+		return NewText(string(runes[from-1 : to])), nil
+	})
+
+	contains := searching("substring")
+	RegisterFunction("contains", contains, texts(contains, func(args []string) (Value, error) {
+		return NewBoolean(strings.Contains(args[0], args[1])), nil
+	}))
+	startsWith := searching("prefix")
+	RegisterFunction("starts-with", startsWith, texts(startsWith, func(args []string) (Value, error) {
+		return NewBoolean(strings.HasPrefix(args[0], args[1])), nil
+	}))
+	endsWith := searching("suffix")
+	RegisterFunction("ends-with", endsWith, texts(endsWith, func(args []string) (Value, error) {
+		return NewBoolean(strings.HasSuffix(args[0], args[1])), nil
+	}))
+	matches := searching("pattern")
+	RegisterFunction("regex-match", matches, texts(matches, func(args []string) (Value, error) {
+		re, err := compileRegex(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return NewBoolean(re.MatchString(args[0])), nil
+	}))
+
+	// split has a result per token, numbered from 1 so the pieces can be put
+	// back in order
+	RegisterGenerator("split", splitting, func(args []Value, emit func(outputs []Value)) error {
+		for ix, arg := range args {
+			if _, ok := arg.(*Text); !ok {
+				return argumentError(splitting, ix, "text", arg)
+			}
+		}
+		for ix, token := range strings.Split(args[0].(*Text).s, args[1].(*Text).s) {
+			emit([]Value{NewText(token), NewNumberFromInt(int64(ix + 1))})
+		}
+		return nil
+	})
+
+	RegisterFunction("to-string", unary, func(args []Value) (Value, error) {
+		if err := bound(unary, args); err != nil {
+			return nil, err
+		}
+		return NewText(ToText(args[0])), nil
+	})
+	RegisterFunction("to-number", textual, texts(textual, func(args []string) (Value, error) {
+		n, err := ParseNumber(strings.TrimSpace(args[0]))
+		if err != nil {
+			return nil, errors.New("'" + args[0] + "' isn't a number")
+		}
+		return n, nil
+	}))
+}
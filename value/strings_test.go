@@ -0,0 +1,126 @@
+package value
+
+import (
+	"strconv"
+	"testing"
+)
+
+func text(s string) Value {
+	return NewText(s)
+}
+
+func TestStringFunctions(t *testing.T) {
+	var tests = []struct {
+		operator string
+		args     []Value
+		result   string
+	}{
+		{"concat", []Value{text("age "), n(3)}, `"age 3"`},
+		{"concat", []Value{NewBoolean(true), text("!")}, `"true!"`},
+		{"length", []Value{text("héllo")}, "5"},
+		{"upper", []Value{text("abc")}, `"ABC"`},
+		{"lower", []Value{text("ABC")}, `"abc"`},
+		{"substring", []Value{text("hello"), n(1), n(1)}, `"h"`},
+		{"substring", []Value{text("hello"), n(2), n(4)}, `"ell"`},
+		{"substring", []Value{text("héllo"), n(2), n(2)}, `"é"`},
+		{"substring", []Value{text("hello"), n(0), n(99)}, `"hello"`},
+		{"substring", []Value{text("hello"), n(4), n(2)}, `""`},
+		{"contains", []Value{text("hello"), text("ell")}, "true"},
+		{"starts-with", []Value{text("hello"), text("el")}, "false"},
+		{"ends-with", []Value{text("hello"), text("lo")}, "true"},
+		{"regex-match", []Value{text("a12"), text("^a[0-9]+$")}, "true"},
+		{"regex-match", []Value{text("b12"), text("^a[0-9]+$")}, "false"},
+		{"to-string", []Value{NewNumberFromFloat(1.5)}, `"1.5"`},
+		{"to-number", []Value{text(" 42 ")}, "42"},
+	}
+	for _, test := range tests {
+		var v, err = call(test.operator, test.args...)
+		if err != nil {
+			t.Errorf("%v%v: %v", test.operator, test.args, err)
+		} else if v.String() != test.result {
+			t.Errorf("%v%v: expected %v, got %v", test.operator, test.args, test.result, v)
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	var tests = []struct {
+		operator string
+		args     []Value
+		err      string
+	}{
+		{"length", []Value{n(1)}, "argument 'text' should be text, but got 1"},
+		{"contains", []Value{text("a"), nil}, "argument 'substring' should be text, but it's unbound"},
+		{"substring", []Value{text("hello"), NewNumberFromFloat(1.5), n(2)}, "argument 'from' should be a whole number, but got 1.5"},
+		{"regex-match", []Value{text("a"), text("(")}, "bad pattern: error parsing regexp: missing closing ): `(`"},
+		{"to-number", []Value{text("ten")}, "'ten' isn't a number"},
+		{"concat", []Value{nil, text("a")}, "argument 'a' should be a value, but it's unbound"},
+	}
+	for _, test := range tests {
+		var v, err = call(test.operator, test.args...)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%v: expected error %q, got %v (%v)", test.operator, test.err, v, err)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	var split = generators["split"]
+	var tokens []string
+	var err = split([]Value{text("a,b,,c"), text(",")}, func(outputs []Value) {
+		tokens = append(tokens, outputs[1].String()+"="+outputs[0].String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{`1="a"`, `2="b"`, `3=""`, `4="c"`}
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+	for ix := range expected {
+		if tokens[ix] != expected[ix] {
+			t.Errorf("expected %v, got %v", expected, tokens)
+		}
+	}
+	if err := split([]Value{text("a"), n(1)}, func([]Value) {}); err == nil || err.Error() != "argument 'by' should be text, but got 1" {
+		t.Errorf("expected splitting by a number to be an error, got %v", err)
+	}
+}
+
+func TestRegexCache(t *testing.T) {
+	var pattern = "^cache-test-[a-z]+$"
+	first, err := compileRegex(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := compileRegex(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected a pattern to be compiled once")
+	}
+	if _, err := compileRegex("["); err == nil {
+		t.Errorf("expected a bad pattern to be an error")
+	}
+	regexes.Lock()
+	_, cached := regexes.compiled["["]
+	regexes.Unlock()
+	if cached {
+		t.Errorf("expected a bad pattern not to be cached")
+	}
+
+	// patterns that change every row push the oldest out rather than piling up
+	for i := 0; i < regexCacheSize; i++ {
+		if _, err := compileRegex("^row-" + strconv.Itoa(i) + "$"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	regexes.Lock()
+	_, cached = regexes.compiled[pattern]
+	var size = len(regexes.compiled)
+	regexes.Unlock()
+	if cached || size != regexCacheSize {
+		t.Errorf("expected %v patterns without the oldest, got %v (oldest cached: %v)", regexCacheSize, size, cached)
+	}
+}
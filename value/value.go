@@ -1,7 +1,10 @@
 package value
 
 import (
+	"crypto/rand"
+	"fmt"
 	"github.com/witheve/evingo/decimal"
+	"hash/crc32"
 )
 
 // we dont close over the value to avoid taking the closure, although
@@ -37,11 +40,30 @@ func (u Uuid) Equals(v interface{}) bool {
 }
 
 func (u Uuid) HashCode() uint32 {
-	return 0
+	return u.top ^ uint32(u.bottom) ^ uint32(u.bottom>>32)
 }
 
 func (u Uuid) String() string {
-	return ""
+	return fmt.Sprintf("%08x-%016x", u.top, u.bottom)
+}
+
+// NewUuid makes a random Uuid
+func NewUuid() *Uuid {
+	var b [12]byte
+	rand.Read(b[:])
+	var u = &Uuid{}
+	for _, x := range b[:4] {
+		u.top = u.top<<8 | uint32(x)
+	}
+	for _, x := range b[4:] {
+		u.bottom = u.bottom<<8 | uint64(x)
+	}
+	return u
+}
+
+// IsZero is true for the zero Uuid, which is nobody's and nothing's
+func (u Uuid) IsZero() bool {
+	return u.top == 0 && u.bottom == 0
 }
 
 type Text struct {
@@ -56,7 +78,7 @@ func (t Text) Equals(v interface{}) bool {
 }
 
 func (t Text) HashCode() uint32 {
-	return 0
+	return crc32.ChecksumIEEE([]byte(t.s))
 }
 
 func (t Text) String() string {
@@ -85,13 +107,14 @@ type Number struct {
 
 func (n Number) Equals(v interface{}) bool {
 	if t2, ok := v.(*Number); ok {
-		return n.d == t2.d
+		return n.d.Equals(t2.d)
 	}
 	return false
 }
 
+// equal numbers print the same, whatever their exponent
 func (n Number) HashCode() uint32 {
-	return 0
+	return crc32.ChecksumIEEE([]byte(n.d.String()))
 }
 
 func (n Number) String() string {
@@ -114,7 +137,16 @@ func NewNumberFromFloat(n float64) Value {
 	return &Number{decimal.NewFromFloat(n)}
 }
 func NewNumberFromInt(n int64) Value {
-	return &Number{decimal.New(n, 1)}
+	return &Number{decimal.New(n, 0)}
+}
+
+// ParseNumber is NewNumberFromString for text that hasn't been checked yet
+func ParseNumber(n string) (Value, error) {
+	var d, err = decimal.NewFromString(n)
+	if err != nil {
+		return nil, err
+	}
+	return &Number{d}, nil
 }
 
 func NewNumberFromString(n string) Value {
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"github.com/witheve/evingo/value"
+	"strings"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+// Views
+//------------------------------------------------------------------------------
+
+// A View is a query's results, kept up to date as facts are added to and
+// removed from the edb it was opened on. Rather than rerunning the query on
+// every change, the view runs it once per pattern the changed fact matches,
+// with that pattern bound to the fact, which finds exactly the results the
+// fact takes part in. Results are counted by how many ways the query derives
+// them, so a result only goes away once the last derivation does, and
+// aggregates downstream see the same inserts and removes the patterns do.
+//
+// A change to what a not's body matches can make results appear or go away
+// anywhere, so a fact that matches a pattern inside a not reruns the whole
+// query instead, and the view takes on the difference.
+//
+// The view keeps up while a transaction commits, but holds its watchers'
+// calls until the commit is over, so they see all of it and can read the
+// edb themselves.
+type View struct {
+	plan       *Plan
+	env        *value.Env
+	relation   *hiding
+	profile    *Profile
+	patterns   []*pattern
+	negated    []*pattern                          // the patterns inside nots
+	scans      func(value.Operator, []value.Value) // every step up to the last pattern
+	rest       func(value.Operator, []value.Value) // the steps after it
+	sink       func(value.Operator, []value.Value) // where scans sends its rows
+	split      int                                 // where scans ends and rest begins
+	rows       map[string]*viewRow
+	order      []string
+	watchers   []func(op value.Operator, row []value.Value)
+	refreshing bool // rerunning the query, so watchers wait for the difference
+	lock       sync.Mutex
+	held       []viewChange // changes the watchers haven't heard about yet
+	err        error
+	unlisten   func()
+}
+
+type viewRow struct {
+	row   []value.Value
+	count int
+}
+
+type viewChange struct {
+	op  value.Operator
+	row []value.Value
+}
+
+func rowString(row []value.Value) string {
+	var parts = make([]string, len(row))
+	for ix, v := range row {
+		if v == nil {
+			parts[ix] = "nil"
+		} else {
+			parts[ix] = v.String()
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// NewView runs plan against c and listens to every bag c reads for changes
+func NewView(plan *Plan, c context) *View {
+	return newView(plan, c, nil)
+}
+
+// newView is NewView, recording into profile if it isn't nil
+func newView(plan *Plan, c context, profile *Profile) *View {
+	var view = &View{plan: plan, profile: profile, rows: make(map[string]*viewRow)}
+	var relation value.Index = c
+	if profile != nil {
+		relation = &profiledRelation{c, profile}
+	}
+	view.relation = &hiding{Index: relation}
+	view.env = &value.Env{Relation: view.relation}
+
+	for ix, step := range plan.steps {
+		if step.pattern != nil || step.join != nil {
+			view.split = ix + 1
+			view.patterns = append(view.patterns, step.patterns()...)
+		}
+	}
+	view.negated = negatedPatterns(plan.steps)
+	view.run()
+	var unlisten []func()
+	if c.asOf != 0 {
+		// the past doesn't change
+		view.unlisten = func() {}
+		return view
+	}
+	for _, db := range c.edbs() {
+		var db = db
+		unlisten = append(unlisten, db.Listen(func(op value.Operator, e, a, v value.Value) {
+			if !c.elsewhere(db, e, a, v) {
+				view.change(op, e, a, v)
+			}
+			if !db.commits.applying {
+				view.deliver()
+			}
+		}))
+		unlisten = append(unlisten, db.OnCommit(func(Commit) {
+			view.deliver()
+		}))
+	}
+	view.unlisten = func() {
+		for _, f := range unlisten {
+			f()
+		}
+	}
+	return view
+}
+
+// run builds the steps afresh, so any aggregate starts out empty, and runs
+// the query from scratch
+func (view *View) run() {
+	var plan = view.plan
+	view.rest = plan.build(view.env, plan.steps[view.split:], view.result, view.profile)
+	view.sink = view.rest
+	view.scans = plan.build(view.env, plan.steps[:view.split], func(op value.Operator, row []value.Value) {
+		view.sink(op, row)
+	}, view.profile)
+	view.scans(value.OpInsert, make([]value.Value, plan.size))
+	view.scans(value.OpFlush, nil)
+}
+
+// negatedPatterns collects the patterns in the bodies of steps' nots, and of
+// the nots inside those
+func negatedPatterns(steps []*PlanStep) []*pattern {
+	var result []*pattern
+	for _, step := range steps {
+		if step.not == nil {
+			continue
+		}
+		for _, inner := range step.body {
+			if inner.pattern != nil || inner.join != nil {
+				result = append(result, inner.patterns()...)
+			}
+		}
+		result = append(result, negatedPatterns(step.body)...)
+	}
+	return result
+}
+
+func (step *PlanStep) patterns() []*pattern {
+	if step.join != nil {
+		return step.join
+	}
+	return []*pattern{step.pattern}
+}
+
+// matches binds p's terms to a fact, returning false if they don't agree
+func (p *pattern) matches(row []value.Value, fact [3]value.Value) bool {
+	for ix, t := range p.terms {
+		if t.constant != nil {
+			if !t.constant.Equals(fact[ix]) {
+				return false
+			}
+		} else if row[t.register] == nil {
+			row[t.register] = fact[ix]
+		} else if !row[t.register].Equals(fact[ix]) {
+			return false
+		}
+	}
+	return true
+}
+
+// change runs the query once for each pattern the fact matches. A result that
+// uses the fact for more than one pattern would turn up once per pattern, so
+// each run only keeps results where this is the first pattern using the fact.
+func (view *View) change(op value.Operator, e, a, v value.Value) {
+	var fact = [3]value.Value{e, a, v}
+	for _, p := range view.negated {
+		if p.matches(make([]value.Value, view.plan.size), fact) {
+			view.refresh(op, fact)
+			return
+		}
+	}
+	for ix, p := range view.patterns {
+		var row = make([]value.Value, view.plan.size)
+		if !p.matches(row, fact) {
+			continue
+		}
+		var earlier = view.patterns[:ix]
+		view.sink = func(op value.Operator, row []value.Value) {
+			if op == value.OpInsert || op == value.OpRemove {
+				for _, q := range earlier {
+					if q.uses(row, fact) {
+						return
+					}
+				}
+			}
+			view.rest(op, row)
+		}
+		view.scans(op, row)
+	}
+	view.sink = view.rest
+	view.rest(value.OpFlush, nil)
+}
+
+// refresh reruns the query after fact changes and tells the watchers what
+// that changed. Results that were there before keep their place in the order.
+func (view *View) refresh(op value.Operator, fact [3]value.Value) {
+	var before, order = view.rows, view.order
+	view.rows, view.order = make(map[string]*viewRow), nil
+	view.refreshing = true
+	if op == value.OpRemove {
+		// the edb announces a remove before the fact goes
+		view.relation.fact = &fact
+	}
+	view.run()
+	view.relation.fact = nil
+	view.refreshing = false
+
+	var after, added = view.rows, view.order
+	view.order = nil
+	for _, key := range order {
+		if _, ok := after[key]; ok {
+			view.order = append(view.order, key)
+		}
+	}
+	for _, key := range added {
+		if _, ok := before[key]; !ok {
+			view.order = append(view.order, key)
+		}
+	}
+	for _, key := range order {
+		if _, ok := after[key]; !ok {
+			view.notify(value.OpRemove, before[key].row)
+		}
+	}
+	for _, key := range added {
+		if _, ok := before[key]; !ok {
+			view.notify(value.OpInsert, after[key].row)
+		}
+	}
+}
+
+// hiding is a relation that can leave out a fact, which is how a view reruns
+// its query against the edb as it will be once a fact being removed is gone
+type hiding struct {
+	value.Index
+	fact *[3]value.Value
+}
+
+func (r *hiding) hides(e, a, v value.Value) bool {
+	return r.fact != nil && r.fact[0].Equals(e) && r.fact[1].Equals(a) && r.fact[2].Equals(v)
+}
+
+func (r *hiding) Scan(e, a, v value.Value, f func(e, a, v value.Value)) {
+	if r.fact == nil {
+		r.Index.Scan(e, a, v, f)
+		return
+	}
+	r.Index.Scan(e, a, v, func(e, a, v value.Value) {
+		if !r.hides(e, a, v) {
+			f(e, a, v)
+		}
+	})
+}
+
+func (r *hiding) Contains(e, a, v value.Value) bool {
+	return !r.hides(e, a, v) && r.Index.Contains(e, a, v)
+}
+
+// uses reports whether p, resolved against a finished row, is the fact
+func (p *pattern) uses(row []value.Value, fact [3]value.Value) bool {
+	for ix, t := range p.terms {
+		var v = t.constant
+		if v == nil {
+			v = row[t.register]
+		}
+		if v == nil || !v.Equals(fact[ix]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (view *View) result(op value.Operator, row []value.Value) {
+	switch op {
+	case value.OpError:
+		if view.err == nil {
+			view.err = errors.New(row[0].(*value.Text).Value())
+		}
+		return
+	case value.OpInsert, value.OpRemove:
+	default:
+		return
+	}
+	var key = rowString(row)
+	var existing, ok = view.rows[key]
+	if op == value.OpInsert {
+		if ok {
+			existing.count++
+			return
+		}
+		view.rows[key] = &viewRow{row: row, count: 1}
+		view.order = append(view.order, key)
+	} else {
+		if !ok {
+			return
+		}
+		if existing.count--; existing.count > 0 {
+			return
+		}
+		// the row the view kept, since watchers hear about it later
+		row = existing.row
+		delete(view.rows, key)
+		for ix, k := range view.order {
+			if k == key {
+				view.order = append(view.order[:ix], view.order[ix+1:]...)
+				break
+			}
+		}
+	}
+	if !view.refreshing {
+		view.notify(op, row)
+	}
+}
+
+// notify holds a change for the watchers until deliver
+func (view *View) notify(op value.Operator, row []value.Value) {
+	view.lock.Lock()
+	view.held = append(view.held, viewChange{op, row})
+	view.lock.Unlock()
+}
+
+// deliver tells the watchers about the changes held for them
+func (view *View) deliver() {
+	view.lock.Lock()
+	var held = view.held
+	view.held = nil
+	view.lock.Unlock()
+	for _, change := range held {
+		for _, watcher := range view.watchers {
+			watcher(change.op, change.row)
+		}
+	}
+}
+
+// Rows are the view's current results, oldest first
+func (view *View) Rows() [][]value.Value {
+	var rows [][]value.Value
+	for _, key := range view.order {
+		rows = append(rows, view.rows[key].row)
+	}
+	return rows
+}
+
+// Watch calls f whenever a result appears (OpInsert) or goes away (OpRemove),
+// once the commit that made the change is over
+func (view *View) Watch(f func(op value.Operator, row []value.Value)) {
+	view.watchers = append(view.watchers, f)
+}
+
+// Err is the first error the query ran into, if any
+func (view *View) Err() error {
+	return view.err
+}
+
+// Close stops the view following the edb
+func (view *View) Close() {
+	view.unlisten()
+}
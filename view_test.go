@@ -0,0 +1,304 @@
+package main
+
+import (
+	"github.com/witheve/evingo/value"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// trianglesPerNode counts the triangles each node starts, which puts an
+// aggregate downstream of a cyclic join
+func trianglesPerNode() *QueryNode {
+	var query = triangleQuery()
+	var count = &VariableNode{id: "count", name: "count"}
+	query.variables["count"] = count
+	var expression = &ExpressionNode{id: "e0", operator: "count"}
+	expression.bindings = []*BindingNode{{id: "e0r", field: "return", variable: count, source: expression}}
+	expression.grouping = []*VariableNode{query.variables["a"]}
+	expression.projection = []*VariableNode{query.variables["b"], query.variables["c"]}
+	query.expressions[expression.id] = expression
+	return query
+}
+
+// oneWayEdges finds edges without one going back. Its not's body has
+// variables of its own that it shares with the query by name, the way loaded
+// programs do.
+func oneWayEdges() *QueryNode {
+	var query = NewQuery("one way")
+	var body = NewQuery("one way.not")
+	for _, q := range []*QueryNode{query, body} {
+		for _, name := range []string{"a", "b"} {
+			q.variables[name] = &VariableNode{id: q.id + "." + name, name: name}
+		}
+	}
+	var edge = value.NewText("edge")
+	var scan = func(q *QueryNode, id string, from string, to string) {
+		var s = &ScanNode{id: id}
+		s.bindings = []*BindingNode{
+			{id: id + "e", field: "entity", variable: q.variables[from], source: s},
+			{id: id + "a", field: "attribute", constant: edge, source: s},
+			{id: id + "v", field: "value", variable: q.variables[to], source: s},
+		}
+		q.scans[id] = s
+	}
+	scan(query, "s1", "a", "b")
+	scan(body, "s2", "b", "a")
+	query.nots["n1"] = &NotNode{id: "n1", body: body}
+	return query
+}
+
+func TestPlanNots(t *testing.T) {
+	var plan, err = PlanQuery(oneWayEdges(), nil, JoinNested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.steps) != 2 || plan.steps[1].String() != `not n1 (scan s2 [b "edge" a] ~1 rows)` {
+		t.Fatalf("expected the not to run after the scan, against its registers, got %v", plan)
+	}
+
+	var c = context{e: *NewEdb()}
+	for _, pair := range [][2]int64{{0, 1}, {1, 0}, {2, 3}} {
+		insert(c, value.NewNumberFromInt(pair[0]), value.NewText("edge"), value.NewNumberFromInt(pair[1]))
+	}
+	var rows = rerun(t, plan, c)
+	if len(rows) != 1 || rows[0] != "2\x003" {
+		t.Fatalf("expected only 2 -> 3 to be one way, got %q", rows)
+	}
+
+	var union = oneWayEdges()
+	union.unions["u1"] = &UnionNode{id: "u1"}
+	if _, err := PlanQuery(union, nil, JoinNested); err == nil || err.Error() != "query 'one way': union 'u1' can't be planned yet" {
+		t.Fatalf("expected a union to be an error, got %v", err)
+	}
+	var stranded = oneWayEdges()
+	delete(stranded.scans, "s1")
+	if _, err := PlanQuery(stranded, nil, JoinNested); err == nil || err.Error() != "query 'one way': not 'n1' uses variables nothing binds" {
+		t.Fatalf("expected a not with nothing to test to be an error, got %v", err)
+	}
+}
+
+func sortedRows(rows [][]value.Value) []string {
+	var result []string
+	for _, row := range rows {
+		result = append(result, rowString(row))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func rerun(t *testing.T, plan *Plan, c context) []string {
+	var rows [][]value.Value
+	if err := plan.Run(c, func(row []value.Value) { rows = append(rows, row) }); err != nil {
+		t.Fatal(err)
+	}
+	return sortedRows(rows)
+}
+
+func TestPlanStepArguments(t *testing.T) {
+	var query = NewQuery("sum")
+	for _, name := range []string{"x", "y"} {
+		query.variables[name] = &VariableNode{id: name, name: name}
+	}
+	var plus = &ExpressionNode{id: "e1", operator: "+"}
+	plus.bindings = []*BindingNode{
+		{id: "b1", field: "return", variable: query.variables["y"], source: plus},
+		{id: "b2", field: "b", constant: value.NewNumberFromInt(1), source: plus},
+		{id: "b3", field: "a", variable: query.variables["x"], source: plus},
+	}
+	query.expressions[plus.id] = plus
+	var bound = &ExpressionNode{id: "e0", operator: "+"}
+	bound.bindings = []*BindingNode{
+		{id: "b4", field: "a", constant: value.NewNumberFromInt(1), source: bound},
+		{id: "b5", field: "b", constant: value.NewNumberFromInt(2), source: bound},
+		{id: "b6", field: "return", variable: query.variables["x"], source: bound},
+	}
+	query.expressions[bound.id] = bound
+	var plan, err = PlanQuery(query, nil, JoinNested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.steps[1].String(); got != "expression e1 +(a: x, b: 1, return: y)" {
+		t.Errorf("expected the arguments in field order, got %v", got)
+	}
+}
+
+func TestViewMatchesRerun(t *testing.T) {
+	var random = rand.New(rand.NewSource(7))
+	var edge = value.NewText("edge")
+	for _, query := range []*QueryNode{triangleQuery(), trianglesPerNode(), oneWayEdges()} {
+		for _, strategy := range []JoinStrategy{JoinNested, JoinGeneric} {
+			var c = randomGraph(12, 40)
+			var plan, err = PlanQuery(query, &c.e, strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var view = NewView(plan, c)
+			for i := 0; i < 200; i++ {
+				var from = value.NewNumberFromInt(int64(random.Intn(12)))
+				var to = value.NewNumberFromInt(int64(random.Intn(12)))
+				if random.Intn(2) == 0 {
+					insert(c, from, edge, to)
+				} else {
+					remove(c, from, edge, to)
+				}
+				if err := view.Err(); err != nil {
+					t.Fatal(err)
+				}
+				var incremental, expected = sortedRows(view.Rows()), rerun(t, plan, c)
+				if len(incremental) != len(expected) {
+					t.Fatalf("%v after change %v: view has %v rows, rerunning gives %v", query.id, i, len(incremental), len(expected))
+				}
+				for ix := range expected {
+					if incremental[ix] != expected[ix] {
+						t.Fatalf("%v after change %v: view has %q, rerunning gives %q", query.id, i, incremental[ix], expected[ix])
+					}
+				}
+			}
+			view.Close()
+		}
+	}
+}
+
+func TestViewAcrossBags(t *testing.T) {
+	var bags = NewBags()
+	var alice, bob = *value.NewUuid(), *value.NewUuid()
+	var mine, _ = bags.Create("mine", alice)
+	bags.Create("shared", value.Uuid{})
+	if _, err := bags.Context(bob, "mine"); err == nil {
+		t.Fatal("expected bob not to see alice's bag")
+	}
+	mine.Share(bob)
+	if len(bags.Visible(bob)) != 2 {
+		t.Fatalf("expected bob to see both bags once shared, got %v", len(bags.Visible(bob)))
+	}
+
+	var c, err = bags.Context(bob, "shared", "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mineOnly, _ = bags.Context(alice, "mine")
+	var plan, _ = PlanQuery(triangleQuery(), &c.e, JoinGeneric)
+	var view = NewView(plan, c)
+	defer view.Close()
+	var edge = value.NewText("edge")
+	var node = func(n int64) value.Value { return value.NewNumberFromInt(n) }
+	insert(c, node(0), edge, node(1))
+	insert(mineOnly, node(1), edge, node(2))
+	insert(mineOnly, node(2), edge, node(0))
+	if len(view.Rows()) != 3 {
+		t.Fatalf("expected the triangle from both bags, got %v rows", len(view.Rows()))
+	}
+	// the fact is still in one of the bags, so nothing changes
+	insert(mineOnly, node(0), edge, node(1))
+	remove(c, node(0), edge, node(1))
+	if len(view.Rows()) != 3 || len(rerun(t, plan, c)) != 3 {
+		t.Fatalf("expected the triangle to survive, got %v rows", len(view.Rows()))
+	}
+	remove(mineOnly, node(0), edge, node(1))
+	if len(view.Rows()) != 0 {
+		t.Fatalf("expected the triangle to go, got %v rows", len(view.Rows()))
+	}
+}
+
+// watchers hear about a commit once it's over: they see every change it made,
+// and can read the edb without waiting on it
+func TestWatchersSeeWholeCommits(t *testing.T) {
+	var c = context{e: *NewEdb()}
+	var plan, _ = PlanQuery(triangleQuery(), &c.e, JoinNested)
+	var view = NewView(plan, c)
+	defer view.Close()
+	var edge = value.NewText("edge")
+	var node = func(n int64) value.Value { return value.NewNumberFromInt(n) }
+	var heard, edges []int
+	view.Watch(func(op value.Operator, row []value.Value) {
+		var n = 0
+		c.Read(func() {
+			scan(c, nil, edge, nil, func(e, a, v value.Value) { n++ })
+		})
+		heard = append(heard, len(view.Rows()))
+		edges = append(edges, n)
+	})
+
+	var tx = c.Begin()
+	tx.Insert(node(0), edge, node(1))
+	tx.Insert(node(1), edge, node(2))
+	tx.Insert(node(2), edge, node(0))
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(heard) != 3 {
+		t.Fatalf("expected to hear about the triangle's 3 rows, heard %v", heard)
+	}
+	for ix := range heard {
+		if heard[ix] != 3 || edges[ix] != 3 {
+			t.Fatalf("expected every call to see the whole commit, saw %v rows and %v edges", heard, edges)
+		}
+	}
+
+	// outside a transaction there's no commit to wait for
+	heard = nil
+	remove(c, node(2), edge, node(0))
+	if len(heard) != 3 {
+		t.Fatalf("expected a change outside a transaction to be heard at once, heard %v", heard)
+	}
+}
+
+// two rows with the same given: value but different values to sum both
+// count, and each remove takes out the value its insert put in
+func TestAggregateOverSharedProjection(t *testing.T) {
+	var query = NewQuery("ages")
+	for _, name := range []string{"p", "name", "age", "total"} {
+		query.variables[name] = &VariableNode{id: name, name: name}
+	}
+	for ix, attribute := range []string{"name", "age"} {
+		var scan = &ScanNode{id: "s" + strconv.Itoa(ix)}
+		scan.bindings = []*BindingNode{
+			{id: scan.id + "e", field: "entity", variable: query.variables["p"], source: scan},
+			{id: scan.id + "a", field: "attribute", constant: value.NewText(attribute), source: scan},
+			{id: scan.id + "v", field: "value", variable: query.variables[attribute], source: scan},
+		}
+		query.scans[scan.id] = scan
+	}
+	var sum = &ExpressionNode{id: "e0", operator: "sum"}
+	sum.bindings = []*BindingNode{
+		{id: "e0v", field: "value", variable: query.variables["age"], source: sum},
+		{id: "e0r", field: "return", variable: query.variables["total"], source: sum},
+	}
+	sum.projection = []*VariableNode{query.variables["name"]}
+	query.expressions[sum.id] = sum
+
+	var c = context{e: *NewEdb()}
+	var plan, err = PlanQuery(query, &c.e, JoinNested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var view = NewView(plan, c)
+	defer view.Close()
+	var total = func() string {
+		var rows = view.Rows()
+		if len(rows) == 0 {
+			return ""
+		}
+		return rows[0][plan.registers[query.variables["total"]]].String()
+	}
+	var name, age = value.NewText("name"), value.NewText("age")
+	var ada, bea = value.NewText("ada"), value.NewText("bea")
+	for _, p := range []value.Value{ada, bea} {
+		insert(c, p, name, value.NewText("Ada"))
+	}
+	insert(c, ada, age, value.NewNumberFromInt(3))
+	insert(c, bea, age, value.NewNumberFromInt(5))
+	if total() != "8" {
+		t.Fatalf("expected both ages to count, got %v", total())
+	}
+	remove(c, ada, age, value.NewNumberFromInt(3))
+	if total() != "5" || view.Err() != nil {
+		t.Fatalf("expected the first age to go, got %v (%v)", total(), view.Err())
+	}
+	remove(c, bea, age, value.NewNumberFromInt(5))
+	if total() != "" || view.Err() != nil {
+		t.Fatalf("expected nothing left, got %v (%v)", total(), view.Err())
+	}
+}
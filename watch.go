@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"github.com/witheve/evingo/util/color"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// Watching
+//------------------------------------------------------------------------------
+
+// A Watcher keeps a program running while its source file is edited. Each
+// time the file changes, the blocks whose source text changed are swapped
+// for their new versions and the rest carry on untouched.
+type Watcher struct {
+	path    string
+	c       context
+	runtime *Runtime
+	sources map[*QueryNode]string // each running block's query, as written
+	code    string
+	out     io.Writer
+}
+
+// NewWatcher runs the program in path in the bags openBags makes of bags and
+// prints the facts it ends with. A program with errors doesn't stop the
+// watcher; nothing runs until they're fixed.
+func NewWatcher(path string, bags []string, out io.Writer) (*Watcher, error) {
+	c, err := openBags(bags)
+	if err != nil {
+		return nil, err
+	}
+	runtime, err := NewRuntime(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	var watcher = &Watcher{path: path, c: c, runtime: runtime, sources: make(map[*QueryNode]string), out: out}
+	if _, err := watcher.Poll(); err != nil {
+		runtime.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// sourcesOf is the source text of each query: its lines up to the next
+// query's, without the blank lines around them
+func sourcesOf(code string, queries []*QueryNode) map[*QueryNode]string {
+	var lines = strings.Split(code, "\n")
+	var sorted = append([]*QueryNode(nil), queries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].line < sorted[j].line
+	})
+	var sources = make(map[*QueryNode]string)
+	for ix, query := range sorted {
+		var end = len(lines)
+		if ix+1 < len(sorted) {
+			end = sorted[ix+1].line - 1
+		}
+		var start = query.line - 1
+		if start < 0 || start > end {
+			start = end
+		}
+		sources[query] = strings.TrimSpace(strings.Join(lines[start:end], "\n"))
+	}
+	return sources
+}
+
+// Poll reloads the program if its file has changed since the last poll, runs
+// it and prints what that changed. It reports whether there was a change. If
+// the new version has errors they're printed and the old one keeps running.
+func (watcher *Watcher) Poll() (bool, error) {
+	raw, err := ioutil.ReadFile(watcher.path)
+	if err != nil {
+		return false, err
+	}
+	var code = string(raw)
+	if code == watcher.code {
+		return false, nil
+	}
+	watcher.code = code
+	queries, diagnostics, err := LoadProgramString(watcher.path, code)
+	if err == nil {
+		diagnostics = append(diagnostics, CheckQueries(queries)...)
+	}
+	printDiagnostics(watcher.out, watcher.path, diagnostics, "text")
+	if err != nil || HasErrors(diagnostics) {
+		if err != nil {
+			fmt.Fprintln(watcher.out, color.Error(watcher.path+": "+err.Error()))
+		}
+		fmt.Fprintln(watcher.out, color.Warning("Keeping the program that was running"))
+		return true, nil
+	}
+
+	var from = watcher.c.e.LastCommit()
+	var sources = sourcesOf(code, queries)
+	reload, err := watcher.runtime.Reload(queries, func(block *Block, query *QueryNode) bool {
+		return watcher.sources[block.query] == sources[query]
+	})
+	if err != nil {
+		fmt.Fprintln(watcher.out, color.Error(watcher.path+": "+err.Error()))
+		fmt.Fprintln(watcher.out, color.Warning("Keeping the program that was running"))
+		return true, nil
+	}
+	var kept = make(map[*QueryNode]string)
+	for ix, block := range watcher.runtime.Blocks() {
+		kept[block.query] = sources[queries[ix]]
+	}
+	watcher.sources = kept
+	if _, err := watcher.runtime.Run(); err != nil {
+		return true, err
+	}
+
+	fmt.Fprintf(watcher.out, "%d block(s) added, %d removed, %d fact(s) retracted\n", len(reload.Added), len(reload.Removed), reload.Retracted)
+	var added, removed = watcher.c.e.Diff(from, 0)
+	var changes []string
+	for _, fact := range added {
+		changes = append(changes, "+ "+textOf(fact[0])+" "+textOf(fact[1])+" "+fact[2].String())
+	}
+	for _, fact := range removed {
+		changes = append(changes, "- "+textOf(fact[0])+" "+textOf(fact[1])+" "+fact[2].String())
+	}
+	sort.Strings(changes)
+	for _, change := range changes {
+		fmt.Fprintln(watcher.out, change)
+	}
+	return true, nil
+}
+
+// Watch polls every interval until stop is closed. A file that can't be read
+// for a moment, as happens while some editors save, is reported and polled
+// again.
+func (watcher *Watcher) Watch(interval time.Duration, stop <-chan struct{}) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := watcher.Poll(); err != nil {
+				fmt.Fprintln(watcher.out, color.Error(watcher.path+": "+err.Error()))
+			}
+		}
+	}
+}
+
+// Close stops the running program
+func (watcher *Watcher) Close() {
+	watcher.runtime.Close()
+}
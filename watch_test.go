@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"github.com/witheve/evingo/value"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcherReloadsChangedBlocks(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "program.e")
+	var people = "people\n  add\n    #person name: \"Ada\"\n\n"
+	var pets = "pets\n  add forever\n    #pet name: \"Rex\"\n\n"
+	var greet = "greet\n  #person name\n  add\n    #greeting who: name\n"
+	var save = func(code string) {
+		if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names = func(c context) map[string]bool {
+		var found = make(map[string]bool)
+		scan(c, nil, value.NewText("name"), nil, func(e, a, v value.Value) {
+			found[textOf(v)] = true
+		})
+		return found
+	}
+
+	save(people + pets + greet)
+	var out bytes.Buffer
+	watcher, err := NewWatcher(path, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if found := names(watcher.c); !found["Ada"] || !found["Rex"] {
+		t.Fatalf("expected Ada and Rex, got %v\n%v", found, out.String())
+	}
+	var greetBlock = watcher.runtime.Blocks()[2]
+
+	save(people + pets + greet)
+	if changed, err := watcher.Poll(); err != nil || changed {
+		t.Fatalf("expected an unchanged file to do nothing, got %v %v", changed, err)
+	}
+
+	save("people\n  add\n    #person name: \"Bea\"\n\n" + pets + greet)
+	if _, err := watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if found := names(watcher.c); found["Ada"] || !found["Bea"] || !found["Rex"] {
+		t.Fatalf("expected Ada to be swapped for Bea, got %v\n%v", found, out.String())
+	}
+	if watcher.runtime.Blocks()[2] != greetBlock {
+		t.Fatalf("expected the unchanged block to keep running")
+	}
+
+	save(greet)
+	if _, err := watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if found := names(watcher.c); found["Bea"] || !found["Rex"] {
+		t.Fatalf("expected Bea to go with her block and Rex to stay forever, got %v\n%v", found, out.String())
+	}
+
+	save(greet + "broken\n  add\n    #thing name: nowhere\n")
+	if _, err := watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(watcher.runtime.Blocks()) != 1 {
+		t.Fatalf("expected a program with errors to leave the old one running\n%v", out.String())
+	}
+
+	// the new block is q1 now, like the kept one was, but mustn't make up the
+	// same entities
+	var first = "first\n  add\n    #note text: \"first\"\n\n"
+	var second = "second\n  add\n    #note text: \"second\"\n\n"
+	save(first)
+	if _, err := watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	save(second + first)
+	if _, err := watcher.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	var texts = make(map[string][]string)
+	scan(watcher.c, nil, value.NewText("text"), nil, func(e, a, v value.Value) {
+		texts[e.String()] = append(texts[e.String()], textOf(v))
+	})
+	if len(texts) != 2 {
+		t.Fatalf("expected two notes with a text each, got %v\n%v", texts, out.String())
+	}
+}